@@ -1,21 +1,47 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sharded-counters/internal/config"
+	countermetadata "sharded-counters/internal/counter_metadata"
 	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/loadbalancer"
+	metadatacache "sharded-counters/internal/metadata_cache"
 	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/rebalancer"
 	"sharded-counters/internal/server"
 	shardmetadata "sharded-counters/internal/shard_metadata"
 	counter "sharded-counters/internal/shard_store"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 )
 
+// shutdownTimeout bounds how long in-flight requests may take to finish once
+// the server stops accepting new ones.
+const shutdownTimeout = 10 * time.Second
+
+// drainPollInterval is how often a draining shard checks whether its values
+// have been handed over.
+const drainPollInterval = 500 * time.Millisecond
+
 func main() {
+	// Shut down gracefully on SIGTERM, which Kubernetes sends to stop a pod.
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+
+	// Load handler configuration.
+	cfg, err := config.FromEnv()
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
 	// Initialize CounterManager and EtcdManager.
 	counterManager := counter.GetCounterManager()
 	// Initialize etcd client
@@ -23,14 +49,18 @@ func main() {
 	if etcdEndpoints == "" {
 		etcdEndpoints = "localhost:2379"
 	}
-	etcdManager, err := etcd.NewEtcdManager([]string{etcdEndpoints}, 5*time.Second)
+	etcdManager, err := etcd.NewEtcdManager([]string{etcdEndpoints}, 5*time.Second, cfg.EtcdRequestTimeout)
 	if err != nil {
 		log.Fatalf("Failed to initialize etcd client: %v", err)
 	}
 	defer etcdManager.Close()
 
-	// Get shard ID
-	shardID := os.Getenv("POD_IP")
+	// Get shard ID: the host app servers reach the shard at. It must survive
+	// restarts for the shard to keep its WAL and its place in counter records.
+	shardID := os.Getenv("SHARD_ID")
+	if shardID == "" {
+		shardID = os.Getenv("POD_IP")
+	}
 	if shardID == "" {
 		shardID = "unknown"
 	}
@@ -44,15 +74,82 @@ func main() {
 		servType = "app"
 	}
 
+	// Removes the shard from the registry; set once the shard registers.
+	deregister := func() {}
 	if servType == "shard" {
-		go shardmetadata.StoreMetrics(etcdManager, shardID, shardInterval)
+		// Rebuild shard values from the WAL before registering the shard in etcd.
+		syncPolicy, err := counter.ParseSyncPolicy(cfg.WALSyncPolicy)
+		if err != nil {
+			log.Fatalf("Invalid WAL configuration: %v", err)
+		}
+		walOpts := counter.WALOptions{Dir: cfg.WALDir, SyncPolicy: syncPolicy, SyncInterval: cfg.WALSyncInterval}
+		if err := counterManager.EnableWAL(walOpts); err != nil {
+			log.Fatalf("Failed to initialize WAL: %v", err)
+		}
+		defer counterManager.Close()
 
+		snapshotOpts := counter.SnapshotOptions{Interval: cfg.SnapshotInterval, MaxWALBytes: int64(cfg.SnapshotMaxWALBytes)}
+		stopSnapshots := make(chan struct{})
+		snapshotsDone := make(chan struct{})
+		// Runs before the WAL is closed, so no snapshot is still writing to it.
+		defer func() {
+			close(stopSnapshots)
+			<-snapshotsDone
+		}()
+		go func() {
+			defer close(snapshotsDone)
+			counterManager.RunSnapshots(snapshotOpts, stopSnapshots)
+		}()
+
+		// Report the shard read-only while its WAL cannot be written.
+		shardmetadata.SetWALCheck(counterManager.CheckWAL)
+		shardmetadata.SetCounterCount(counterManager.Count)
+
+		registryCtx, stopRegistry := context.WithCancel(context.Background())
+		registered := make(chan struct{})
+		go func() {
+			defer close(registered)
+			shardmetadata.StoreMetrics(registryCtx, etcdManager, shardID, shardInterval)
+		}()
+		deregister = func() {
+			stopRegistry()
+			<-registered
+		}
+	}
+
+	placement, err := countermetadata.ParsePlacement(cfg.PlacementStrategy, cfg.HashRingVirtualNodes)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+	weights, err := loadbalancer.ParseSelectionWeights(cfg.ShardSelection)
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
 	}
 
 	// Create a Dependencies container.
 	deps := &middleware.Dependencies{
 		CounterManager: counterManager,
 		EtcdManager:    etcdManager,
+		Config:         cfg,
+		Placement:      placement,
+		Selection:      &loadbalancer.MetricsStrategy{MaxStaleness: cfg.ShardMetricsMaxAge, Weights: weights},
+	}
+
+	if servType == "app" {
+		watchCtx, stopWatch := context.WithCancel(context.Background())
+		defer stopWatch()
+
+		// Serve counter records and shard health from memory, kept fresh by watches.
+		cache := metadatacache.New(etcdManager, cfg.MetadataCacheSize, countermetadata.CounterPrefix+"/", shardmetadata.ShardKeyPrefix)
+		go cache.Run(watchCtx)
+		deps.EtcdManager = cache
+		deps.MetadataCache = cache
+
+		// Keep counter shard lists in line with the shards that are alive.
+		rb := rebalancer.New(cache, placement, cfg.DeadShardGrace, cfg.ShardQueryTimeout)
+		stopRebalancer := make(chan struct{})
+		defer close(stopRebalancer)
+		go rb.Run(cfg.RebalanceInterval, etcd.WatchChanges(watchCtx, etcdManager, shardmetadata.ShardKeyPrefix), stopRebalancer)
 	}
 
 	startAPI(deps)
@@ -61,9 +158,51 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	log.Printf("Starting server on port %s", port)
-	if err := http.ListenAndServe(fmt.Sprintf(":%s", port), nil); err != nil {
+	srv := &http.Server{Addr: fmt.Sprintf(":%s", port)}
+	serverErr := make(chan error, 1)
+	go func() {
+		log.Printf("Starting server on port %s", port)
+		serverErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serverErr:
 		log.Fatalf("Server failed to start: %v", err)
+	case <-signalCtx.Done():
+	}
+	log.Printf("Shutting down")
+
+	if servType == "shard" {
+		drainShard(counterManager, cfg.DrainTimeout)
+	}
+	// Revoke the shard's lease so that it leaves the registry right away.
+	deregister()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+}
+
+// drainShard marks the shard as draining, so that app servers stop routing
+// writes to it and hand its values over to other shards, and waits up to
+// timeout for them to finish. Values still held afterwards are persisted in a
+// snapshot.
+func drainShard(counterManager *counter.CounterManager, timeout time.Duration) {
+	shardmetadata.SetDraining(true)
+	deadline := time.Now().Add(timeout)
+	for counterManager.CountNonZero() > 0 && time.Now().Before(deadline) {
+		time.Sleep(drainPollInterval)
+	}
+	remaining := counterManager.CountNonZero()
+	if remaining == 0 {
+		log.Printf("Shard drained")
+		return
+	}
+	log.Printf("%d counters were not handed over within %v; persisting them", remaining, timeout)
+	if err := counterManager.Snapshot(); err != nil {
+		log.Printf("Error persisting shard values: %v", err)
 	}
 }
 
@@ -75,10 +214,26 @@ func startAPI(deps *middleware.Dependencies) {
 	r.Handle("/counter", middleware.Middleware(deps, http.HandlerFunc(server.CreateCounterHandler))).Methods(http.MethodPost)
 	r.Handle("/counter/increment", middleware.Middleware(deps, http.HandlerFunc(server.IncrementCounterHandler))).Methods(http.MethodPut)
 	r.Handle("/counter/decrement", middleware.Middleware(deps, http.HandlerFunc(server.DecrementCounterHandler))).Methods(http.MethodPut)
+	r.Handle("/counter/batch", middleware.Middleware(deps, http.HandlerFunc(server.BatchCounterHandler))).Methods(http.MethodPost)
+	r.Handle("/counter/reset", middleware.Middleware(deps, http.HandlerFunc(server.ResetCounterHandler))).Methods(http.MethodPost)
 	r.Handle("/counter/shard/increment", middleware.Middleware(deps, http.HandlerFunc(server.IncrementShardCounterHandler))).Methods(http.MethodPut)
 	r.Handle("/counter/shard/decrement", middleware.Middleware(deps, http.HandlerFunc(server.DecrementShardCounterHandler))).Methods(http.MethodPut)
+	r.Handle("/counter/shard/batch", middleware.Middleware(deps, http.HandlerFunc(server.BatchShardCounterHandler))).Methods(http.MethodPost)
 	r.Handle("/counter", middleware.Middleware(deps, http.HandlerFunc(server.GetCounterHandler))).Methods(http.MethodGet)
+	r.Handle("/counter", middleware.Middleware(deps, http.HandlerFunc(server.DeleteCounterHandler))).Methods(http.MethodDelete)
+	r.Handle("/counters", middleware.Middleware(deps, http.HandlerFunc(server.ListCountersHandler))).Methods(http.MethodGet)
+	r.Handle("/counter/by-name", middleware.Middleware(deps, http.HandlerFunc(server.GetCounterByNameHandler))).Methods(http.MethodGet)
+	r.Handle("/counter/values", middleware.Middleware(deps, http.HandlerFunc(server.GetCounterValuesHandler))).Methods(http.MethodPost)
 	r.Handle("/counter/shard", middleware.Middleware(deps, http.HandlerFunc(server.GetShardCounterHandler))).Methods(http.MethodGet)
+	r.Handle("/counter/shard", middleware.Middleware(deps, http.HandlerFunc(server.DeleteShardCounterHandler))).Methods(http.MethodDelete)
+	r.Handle("/counter/shard/values", middleware.Middleware(deps, http.HandlerFunc(server.GetShardCounterValuesHandler))).Methods(http.MethodPost)
+	r.Handle("/shard/admin/snapshot", middleware.Middleware(deps, http.HandlerFunc(server.ShardSnapshotStatsHandler))).Methods(http.MethodGet)
+	r.Handle("/shard/admin/snapshot", middleware.Middleware(deps, http.HandlerFunc(server.ShardSnapshotHandler))).Methods(http.MethodPost)
+	r.Handle("/shard/admin/drain", middleware.Middleware(deps, http.HandlerFunc(server.ShardDrainStatusHandler))).Methods(http.MethodGet)
+	r.Handle("/shard/admin/drain", middleware.Middleware(deps, http.HandlerFunc(server.ShardDrainHandler))).Methods(http.MethodPost)
+	r.Handle("/admin/cache", middleware.Middleware(deps, http.HandlerFunc(server.MetadataCacheStatsHandler))).Methods(http.MethodGet)
+	r.Handle("/admin/shards", middleware.Middleware(deps, http.HandlerFunc(server.ShardsStatusHandler))).Methods(http.MethodGet)
+	r.Handle("/counter/shard/handoff", middleware.Middleware(deps, http.HandlerFunc(server.HandoffShardCounterHandler))).Methods(http.MethodPost)
 
 	// Wrap the router with the middleware.
 	http.Handle("/", r)
@@ -0,0 +1,217 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the tunables used by the API handlers.
+type Config struct {
+	// ShardQueryTimeout bounds a fan-out of read queries across shards.
+	ShardQueryTimeout time.Duration
+	// DefaultShardCount is the number of shards assigned to a counter
+	// created without an explicit shard count.
+	DefaultShardCount int
+	// PlacementStrategy chooses the shards of new counters: "hashring" or
+	// "least-loaded".
+	PlacementStrategy string
+	// HashRingVirtualNodes is the number of points per shard on the
+	// placement hash ring.
+	HashRingVirtualNodes int
+	// RebalanceInterval is how often the rebalancer reconciles all counters
+	// even when no shard joined or left, retrying failed hand-offs.
+	RebalanceInterval time.Duration
+	// DeadShardGrace is how long a shard may be missing from the registry
+	// before it is removed from counter records without a hand-off.
+	DeadShardGrace time.Duration
+	// AutoCreate decides which unknown counters a mutation may create.
+	AutoCreate AutoCreatePolicy
+	// MetadataCacheSize bounds the number of etcd keys cached by app servers.
+	MetadataCacheSize int
+	// EtcdRequestTimeout bounds every etcd request that is not already
+	// bounded by a shorter request deadline.
+	EtcdRequestTimeout time.Duration
+	// DrainTimeout is how long a shard that is shutting down waits for the
+	// app servers to hand its values over before it persists what is left.
+	DrainTimeout time.Duration
+	// ShardMetricsMaxAge is the age beyond which the metrics a shard
+	// published are not trusted for routing writes; zero trusts any age.
+	ShardMetricsMaxAge time.Duration
+	// ShardSelection names the load signals, optionally weighted, by which
+	// writes are routed to the shards of a counter.
+	ShardSelection string
+	// WALDir is the directory of a shard's write-ahead log.
+	WALDir string
+	// WALSyncPolicy is when a shard fsyncs its WAL: "always", "interval"
+	// or "none".
+	WALSyncPolicy string
+	// WALSyncInterval is the fsync period of the "interval" policy.
+	WALSyncInterval time.Duration
+	// SnapshotInterval is the maximum time between snapshots of a shard's
+	// counters.
+	SnapshotInterval time.Duration
+	// SnapshotMaxWALBytes is the size of the WAL written since the last
+	// snapshot beyond which a shard snapshots early.
+	SnapshotMaxWALBytes int
+}
+
+// AutoCreatePolicy decides whether a mutation of an unknown counter ID creates
+// the counter or is rejected.
+type AutoCreatePolicy struct {
+	Enabled  bool
+	Prefixes []string // When set, only IDs starting with one of these are created.
+}
+
+// Allows reports whether the policy lets a mutation create counterID.
+func (p AutoCreatePolicy) Allows(counterID string) bool {
+	if !p.Enabled {
+		return false
+	}
+	if len(p.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range p.Prefixes {
+		if strings.HasPrefix(counterID, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseAutoCreatePolicy parses "off", "on" or a comma-separated list of
+// counter ID prefixes that may be created.
+func ParseAutoCreatePolicy(value string) (AutoCreatePolicy, error) {
+	switch strings.TrimSpace(value) {
+	case "", "off":
+		return AutoCreatePolicy{}, nil
+	case "on":
+		return AutoCreatePolicy{Enabled: true}, nil
+	}
+	policy := AutoCreatePolicy{Enabled: true}
+	for _, prefix := range strings.Split(value, ",") {
+		prefix = strings.TrimSpace(prefix)
+		if prefix == "" {
+			return AutoCreatePolicy{}, fmt.Errorf("empty prefix in auto-create policy %q", value)
+		}
+		policy.Prefixes = append(policy.Prefixes, prefix)
+	}
+	return policy, nil
+}
+
+// Default returns the configuration used when no overrides are set.
+func Default() *Config {
+	return &Config{
+		ShardQueryTimeout:    2 * time.Second,
+		DefaultShardCount:    3,
+		PlacementStrategy:    "hashring",
+		HashRingVirtualNodes: 128,
+		RebalanceInterval:    time.Minute,
+		DeadShardGrace:       2 * time.Minute,
+		MetadataCacheSize:    100000,
+		EtcdRequestTimeout:   5 * time.Second,
+		DrainTimeout:         45 * time.Second,
+		ShardMetricsMaxAge:   15 * time.Second,
+		ShardSelection:       "cpu",
+		WALDir:               "data",
+		WALSyncPolicy:        "interval",
+		WALSyncInterval:      time.Second,
+		SnapshotInterval:     5 * time.Minute,
+		SnapshotMaxWALBytes:  64 << 20,
+	}
+}
+
+// FromEnv returns the default configuration overridden by environment variables.
+func FromEnv() (*Config, error) {
+	cfg := Default()
+	if err := durationFromEnv("SHARD_QUERY_TIMEOUT", &cfg.ShardQueryTimeout); err != nil {
+		return nil, err
+	}
+	if err := intFromEnv("DEFAULT_SHARD_COUNT", &cfg.DefaultShardCount); err != nil {
+		return nil, err
+	}
+	if value := os.Getenv("PLACEMENT_STRATEGY"); value != "" {
+		cfg.PlacementStrategy = value
+	}
+	if err := intFromEnv("HASH_RING_VIRTUAL_NODES", &cfg.HashRingVirtualNodes); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("REBALANCE_INTERVAL", &cfg.RebalanceInterval); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("DEAD_SHARD_GRACE", &cfg.DeadShardGrace); err != nil {
+		return nil, err
+	}
+	policy, err := ParseAutoCreatePolicy(os.Getenv("AUTO_CREATE"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid AUTO_CREATE: %w", err)
+	}
+	cfg.AutoCreate = policy
+	if err := intFromEnv("METADATA_CACHE_SIZE", &cfg.MetadataCacheSize); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("ETCD_REQUEST_TIMEOUT", &cfg.EtcdRequestTimeout); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("DRAIN_TIMEOUT", &cfg.DrainTimeout); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("SHARD_METRICS_MAX_AGE", &cfg.ShardMetricsMaxAge); err != nil {
+		return nil, err
+	}
+	if value := os.Getenv("SHARD_SELECTION"); value != "" {
+		cfg.ShardSelection = value
+	}
+	if value := os.Getenv("WAL_DIR"); value != "" {
+		cfg.WALDir = value
+	}
+	if value := os.Getenv("WAL_SYNC_POLICY"); value != "" {
+		cfg.WALSyncPolicy = value
+	}
+	if err := durationFromEnv("WAL_SYNC_INTERVAL", &cfg.WALSyncInterval); err != nil {
+		return nil, err
+	}
+	if err := durationFromEnv("SNAPSHOT_INTERVAL", &cfg.SnapshotInterval); err != nil {
+		return nil, err
+	}
+	if err := intFromEnv("SNAPSHOT_MAX_WAL_BYTES", &cfg.SnapshotMaxWALBytes); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// durationFromEnv parses the named variable into dst when it is set.
+func durationFromEnv(name string, dst *time.Duration) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("invalid %s: must be positive", name)
+	}
+	*dst = parsed
+	return nil
+}
+
+// intFromEnv parses the named variable into dst when it is set.
+func intFromEnv(name string, dst *int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("invalid %s: must be positive", name)
+	}
+	*dst = parsed
+	return nil
+}
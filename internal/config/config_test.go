@@ -0,0 +1,39 @@
+package config_test
+
+import (
+	"sharded-counters/internal/config"
+	"testing"
+)
+
+func TestAutoCreatePolicy(t *testing.T) {
+	tests := []struct {
+		value   string
+		allowed []string
+		denied  []string
+	}{
+		{value: "", denied: []string{"page-views"}},
+		{value: "off", denied: []string{"page-views"}},
+		{value: "on", allowed: []string{"page-views", "tmp-1"}},
+		{value: "tmp-, jobs-", allowed: []string{"tmp-1", "jobs-nightly"}, denied: []string{"page-views", "tmp"}},
+	}
+	for _, tt := range tests {
+		policy, err := config.ParseAutoCreatePolicy(tt.value)
+		if err != nil {
+			t.Fatalf("ParseAutoCreatePolicy(%q) failed: %v", tt.value, err)
+		}
+		for _, counterID := range tt.allowed {
+			if !policy.Allows(counterID) {
+				t.Errorf("Expected policy %q to allow %s", tt.value, counterID)
+			}
+		}
+		for _, counterID := range tt.denied {
+			if policy.Allows(counterID) {
+				t.Errorf("Expected policy %q to deny %s", tt.value, counterID)
+			}
+		}
+	}
+
+	if _, err := config.ParseAutoCreatePolicy("tmp-,,jobs-"); err == nil {
+		t.Error("Expected an error for an empty prefix")
+	}
+}
@@ -0,0 +1,114 @@
+package countermetadata
+
+import (
+	"context"
+	"fmt"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/hashring"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"sort"
+)
+
+// Placement chooses the shards a new counter is spread over.
+type Placement interface {
+	// Place selects count of the alive shards for the counter, where
+	// 0 < count < len(shards).
+	Place(ctx context.Context, manager etcd.Manager, counterID string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error)
+	// Rebalance selects the count shards an existing counter, currently on
+	// the current shard IDs, should be on once the alive shards change.
+	Rebalance(ctx context.Context, manager etcd.Manager, counterID string, current []string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error)
+}
+
+// ParsePlacement returns the placement with the given name: "hashring" or
+// "least-loaded". vnodes configures the virtual nodes of the hash ring.
+func ParsePlacement(name string, vnodes int) (Placement, error) {
+	switch name {
+	case "hashring":
+		return HashRingPlacement{VirtualNodes: vnodes}, nil
+	case "least-loaded":
+		return LeastLoadedPlacement{}, nil
+	default:
+		return nil, fmt.Errorf("unknown placement strategy %q", name)
+	}
+}
+
+// HashRingPlacement places counters on a consistent-hash ring of the alive
+// shards. Placement depends only on the counter ID and the set of alive
+// shards, and a shard joining or leaving only moves the counters next to it
+// on the ring.
+type HashRingPlacement struct {
+	VirtualNodes int // Points per shard on the ring; zero uses hashring.DefaultVirtualNodes.
+}
+
+// Place picks the first count shards clockwise from the counter ID on the ring.
+func (p HashRingPlacement) Place(ctx context.Context, manager etcd.Manager, counterID string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	byID := make(map[string]*shardmetadata.Shard, len(shards))
+	for _, shard := range shards {
+		byID[shard.ShardID] = shard
+	}
+	ring := hashring.New(GetShardIds(shards), p.VirtualNodes)
+
+	var placed []*shardmetadata.Shard
+	for _, shardID := range ring.Lookup(counterID, count) {
+		placed = append(placed, byID[shardID])
+	}
+	return placed, nil
+}
+
+// Rebalance recomputes the placement on the ring of the alive shards, which
+// only moves the counter when a shard next to it joined or left.
+func (p HashRingPlacement) Rebalance(ctx context.Context, manager etcd.Manager, counterID string, current []string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	return p.Place(ctx, manager, counterID, shards, count)
+}
+
+// LeastLoadedPlacement prefers the shards that own the fewest counters so
+// that load stays balanced. Ties are broken by shard ID to keep the choice
+// deterministic.
+type LeastLoadedPlacement struct{}
+
+// Place picks the count shards owning the fewest counters.
+func (LeastLoadedPlacement) Place(ctx context.Context, manager etcd.Manager, counterID string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	owned := make(map[string]int64, len(shards))
+	for _, shard := range shards {
+		n, err := CountOwnedCounters(ctx, manager, shard.ShardID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to count counters of shard %s: %v", shard.ShardID, err)
+		}
+		owned[shard.ShardID] = n
+	}
+	candidates := append([]*shardmetadata.Shard(nil), shards...)
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if owned[a.ShardID] != owned[b.ShardID] {
+			return owned[a.ShardID] < owned[b.ShardID]
+		}
+		return a.ShardID < b.ShardID
+	})
+	return candidates[:count], nil
+}
+
+// Rebalance keeps the current shards that are still alive and replaces the
+// rest with the least-loaded other shards. Since load changes all the time,
+// recomputing the whole placement would move counters on every pass.
+func (p LeastLoadedPlacement) Rebalance(ctx context.Context, manager etcd.Manager, counterID string, current []string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	wanted := make(map[string]bool, len(current))
+	for _, shardID := range current {
+		wanted[shardID] = true
+	}
+	var kept, others []*shardmetadata.Shard
+	for _, shard := range shards {
+		if wanted[shard.ShardID] && len(kept) < count {
+			kept = append(kept, shard)
+		} else {
+			others = append(others, shard)
+		}
+	}
+	if len(kept) == count {
+		return kept, nil
+	}
+	added, err := p.Place(ctx, manager, counterID, others, count-len(kept))
+	if err != nil {
+		return nil, err
+	}
+	return append(kept, added...), nil
+}
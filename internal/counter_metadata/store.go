@@ -1,71 +1,543 @@
 package countermetadata
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"sharded-counters/internal/etcd"
 	shardmetadata "sharded-counters/internal/shard_metadata"
+	"strings"
+	"time"
 )
 
 const CounterPrefix = "counters" // Prefix used to identify counter keys in etcd
 
-// saveCounterMetadata saves counter metadata in Etcd.
-func SaveCounterMetadata(manager etcd.Manager, counterID string, shards []*shardmetadata.Shard) error {
-	shardIds := GetShardIds(shards)
-	data, err := json.Marshal(shardIds)
+const NamePrefix = "counter-names" // Prefix of the unique name => counter ID index in etcd
+
+const TombstonePrefix = "counter-tombstones" // Prefix of the IDs of deleted counters in etcd
+
+const OwnershipPrefix = "shard-counters" // Prefix of the shard => owned counter IDs index in etcd
+
+// ErrCounterDeleted is returned when resolving a counter that has been deleted.
+var ErrCounterDeleted = errors.New("counter has been deleted")
+
+// ErrNameTaken is returned when creating a counter with a name that another
+// counter already has.
+var ErrNameTaken = errors.New("counter name is already taken")
+
+// ErrConflict is returned when a counter record keeps changing underneath an
+// update, so that it could not be applied within maxUpdateAttempts.
+var ErrConflict = errors.New("counter record was modified concurrently")
+
+// maxUpdateAttempts bounds the compare-and-swap retries of a record update.
+const maxUpdateAttempts = 10
+
+// CounterRecord is the metadata stored in etcd for every counter.
+type CounterRecord struct {
+	CounterID   string    `json:"counter_id"`
+	Name        string    `json:"name,omitempty"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Shards      []string  `json:"shards"`
+	ShardCount  int       `json:"shard_count,omitempty"` // Requested number of shards; zero spreads the counter over every shard.
+	Version     int64     `json:"version"`               // Incremented on every update of the record.
+	Epoch       int64     `json:"epoch"`                 // Incremented on every reset; shards discard values from older epochs.
+}
+
+func counterKey(counterID string) string {
+	return fmt.Sprintf("%s/%s", CounterPrefix, counterID)
+}
+
+func nameKey(name string) string {
+	return fmt.Sprintf("%s/%s", NamePrefix, name)
+}
+
+func tombstoneKey(counterID string) string {
+	return fmt.Sprintf("%s/%s", TombstonePrefix, counterID)
+}
+
+func ownershipKey(shardID, counterID string) string {
+	return fmt.Sprintf("%s/%s/%s", OwnershipPrefix, shardID, counterID)
+}
+
+// CountOwnedCounters returns the number of counters assigned to a shard.
+func CountOwnedCounters(ctx context.Context, manager etcd.Manager, shardID string) (int64, error) {
+	return manager.CountKeysWithPrefix(ctx, fmt.Sprintf("%s/%s/", OwnershipPrefix, shardID))
+}
+
+// ownershipOps indexes the counter under the shards it was added to and
+// removes it from the shards it was taken from, for writing in the same
+// transaction as the record.
+func ownershipOps(counterID string, oldShards, newShards []string) []etcd.Op {
+	var ops []etcd.Op
+	kept := make(map[string]bool, len(newShards))
+	for _, shardID := range newShards {
+		kept[shardID] = true
+		ops = append(ops, etcd.Op{Key: ownershipKey(shardID, counterID)})
+	}
+	for _, shardID := range oldShards {
+		if !kept[shardID] {
+			ops = append(ops, etcd.Op{Key: ownershipKey(shardID, counterID), Delete: true})
+		}
+	}
+	return ops
+}
+
+// GetCounterIDByName resolves a counter name to its ID using the name index.
+func GetCounterIDByName(ctx context.Context, manager etcd.Manager, name string) (string, error) {
+	return manager.Get(ctx, nameKey(name))
+}
+
+// GetCounterRecordByName retrieves the record of the counter with the given
+// name. It returns a KeyNotFoundError when no counter has that name.
+func GetCounterRecordByName(ctx context.Context, manager etcd.Manager, name string) (*CounterRecord, error) {
+	counterID, err := GetCounterIDByName(ctx, manager, name)
 	if err != nil {
-		return fmt.Errorf("failed to marshal shards: %v", err)
+		return nil, err
 	}
-	key := fmt.Sprintf("%s/%s", CounterPrefix, counterID)
-	err = manager.SaveMetadata(key, string(data))
+	return GetCounterRecord(ctx, manager, counterID)
+}
+
+func encodeCounterRecord(record *CounterRecord) (string, error) {
+	data, err := json.Marshal(record)
 	if err != nil {
-		return fmt.Errorf("failed to store metadata in etcd: %v", err)
+		return "", fmt.Errorf("failed to marshal counter record: %v", err)
 	}
-	return nil
+	return string(data), nil
 }
 
-// getCounterMetadata retrieves counter metadata i.e. assigned shards from Etcd.
-func GetCounterMetadata(manager etcd.Manager, counterID string) ([]*shardmetadata.Shard, error) {
-	// Fetch the metadata from Etcd using the provided key
-	key := fmt.Sprintf("%s/%s", CounterPrefix, counterID)
-	data, err := manager.Get(key)
+// updateCounterRecord applies update to the stored record of a counter and
+// writes it back with a compare-and-swap, re-reading and retrying when another
+// writer got there first. The shard ownership index is updated in the same
+// transaction. update reports whether it changed the record; unchanged records
+// are not written. With create set, a missing record is created unless the
+// counter has been deleted. It returns the stored record.
+func updateCounterRecord(ctx context.Context, manager etcd.Manager, counterID string, create bool, update func(record *CounterRecord) (bool, error)) (*CounterRecord, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		var record *CounterRecord
+		data, revision, err := manager.GetWithRevision(ctx, counterKey(counterID))
+		switch {
+		case err == nil:
+			record, err = decodeCounterRecord(counterID, data)
+			if err != nil {
+				return nil, err
+			}
+		case etcd.IsKeyNotFound(err) && create:
+			record = &CounterRecord{CounterID: counterID, CreatedAt: time.Now().UTC()}
+		default:
+			return nil, err
+		}
+		oldShards := record.Shards
+
+		changed, err := update(record)
+		if err != nil {
+			return nil, err
+		}
+		if !changed && revision != 0 {
+			return record, nil
+		}
+		record.Version++
+		encoded, err := encodeCounterRecord(record)
+		if err != nil {
+			return nil, err
+		}
+
+		revisions := map[string]int64{counterKey(counterID): revision}
+		if revision == 0 {
+			revisions[tombstoneKey(counterID)] = 0
+		}
+		ops := append([]etcd.Op{{Key: counterKey(counterID), Value: encoded}}, ownershipOps(counterID, oldShards, record.Shards)...)
+		stored, err := manager.CommitIfUnchanged(ctx, revisions, ops)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store metadata in etcd: %v", err)
+		}
+		if stored {
+			return record, nil
+		}
+		if revision == 0 {
+			deleted, err := IsCounterDeleted(ctx, manager, counterID)
+			if err != nil {
+				return nil, err
+			}
+			if deleted {
+				return nil, ErrCounterDeleted
+			}
+		}
+	}
+	return nil, ErrConflict
+}
+
+// GetCounterRecord retrieves the counter record from Etcd.
+func GetCounterRecord(ctx context.Context, manager etcd.Manager, counterID string) (*CounterRecord, error) {
+	data, err := manager.Get(ctx, counterKey(counterID))
 	if err != nil {
 		return nil, err
 	}
-	// Unmarshal the JSON data into a slice of strings
-	var shards []string
-	err = json.Unmarshal([]byte(data), &shards)
-	if err != nil {
+	return decodeCounterRecord(counterID, data)
+}
+
+// decodeCounterRecord parses a stored record. Counters created before records
+// were introduced hold a bare JSON array of shard IDs, which is returned as a
+// version 0 record.
+func decodeCounterRecord(counterID, data string) (*CounterRecord, error) {
+	var shardIds []string
+	if err := json.Unmarshal([]byte(data), &shardIds); err == nil {
+		return &CounterRecord{CounterID: counterID, Shards: shardIds}, nil
+	}
+	record := new(CounterRecord)
+	if err := json.Unmarshal([]byte(data), record); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal metadata: %v", err)
 	}
+	return record, nil
+}
+
+// SaveCounterMetadata replaces the shards of a counter in Etcd, keeping the
+// rest of its record, and creates the record if the counter does not exist.
+// It returns ErrCounterDeleted for deleted counters.
+func SaveCounterMetadata(ctx context.Context, manager etcd.Manager, counterID string, shards []*shardmetadata.Shard) error {
+	_, err := updateCounterRecord(ctx, manager, counterID, true, func(record *CounterRecord) (bool, error) {
+		record.Shards = GetShardIds(shards)
+		return true, nil
+	})
+	return err
+}
+
+// UpdateCounterShards replaces the shards of an existing counter with those
+// shards computes from its current record. If another writer changes the
+// record before it is stored, the record is read again and shards called
+// anew, so that concurrent moves, removals and resets are kept. The record is
+// not written when the shards are the same in any order. It returns the
+// stored record, or a KeyNotFoundError if the counter does not exist.
+func UpdateCounterShards(ctx context.Context, manager etcd.Manager, counterID string, shards func(record *CounterRecord) ([]string, error)) (*CounterRecord, error) {
+	return updateCounterRecord(ctx, manager, counterID, false, func(record *CounterRecord) (bool, error) {
+		updated, err := shards(record)
+		if err != nil || SameShards(record.Shards, updated) {
+			return false, err
+		}
+		record.Shards = updated
+		return true, nil
+	})
+}
+
+// SameShards reports whether a and b hold the same shard IDs in any order.
+func SameShards(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := make(map[string]bool, len(a))
+	for _, shardID := range a {
+		set[shardID] = true
+	}
+	for _, shardID := range b {
+		if !set[shardID] {
+			return false
+		}
+	}
+	return true
+}
+
+// getCounterMetadata retrieves counter metadata i.e. assigned shards from Etcd.
+func GetCounterMetadata(ctx context.Context, manager etcd.Manager, counterID string) ([]*shardmetadata.Shard, error) {
+	// Fetch the record from Etcd using the counter ID
+	record, err := GetCounterRecord(ctx, manager, counterID)
+	if err != nil {
+		return nil, err
+	}
 
-	shardsList := GetShardObjList(shards)
+	shardsList := GetShardObjList(record.Shards)
 	return shardsList, nil
 
 }
 
-func LoadOrStore(etcdManager etcd.Manager, counterID string) ([]*shardmetadata.Shard, error) {
-	// Retrieve assigned shards (pods) for counter
-	counterShards, metadataErr := GetCounterMetadata(etcdManager, counterID)
-	if etcd.IsKeyNotFound(metadataErr) {
-		// Retrieve all available shards (pods) from Etcd.
-		allAliveShards, err := shardmetadata.GetAliveShards(etcdManager)
+// CreateOptions describes a counter to create.
+type CreateOptions struct {
+	Name        string
+	Description string
+	ShardCount  int       // Number of shards to assign; zero assigns every alive shard.
+	Placement   Placement // Chooses the shards; nil uses a HashRingPlacement.
+}
+
+// CreateCounter assigns shards to a new counter and stores its record in
+// Etcd. When fewer shards are alive than requested, all of them are assigned.
+//
+// The record, its name index entry and its shard ownership are created in one
+// transaction that only succeeds if neither the record nor the name exists and
+// the ID has not been deleted. If the
+// counter has been created concurrently, the stored record is returned so that
+// every caller routes to the same shards. It returns ErrNameTaken when another
+// counter has the name and ErrCounterDeleted for deleted IDs.
+func CreateCounter(ctx context.Context, manager etcd.Manager, counterID string, opts CreateOptions) (*CounterRecord, error) {
+	// Retrieve all available shards (pods) from Etcd.
+	allAliveShards, err := shardmetadata.GetAliveShards(ctx, manager)
+	if err != nil {
+		return nil, err
+	}
+	placement := opts.Placement
+	if placement == nil {
+		placement = HashRingPlacement{}
+	}
+	assigned := allAliveShards
+	if opts.ShardCount > 0 && opts.ShardCount < len(allAliveShards) {
+		assigned, err = placement.Place(ctx, manager, counterID, allAliveShards, opts.ShardCount)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		// Assign shards to the counter.
-		counterShards = assignShards(allAliveShards)
+	record := &CounterRecord{
+		CounterID:   counterID,
+		Name:        opts.Name,
+		Description: opts.Description,
+		CreatedAt:   time.Now().UTC(),
+		Shards:      GetShardIds(assigned),
+		ShardCount:  opts.ShardCount,
+		Version:     1,
+	}
+	encoded, err := encodeCounterRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	revisions := map[string]int64{counterKey(counterID): 0, tombstoneKey(counterID): 0}
+	ops := []etcd.Op{{Key: counterKey(counterID), Value: encoded}}
+	if opts.Name != "" {
+		// Index the counter by name.
+		revisions[nameKey(opts.Name)] = 0
+		ops = append(ops, etcd.Op{Key: nameKey(opts.Name), Value: counterID})
+	}
+	ops = append(ops, ownershipOps(counterID, nil, record.Shards)...)
 
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
 		// Save metadata to Etcd.
-		if err := SaveCounterMetadata(etcdManager, counterID, counterShards); err != nil {
+		created, err := manager.CommitIfUnchanged(ctx, revisions, ops)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store metadata in etcd: %v", err)
+		}
+		if created {
+			log.Printf("Stored counter metadata in etcd: %s = %s", counterID, record.Shards)
+			return record, nil
+		}
+
+		// Find out which key was in the way.
+		existing, err := GetCounterRecord(ctx, manager, counterID)
+		if err == nil {
+			return existing, nil
+		}
+		if !etcd.IsKeyNotFound(err) {
+			return nil, err
+		}
+		deleted, err := IsCounterDeleted(ctx, manager, counterID)
+		if err != nil {
+			return nil, err
+		}
+		if deleted {
+			return nil, ErrCounterDeleted
+		}
+		if opts.Name != "" {
+			_, err := GetCounterIDByName(ctx, manager, opts.Name)
+			if err == nil {
+				return nil, ErrNameTaken
+			}
+			if !etcd.IsKeyNotFound(err) {
+				return nil, err
+			}
+		}
+		// The conflicting key is gone again; try once more.
+	}
+	return nil, ErrConflict
+}
+
+// ListOptions selects a page of counters.
+type ListOptions struct {
+	NamePrefix string // Only list named counters whose name starts with this prefix.
+	Cursor     string // Opaque cursor returned with the previous page.
+	Limit      int    // Maximum number of records in the page.
+}
+
+// CounterPage is a page of counter records in key order.
+type CounterPage struct {
+	Records    []*CounterRecord
+	NextCursor string // Empty when there are no more pages.
+}
+
+// ErrInvalidCursor is returned when a list cursor cannot be decoded or was
+// issued for a different listing.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListCounters returns a page of counter records. Without a name prefix the
+// records are ordered by counter ID; with one, only named counters are listed
+// in name order using the name index.
+func ListCounters(ctx context.Context, manager etcd.Manager, opts ListOptions) (*CounterPage, error) {
+	prefix := CounterPrefix + "/"
+	if opts.NamePrefix != "" {
+		prefix = nameKey(opts.NamePrefix)
+	}
+
+	startAfter := ""
+	if opts.Cursor != "" {
+		key, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+		if err != nil || !strings.HasPrefix(string(key), prefix) {
+			return nil, ErrInvalidCursor
+		}
+		startAfter = string(key)
+	}
+
+	kvs, more, err := manager.GetRange(ctx, prefix, startAfter, opts.Limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list counters from etcd: %v", err)
+	}
+
+	page := &CounterPage{Records: []*CounterRecord{}}
+	for _, kv := range kvs {
+		var record *CounterRecord
+		if opts.NamePrefix != "" {
+			// Name index entries map to counter IDs.
+			record, err = GetCounterRecord(ctx, manager, kv.Value)
+			if etcd.IsKeyNotFound(err) {
+				continue // Stale index entry.
+			}
+		} else {
+			record, err = decodeCounterRecord(strings.TrimPrefix(kv.Key, CounterPrefix+"/"), kv.Value)
+		}
+		if err != nil {
 			return nil, err
 		}
-		log.Printf("Stored counter metadata in etcd: %s = %s", counterID, GetShardIds(counterShards))
+		page.Records = append(page.Records, record)
+	}
+	if more && len(kvs) > 0 {
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(kvs[len(kvs)-1].Key))
 	}
+	return page, nil
+}
 
-	return counterShards, nil
+// CounterTombstone is stored in etcd in place of a deleted counter's record.
+// It keeps the assigned shards so that shard cleanup can be retried.
+type CounterTombstone struct {
+	CounterID string    `json:"counter_id"`
+	Name      string    `json:"name,omitempty"`
+	Shards    []string  `json:"shards"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// DeleteCounter tombstones a counter and removes its record, name index entry
+// and shard ownership from Etcd in one transaction, which only succeeds if the
+// record has not changed since it was read. The tombstone keeps the shards of
+// the record that was deleted, and the ID stays tombstoned so that a
+// concurrent LoadOrStore cannot recreate the counter. It returns a
+// KeyNotFoundError when the counter does not exist.
+func DeleteCounter(ctx context.Context, manager etcd.Manager, counterID string) (*CounterTombstone, error) {
+	for attempt := 0; attempt < maxUpdateAttempts; attempt++ {
+		data, revision, err := manager.GetWithRevision(ctx, counterKey(counterID))
+		if err != nil {
+			return nil, err
+		}
+		record, err := decodeCounterRecord(counterID, data)
+		if err != nil {
+			return nil, err
+		}
+		tombstone := &CounterTombstone{
+			CounterID: counterID,
+			Name:      record.Name,
+			Shards:    record.Shards,
+			DeletedAt: time.Now().UTC(),
+		}
+		encoded, err := json.Marshal(tombstone)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal tombstone: %v", err)
+		}
+
+		revisions := map[string]int64{counterKey(counterID): revision}
+		ops := []etcd.Op{
+			{Key: tombstoneKey(counterID), Value: string(encoded)},
+			{Key: counterKey(counterID), Delete: true},
+		}
+		ops = append(ops, ownershipOps(counterID, record.Shards, nil)...)
+		if record.Name != "" {
+			// Leave the index alone if the name has been taken by another counter.
+			owner, nameRevision, err := manager.GetWithRevision(ctx, nameKey(record.Name))
+			if err != nil && !etcd.IsKeyNotFound(err) {
+				return nil, err
+			}
+			revisions[nameKey(record.Name)] = nameRevision
+			if err == nil && owner == counterID {
+				ops = append(ops, etcd.Op{Key: nameKey(record.Name), Delete: true})
+			}
+		}
+
+		deleted, err := manager.CommitIfUnchanged(ctx, revisions, ops)
+		if err != nil {
+			return nil, fmt.Errorf("failed to delete metadata from etcd: %v", err)
+		}
+		if deleted {
+			log.Printf("Deleted counter metadata from etcd: %s", counterID)
+			return tombstone, nil
+		}
+	}
+	return nil, ErrConflict
+}
+
+// GetCounterTombstone retrieves the tombstone of a deleted counter. It returns
+// a KeyNotFoundError when the counter has not been deleted.
+func GetCounterTombstone(ctx context.Context, manager etcd.Manager, counterID string) (*CounterTombstone, error) {
+	data, err := manager.Get(ctx, tombstoneKey(counterID))
+	if err != nil {
+		return nil, err
+	}
+	tombstone := new(CounterTombstone)
+	if err := json.Unmarshal([]byte(data), tombstone); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal tombstone: %v", err)
+	}
+	return tombstone, nil
+}
+
+// IsCounterDeleted reports whether the counter ID has been tombstoned.
+func IsCounterDeleted(ctx context.Context, manager etcd.Manager, counterID string) (bool, error) {
+	_, err := manager.Get(ctx, tombstoneKey(counterID))
+	if etcd.IsKeyNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ResetCounter starts a new epoch for the counter, which zeroes it on every
+// shard: shards discard the values they hold for older epochs the next time
+// they see the counter.
+func ResetCounter(ctx context.Context, manager etcd.Manager, counterID string) (*CounterRecord, error) {
+	record, err := updateCounterRecord(ctx, manager, counterID, false, func(record *CounterRecord) (bool, error) {
+		record.Epoch++
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Reset counter %s to epoch %d", counterID, record.Epoch)
+	return record, nil
+}
+
+// LoadOrStore returns the shards of a counter, creating the counter as
+// described by opts when it does not exist. It returns ErrCounterDeleted for
+// deleted counters rather than recreating them.
+func LoadOrStore(ctx context.Context, etcdManager etcd.Manager, counterID string, opts CreateOptions) ([]*shardmetadata.Shard, error) {
+	record, err := LoadOrStoreRecord(ctx, etcdManager, counterID, opts)
+	if err != nil {
+		return nil, err
+	}
+	return GetShardObjList(record.Shards), nil
+}
+
+// LoadOrStoreRecord is like LoadOrStore, but returns the whole counter record.
+// Concurrent callers creating the same counter all get the record that won.
+func LoadOrStoreRecord(ctx context.Context, etcdManager etcd.Manager, counterID string, opts CreateOptions) (*CounterRecord, error) {
+	record, err := GetCounterRecord(ctx, etcdManager, counterID)
+	if !etcd.IsKeyNotFound(err) {
+		return record, err
+	}
+	return CreateCounter(ctx, etcdManager, counterID, opts)
 }
 
 func GetShardIds(shards []*shardmetadata.Shard) []string {
@@ -86,9 +558,3 @@ func GetShardObjList(shardIds []string) []*shardmetadata.Shard {
 	}
 	return shardsList
 }
-
-// assignShards randomly selects shards for a counter.
-func assignShards(shards []*shardmetadata.Shard) []*shardmetadata.Shard {
-	// For simplicity, assign all shards (or select a random subset if needed).
-	return shards
-}
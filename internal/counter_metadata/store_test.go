@@ -1,71 +1,47 @@
 package countermetadata_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	countermetadata "sharded-counters/internal/counter_metadata"
 	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/etcd/etcdtest"
 	shardmetadata "sharded-counters/internal/shard_metadata"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-// MockEtcdManager implements the etcd.Manager interface for testing
-type MockEtcdManager struct {
-	store map[string]string
-}
-
-func NewMockEtcdManager() *MockEtcdManager {
-	return &MockEtcdManager{store: make(map[string]string)}
-}
-
-func (m *MockEtcdManager) Get(key string) (string, error) {
-	val, exists := m.store[key]
-	if !exists {
-		return "", &etcd.KeyNotFoundError{Key: key}
+// registerShards publishes the metrics of the given shards, as alive shards do.
+func registerShards(t *testing.T, m *etcdtest.Manager, shardIDs ...string) {
+	t.Helper()
+	lease, err := m.GrantLease(context.Background(), 6*time.Second)
+	if err != nil {
+		t.Fatalf("GrantLease failed: %v", err)
 	}
-	return val, nil
-}
-
-func (m *MockEtcdManager) SaveMetadata(key, value string) error {
-	m.store[key] = value
-	return nil
-}
-
-func (m *MockEtcdManager) GetKeysWithPrefix(prefix string) ([]string, error) {
-	var keys []string
-	for k := range m.store {
-		if len(k) >= len(prefix) && k[:len(prefix)] == prefix {
-			keys = append(keys, k)
+	for _, shardID := range shardIDs {
+		if err := shardmetadata.FetchAndStoreMetrics(context.Background(), lease, shardID); err != nil {
+			t.Fatalf("FetchAndStoreMetrics failed: %v", err)
 		}
 	}
-	return keys, nil
-}
-
-func (m *MockEtcdManager) SaveMetadataWithLease(key, value string, ttl time.Duration) error {
-	m.store[key] = value
-	return nil
 }
 
-// Mock GetAliveShards function
-// func MockGetAliveShards(manager etcd.Manager) ([]*shardmetadata.Shard, error) {
-// 	return []*shardmetadata.Shard{
-// 		{ShardID: "shard1"},
-// 		{ShardID: "shard2"},
-// 	}, nil
-// }
-
 func TestLoadOrStore(t *testing.T) {
-	// Create a mock EtcdManager
-	mockEtcd := NewMockEtcdManager()
+	// Create an in-memory etcd
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
 
 	// Store shard metrics
-	shardmetadata.FetchAndStoreMetrics(mockEtcd, "shard1")
-	shardmetadata.FetchAndStoreMetrics(mockEtcd, "shard2")
+	registerShards(t, mockEtcd, "shard1", "shard2")
 
 	// Test Case 1: No existing metadata
 	t.Run("No Existing Metadata", func(t *testing.T) {
 		counterID := "test-counter"
 
-		shards, err := countermetadata.LoadOrStore(mockEtcd, counterID)
+		shards, err := countermetadata.LoadOrStore(ctx, mockEtcd, counterID, countermetadata.CreateOptions{})
 		if err != nil {
 			t.Fatalf("LoadOrStore failed: %v", err)
 		}
@@ -76,7 +52,7 @@ func TestLoadOrStore(t *testing.T) {
 		}
 
 		// Verify metadata was saved
-		savedShards, err := countermetadata.GetCounterMetadata(mockEtcd, counterID)
+		savedShards, err := countermetadata.GetCounterMetadata(ctx, mockEtcd, counterID)
 		if err != nil {
 			t.Fatalf("GetCounterMetadata failed: %v", err)
 		}
@@ -94,11 +70,11 @@ func TestLoadOrStore(t *testing.T) {
 			{ShardID: "shard1"},
 			{ShardID: "shard2"},
 		}
-		err := countermetadata.SaveCounterMetadata(mockEtcd, counterID, initialShards)
+		err := countermetadata.SaveCounterMetadata(ctx, mockEtcd, counterID, initialShards)
 		if err != nil {
 			t.Fatalf("SaveCounterMetadata failed: %v", err)
 		}
-		shards, err := countermetadata.LoadOrStore(mockEtcd, counterID)
+		shards, err := countermetadata.LoadOrStore(ctx, mockEtcd, counterID, countermetadata.CreateOptions{})
 		if err != nil {
 			t.Fatalf("LoadOrStore failed: %v", err)
 		}
@@ -109,3 +85,416 @@ func TestLoadOrStore(t *testing.T) {
 		}
 	})
 }
+
+func TestCounterRecord(t *testing.T) {
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
+	registerShards(t, mockEtcd, "shard1")
+
+	// Test Case 1: Name and description are persisted
+	t.Run("Create Counter", func(t *testing.T) {
+		created, err := countermetadata.CreateCounter(ctx, mockEtcd, "named-counter", countermetadata.CreateOptions{Name: "page-views", Description: "Views of the landing page"})
+		if err != nil {
+			t.Fatalf("CreateCounter failed: %v", err)
+		}
+
+		record, err := countermetadata.GetCounterRecord(ctx, mockEtcd, "named-counter")
+		if err != nil {
+			t.Fatalf("GetCounterRecord failed: %v", err)
+		}
+		if record.Name != "page-views" || record.Description != "Views of the landing page" {
+			t.Errorf("Expected name and description to be stored, got %+v", record)
+		}
+		if record.Version != 1 || record.CreatedAt.IsZero() || !record.CreatedAt.Equal(created.CreatedAt) {
+			t.Errorf("Unexpected version or creation time: %+v", record)
+		}
+		if len(record.Shards) != 1 || record.Shards[0] != "shard1" {
+			t.Errorf("Expected shard1 to be assigned, got %v", record.Shards)
+		}
+	})
+
+	// Test Case 2: Counters can be looked up by name
+	t.Run("Lookup By Name", func(t *testing.T) {
+		record, err := countermetadata.GetCounterRecordByName(ctx, mockEtcd, "page-views")
+		if err != nil {
+			t.Fatalf("GetCounterRecordByName failed: %v", err)
+		}
+		if record.CounterID != "named-counter" {
+			t.Errorf("Expected named-counter, got %s", record.CounterID)
+		}
+
+		_, err = countermetadata.GetCounterRecordByName(ctx, mockEtcd, "unknown-name")
+		if !etcd.IsKeyNotFound(err) {
+			t.Errorf("Expected key not found for unknown name, got %v", err)
+		}
+	})
+
+	// Test Case 3: Resetting starts a new epoch
+	t.Run("Reset Counter", func(t *testing.T) {
+		record, err := countermetadata.ResetCounter(ctx, mockEtcd, "named-counter")
+		if err != nil {
+			t.Fatalf("ResetCounter failed: %v", err)
+		}
+		if record.Epoch != 1 || record.Version != 2 {
+			t.Errorf("Expected epoch 1 and version 2, got %+v", record)
+		}
+		stored, _ := countermetadata.GetCounterRecord(ctx, mockEtcd, "named-counter")
+		if stored.Epoch != 1 {
+			t.Errorf("Expected stored epoch 1, got %d", stored.Epoch)
+		}
+	})
+
+	// Test Case 4: Records stored as a bare shard list are still readable
+	t.Run("Legacy Metadata", func(t *testing.T) {
+		mockEtcd.SaveMetadata(ctx, "counters/legacy-counter", `["shard1","shard2"]`)
+
+		record, err := countermetadata.GetCounterRecord(ctx, mockEtcd, "legacy-counter")
+		if err != nil {
+			t.Fatalf("GetCounterRecord failed: %v", err)
+		}
+		if record.CounterID != "legacy-counter" || len(record.Shards) != 2 {
+			t.Errorf("Expected legacy shard list to be decoded, got %+v", record)
+		}
+	})
+}
+
+func TestListCounters(t *testing.T) {
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
+	registerShards(t, mockEtcd, "shard1")
+
+	names := map[string]string{"c1": "api-requests", "c2": "api-errors", "c3": "page-views", "c4": ""}
+	for counterID, name := range names {
+		if _, err := countermetadata.CreateCounter(ctx, mockEtcd, counterID, countermetadata.CreateOptions{Name: name}); err != nil {
+			t.Fatalf("CreateCounter failed: %v", err)
+		}
+	}
+
+	// Test Case 1: Paginate over all counters in ID order
+	t.Run("Paginate", func(t *testing.T) {
+		var listed []string
+		cursor := ""
+		for {
+			page, err := countermetadata.ListCounters(ctx, mockEtcd, countermetadata.ListOptions{Cursor: cursor, Limit: 3})
+			if err != nil {
+				t.Fatalf("ListCounters failed: %v", err)
+			}
+			for _, record := range page.Records {
+				listed = append(listed, record.CounterID)
+			}
+			if page.NextCursor == "" {
+				break
+			}
+			cursor = page.NextCursor
+		}
+		if strings.Join(listed, ",") != "c1,c2,c3,c4" {
+			t.Errorf("Expected c1,c2,c3,c4, got %v", listed)
+		}
+	})
+
+	// Test Case 2: Filter by name prefix
+	t.Run("Name Prefix", func(t *testing.T) {
+		page, err := countermetadata.ListCounters(ctx, mockEtcd, countermetadata.ListOptions{NamePrefix: "api-", Limit: 10})
+		if err != nil {
+			t.Fatalf("ListCounters failed: %v", err)
+		}
+		if len(page.Records) != 2 || page.Records[0].Name != "api-errors" || page.Records[1].Name != "api-requests" {
+			t.Errorf("Expected api-errors and api-requests, got %+v", page.Records)
+		}
+		if page.NextCursor != "" {
+			t.Errorf("Expected no next cursor, got %q", page.NextCursor)
+		}
+	})
+
+	// Test Case 3: Cursors from another listing are rejected
+	t.Run("Invalid Cursor", func(t *testing.T) {
+		page, err := countermetadata.ListCounters(ctx, mockEtcd, countermetadata.ListOptions{Limit: 1})
+		if err != nil {
+			t.Fatalf("ListCounters failed: %v", err)
+		}
+		_, err = countermetadata.ListCounters(ctx, mockEtcd, countermetadata.ListOptions{NamePrefix: "api-", Cursor: page.NextCursor, Limit: 1})
+		if !errors.Is(err, countermetadata.ErrInvalidCursor) {
+			t.Errorf("Expected ErrInvalidCursor, got %v", err)
+		}
+	})
+}
+
+func TestDeleteCounter(t *testing.T) {
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
+	registerShards(t, mockEtcd, "shard1", "shard2")
+
+	if _, err := countermetadata.CreateCounter(ctx, mockEtcd, "deleted-counter", countermetadata.CreateOptions{Name: "old-name", ShardCount: 1}); err != nil {
+		t.Fatalf("CreateCounter failed: %v", err)
+	}
+	// The tombstone keeps the shards the record has when it is deleted.
+	if err := countermetadata.SaveCounterMetadata(ctx, mockEtcd, "deleted-counter", countermetadata.GetShardObjList([]string{"shard2"})); err != nil {
+		t.Fatalf("SaveCounterMetadata failed: %v", err)
+	}
+	tombstone, err := countermetadata.DeleteCounter(ctx, mockEtcd, "deleted-counter")
+	if err != nil {
+		t.Fatalf("DeleteCounter failed: %v", err)
+	}
+	if len(tombstone.Shards) != 1 || tombstone.Shards[0] != "shard2" {
+		t.Errorf("Expected tombstone to keep the assigned shards, got %v", tombstone.Shards)
+	}
+	if owned, _ := countermetadata.CountOwnedCounters(ctx, mockEtcd, "shard2"); owned != 0 {
+		t.Errorf("Expected shard ownership to be deleted, got %d counters", owned)
+	}
+	if _, err := countermetadata.DeleteCounter(ctx, mockEtcd, "deleted-counter"); !etcd.IsKeyNotFound(err) {
+		t.Errorf("Expected deleting again to find no record, got %v", err)
+	}
+
+	// The record and name index are gone.
+	if _, err := countermetadata.GetCounterRecord(ctx, mockEtcd, "deleted-counter"); !etcd.IsKeyNotFound(err) {
+		t.Errorf("Expected record to be deleted, got %v", err)
+	}
+	if _, err := countermetadata.GetCounterIDByName(ctx, mockEtcd, "old-name"); !etcd.IsKeyNotFound(err) {
+		t.Errorf("Expected name index to be deleted, got %v", err)
+	}
+
+	// A late increment must not recreate the counter.
+	if _, err := countermetadata.LoadOrStore(ctx, mockEtcd, "deleted-counter", countermetadata.CreateOptions{}); !errors.Is(err, countermetadata.ErrCounterDeleted) {
+		t.Errorf("Expected ErrCounterDeleted, got %v", err)
+	}
+	if _, err := countermetadata.GetCounterRecord(ctx, mockEtcd, "deleted-counter"); !etcd.IsKeyNotFound(err) {
+		t.Errorf("Expected counter to stay deleted, got %v", err)
+	}
+}
+
+func leastLoaded(shardCount int) countermetadata.CreateOptions {
+	return countermetadata.CreateOptions{ShardCount: shardCount, Placement: countermetadata.LeastLoadedPlacement{}}
+}
+
+func TestAssignShards(t *testing.T) {
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
+	registerShards(t, mockEtcd, []string{"shard1", "shard2", "shard3"}...)
+
+	// Test Case 1: Counters get the requested number of shards, spread evenly
+	t.Run("Balanced Subset", func(t *testing.T) {
+		for i := 0; i < 6; i++ {
+			record, err := countermetadata.CreateCounter(ctx, mockEtcd, fmt.Sprintf("balanced-%d", i), leastLoaded(2))
+			if err != nil {
+				t.Fatalf("CreateCounter failed: %v", err)
+			}
+			if len(record.Shards) != 2 {
+				t.Fatalf("Expected 2 shards, got %v", record.Shards)
+			}
+		}
+		for _, shardID := range []string{"shard1", "shard2", "shard3"} {
+			owned, _ := countermetadata.CountOwnedCounters(ctx, mockEtcd, shardID)
+			if owned != 4 {
+				t.Errorf("Expected shard %s to own 4 counters, got %d", shardID, owned)
+			}
+		}
+	})
+
+	// Test Case 2: Asking for more shards than are alive assigns all of them
+	t.Run("More Than Alive", func(t *testing.T) {
+		record, err := countermetadata.CreateCounter(ctx, mockEtcd, "wide", leastLoaded(10))
+		if err != nil {
+			t.Fatalf("CreateCounter failed: %v", err)
+		}
+		if len(record.Shards) != 3 {
+			t.Errorf("Expected all 3 shards, got %v", record.Shards)
+		}
+	})
+
+	// Test Case 3: Deleting a counter releases its shards
+	t.Run("Delete Releases Ownership", func(t *testing.T) {
+		if _, err := countermetadata.DeleteCounter(ctx, mockEtcd, "wide"); err != nil {
+			t.Fatalf("DeleteCounter failed: %v", err)
+		}
+		owned, _ := countermetadata.CountOwnedCounters(ctx, mockEtcd, "shard1")
+		if owned != 4 {
+			t.Errorf("Expected shard1 to own 4 counters after delete, got %d", owned)
+		}
+	})
+}
+
+func TestHashRingPlacement(t *testing.T) {
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
+	registerShards(t, mockEtcd, []string{"shard1", "shard2", "shard3", "shard4"}...)
+	opts := countermetadata.CreateOptions{ShardCount: 2, Placement: countermetadata.HashRingPlacement{VirtualNodes: 32}}
+
+	// Placement only depends on the counter ID and the alive shards.
+	first, err := countermetadata.CreateCounter(ctx, mockEtcd, "ring-counter", opts)
+	if err != nil {
+		t.Fatalf("CreateCounter failed: %v", err)
+	}
+	second, err := countermetadata.CreateCounter(ctx, mockEtcd, "ring-counter", opts)
+	if err != nil {
+		t.Fatalf("CreateCounter failed: %v", err)
+	}
+	if len(first.Shards) != 2 || first.Shards[0] == first.Shards[1] {
+		t.Fatalf("Expected 2 distinct shards, got %v", first.Shards)
+	}
+	if strings.Join(first.Shards, ",") != strings.Join(second.Shards, ",") {
+		t.Errorf("Expected the same placement twice, got %v and %v", first.Shards, second.Shards)
+	}
+}
+
+// rotatingPlacement places every call on a different shard, so that racing
+// creators of the same counter would pick different assignments.
+type rotatingPlacement struct {
+	calls atomic.Int64
+}
+
+func (p *rotatingPlacement) Place(ctx context.Context, manager etcd.Manager, counterID string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	i := int(p.calls.Add(1)) % len(shards)
+	return shards[i : i+1], nil
+}
+
+func (p *rotatingPlacement) Rebalance(ctx context.Context, manager etcd.Manager, counterID string, current []string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	return p.Place(ctx, manager, counterID, shards, count)
+}
+
+func TestConcurrentCreate(t *testing.T) {
+	const goroutines = 20
+
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
+	registerShards(t, mockEtcd, []string{"shard1", "shard2", "shard3"}...)
+
+	// Test Case 1: Racing LoadOrStore calls agree on one assignment
+	t.Run("Same Counter ID", func(t *testing.T) {
+		opts := countermetadata.CreateOptions{ShardCount: 1, Placement: &rotatingPlacement{}}
+		records := make([]*countermetadata.CounterRecord, goroutines)
+		errs := make([]error, goroutines)
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				records[i], errs[i] = countermetadata.LoadOrStoreRecord(ctx, mockEtcd, "racy-counter", opts)
+			}(i)
+		}
+		wg.Wait()
+
+		stored, err := countermetadata.GetCounterRecord(ctx, mockEtcd, "racy-counter")
+		if err != nil {
+			t.Fatalf("GetCounterRecord failed: %v", err)
+		}
+		for i := 0; i < goroutines; i++ {
+			if errs[i] != nil {
+				t.Fatalf("LoadOrStoreRecord failed: %v", errs[i])
+			}
+			if fmt.Sprint(records[i].Shards) != fmt.Sprint(stored.Shards) {
+				t.Errorf("Expected every caller to get shards %v, got %v", stored.Shards, records[i].Shards)
+			}
+		}
+		owners := 0
+		for _, shardID := range []string{"shard1", "shard2", "shard3"} {
+			owned, _ := countermetadata.CountOwnedCounters(ctx, mockEtcd, shardID)
+			owners += int(owned)
+		}
+		if owners != 1 {
+			t.Errorf("Expected the counter to be owned by 1 shard, got %d", owners)
+		}
+	})
+
+	// Test Case 2: Only one counter gets a contested name
+	t.Run("Same Name", func(t *testing.T) {
+		errs := make([]error, goroutines)
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				_, errs[i] = countermetadata.CreateCounter(ctx, mockEtcd, fmt.Sprintf("named-%d", i), countermetadata.CreateOptions{Name: "contested"})
+			}(i)
+		}
+		wg.Wait()
+
+		winner := -1
+		for i, err := range errs {
+			switch {
+			case err == nil && winner >= 0:
+				t.Errorf("Expected one counter to get the name, got named-%d and named-%d", winner, i)
+			case err == nil:
+				winner = i
+			case !errors.Is(err, countermetadata.ErrNameTaken):
+				t.Errorf("Expected ErrNameTaken, got %v", err)
+			}
+		}
+		counterID, err := countermetadata.GetCounterIDByName(ctx, mockEtcd, "contested")
+		if err != nil {
+			t.Fatalf("GetCounterIDByName failed: %v", err)
+		}
+		if counterID != fmt.Sprintf("named-%d", winner) {
+			t.Errorf("Expected name to resolve to named-%d, got %s", winner, counterID)
+		}
+	})
+
+	// Test Case 3: Concurrent updates are not lost
+	t.Run("Concurrent Updates", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < goroutines; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := countermetadata.ResetCounter(ctx, mockEtcd, "racy-counter"); err != nil && !errors.Is(err, countermetadata.ErrConflict) {
+					t.Errorf("ResetCounter failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		record, err := countermetadata.GetCounterRecord(ctx, mockEtcd, "racy-counter")
+		if err != nil {
+			t.Fatalf("GetCounterRecord failed: %v", err)
+		}
+		if record.Version != record.Epoch+1 {
+			t.Errorf("Expected every stored reset to bump the version once, got epoch %d and version %d", record.Epoch, record.Version)
+		}
+	})
+
+	// Test Case 4: Deleted counters are not recreated
+	t.Run("Deleted Counter", func(t *testing.T) {
+		if _, err := countermetadata.DeleteCounter(ctx, mockEtcd, "racy-counter"); err != nil {
+			t.Fatalf("DeleteCounter failed: %v", err)
+		}
+		if err := countermetadata.SaveCounterMetadata(ctx, mockEtcd, "racy-counter", nil); !errors.Is(err, countermetadata.ErrCounterDeleted) {
+			t.Errorf("Expected ErrCounterDeleted, got %v", err)
+		}
+	})
+}
+
+func TestOwnershipFollowsRecord(t *testing.T) {
+	const goroutines = 20
+
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
+	shardIDs := []string{"shard1", "shard2", "shard3"}
+	registerShards(t, mockEtcd, shardIDs...)
+	if _, err := countermetadata.CreateCounter(ctx, mockEtcd, "moving-counter", countermetadata.CreateOptions{ShardCount: 1}); err != nil {
+		t.Fatalf("CreateCounter failed: %v", err)
+	}
+
+	// Racing reassignments leave the index owned by exactly the stored shards.
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shards := countermetadata.GetShardObjList([]string{shardIDs[i%len(shardIDs)]})
+			if err := countermetadata.SaveCounterMetadata(ctx, mockEtcd, "moving-counter", shards); err != nil && !errors.Is(err, countermetadata.ErrConflict) {
+				t.Errorf("SaveCounterMetadata failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	record, err := countermetadata.GetCounterRecord(ctx, mockEtcd, "moving-counter")
+	if err != nil {
+		t.Fatalf("GetCounterRecord failed: %v", err)
+	}
+	for _, shardID := range shardIDs {
+		owned, _ := countermetadata.CountOwnedCounters(ctx, mockEtcd, shardID)
+		if want := int64(strings.Count(strings.Join(record.Shards, ","), shardID)); owned != want {
+			t.Errorf("Expected shard %s to own %d counters with record shards %v, got %d", shardID, want, record.Shards, owned)
+		}
+	}
+}
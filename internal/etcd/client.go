@@ -4,25 +4,54 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
 	"time"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
+// Manager is the metadata store. Every call is bounded by ctx, so callers
+// pass the context of the request they serve.
 type Manager interface {
-	Get(key string) (string, error)
-	SaveMetadata(key, value string) error
-	GetKeysWithPrefix(prefix string) ([]string, error)
-	SaveMetadataWithLease(key, value string, ttl time.Duration) error
+	Get(ctx context.Context, key string) (string, error)
+	SaveMetadata(ctx context.Context, key, value string) error
+	GetKeysWithPrefix(ctx context.Context, prefix string) ([]string, error)
+	GetRange(ctx context.Context, prefix, startAfter string, limit int) ([]KeyValue, bool, error)
+	CountKeysWithPrefix(ctx context.Context, prefix string) (int64, error)
+	GetWithRevision(ctx context.Context, key string) (string, int64, error)
+	CommitIfUnchanged(ctx context.Context, revisions map[string]int64, ops []Op) (bool, error)
+	GrantLease(ctx context.Context, ttl time.Duration) (Lease, error)
+	Watch(ctx context.Context, prefix string, fromRevision int64) <-chan WatchResponse
+}
+
+// DefaultRequestTimeout bounds every etcd request when no other value is
+// configured.
+const DefaultRequestTimeout = 5 * time.Second
+
+// KeyValue is a key and its value as stored in etcd.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Op is one write of a transaction: a put of Value under Key, or a delete of
+// Key when Delete is set.
+type Op struct {
+	Key    string
+	Value  string
+	Delete bool
 }
 
 // EtcdManager manages interactions with the Etcd client.
 type EtcdManager struct {
-	client *clientv3.Client
+	client         *clientv3.Client
+	requestTimeout time.Duration
 }
 
-// NewEtcdManager initializes and returns a new EtcdManager instance.
-func NewEtcdManager(endpoints []string, dialTimeout time.Duration) (*EtcdManager, error) {
+// NewEtcdManager initializes and returns a new EtcdManager instance. Every
+// request is bounded by requestTimeout in addition to the caller's context;
+// a requestTimeout of zero uses DefaultRequestTimeout.
+func NewEtcdManager(endpoints []string, dialTimeout, requestTimeout time.Duration) (*EtcdManager, error) {
 	if len(endpoints) == 0 {
 		return nil, fmt.Errorf("no etcd endpoints provided")
 	}
@@ -35,7 +64,15 @@ func NewEtcdManager(endpoints []string, dialTimeout time.Duration) (*EtcdManager
 		return nil, fmt.Errorf("failed to create etcd client: %w", err)
 	}
 
-	return &EtcdManager{client: client}, nil
+	if requestTimeout <= 0 {
+		requestTimeout = DefaultRequestTimeout
+	}
+	return &EtcdManager{client: client, requestTimeout: requestTimeout}, nil
+}
+
+// withTimeout bounds ctx by the request timeout.
+func (e *EtcdManager) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, e.requestTimeout)
 }
 
 // Close closes the Etcd client.
@@ -61,43 +98,94 @@ func IsKeyNotFound(err error) bool {
 }
 
 // SaveMetadata saves a key-value pair in Etcd.
-func (e *EtcdManager) SaveMetadata(key, value string) error {
+func (e *EtcdManager) SaveMetadata(ctx context.Context, key, value string) error {
 	if e.client == nil {
 		return fmt.Errorf("etcd client is not initialized")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := e.withTimeout(ctx)
 	defer cancel()
 
 	_, err := e.client.Put(ctx, key, value)
 	return err
 }
 
-// SaveMetadataWithLease saves a key-value pair in Etcd with a TTL.
-func (e *EtcdManager) SaveMetadataWithLease(key, value string, ttl time.Duration) error {
+// Lease is an etcd lease that is kept alive in the background. Keys stored
+// under it are deleted once it expires or is revoked.
+type Lease interface {
+	// Put stores a key-value pair attached to the lease.
+	Put(ctx context.Context, key, value string) error
+	// Done is closed once the lease is lost: it was revoked, or it expired
+	// because it could not be kept alive.
+	Done() <-chan struct{}
+	// Revoke ends the lease and deletes the keys attached to it.
+	Revoke(ctx context.Context) error
+}
+
+// GrantLease grants a lease with the given TTL and keeps it alive until ctx
+// is done, the lease is revoked, or etcd cannot be reached for longer than
+// the TTL.
+func (e *EtcdManager) GrantLease(ctx context.Context, ttl time.Duration) (Lease, error) {
 	if e.client == nil {
-		return fmt.Errorf("etcd client is not initialized")
+		return nil, fmt.Errorf("etcd client is not initialized")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	grantCtx, cancel := e.withTimeout(ctx)
 	defer cancel()
 
-	leaseResp, err := e.client.Grant(ctx, int64(ttl.Seconds()))
+	leaseResp, err := e.client.Grant(grantCtx, int64(ttl.Seconds()))
 	if err != nil {
-		return fmt.Errorf("error creating lease: %w", err)
+		return nil, fmt.Errorf("error creating lease: %w", err)
 	}
+	keepAlive, err := e.client.KeepAlive(ctx, leaseResp.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error keeping lease alive: %w", err)
+	}
+
+	lease := &etcdLease{manager: e, id: leaseResp.ID, done: make(chan struct{})}
+	go func() {
+		defer close(lease.done)
+		// The channel is closed when keep-alives stop for good.
+		for range keepAlive {
+		}
+	}()
+	return lease, nil
+}
+
+// etcdLease is a Lease granted by an EtcdManager.
+type etcdLease struct {
+	manager *EtcdManager
+	id      clientv3.LeaseID
+	done    chan struct{}
+}
+
+func (l *etcdLease) Put(ctx context.Context, key, value string) error {
+	ctx, cancel := l.manager.withTimeout(ctx)
+	defer cancel()
+
+	_, err := l.manager.client.Put(ctx, key, value, clientv3.WithLease(l.id))
+	return err
+}
+
+func (l *etcdLease) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *etcdLease) Revoke(ctx context.Context) error {
+	ctx, cancel := l.manager.withTimeout(ctx)
+	defer cancel()
 
-	_, err = e.client.Put(ctx, key, value, clientv3.WithLease(leaseResp.ID))
+	_, err := l.manager.client.Revoke(ctx, l.id)
 	return err
 }
 
 // GetKeysWithPrefix retrieves all keys matching a prefix from Etcd.
-func (e *EtcdManager) GetKeysWithPrefix(prefix string) ([]string, error) {
+func (e *EtcdManager) GetKeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
 	if e.client == nil {
 		return nil, fmt.Errorf("etcd client is not initialized")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := e.withTimeout(ctx)
 	defer cancel()
 
 	resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix())
@@ -113,13 +201,171 @@ func (e *EtcdManager) GetKeysWithPrefix(prefix string) ([]string, error) {
 	return keys, nil
 }
 
+// CountKeysWithPrefix returns the number of keys matching a prefix in Etcd
+// without fetching them.
+func (e *EtcdManager) CountKeysWithPrefix(ctx context.Context, prefix string) (int64, error) {
+	if e.client == nil {
+		return 0, fmt.Errorf("etcd client is not initialized")
+	}
+
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := e.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// EventType is the kind of change a watch event reports.
+type EventType int
+
+const (
+	EventPut    EventType = iota // The key was created or updated.
+	EventDelete                  // The key was deleted or its lease expired.
+)
+
+// Event is a change of one key seen by a watch.
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    string // Empty for deletes.
+	Revision int64  // Revision of the change.
+}
+
+// WatchResponse is a batch of events delivered by Watch. Revision is the store
+// revision the response is current as of: a watch resumed from Revision+1
+// misses no change. A response with Err set is the last one of its watch.
+type WatchResponse struct {
+	Events   []Event
+	Revision int64
+	Err      error
+}
+
+// CompactedError is returned by a watch whose start revision is older than the
+// oldest revision etcd still keeps. Changes since then are lost, so the
+// watcher must re-read the keys it cares about and watch from the current
+// revision.
+type CompactedError struct {
+	CompactRevision int64
+}
+
+func (e *CompactedError) Error() string {
+	return fmt.Sprintf("watch revision compacted, oldest available revision is %d", e.CompactRevision)
+}
+
+// IsCompacted checks if an error is of type CompactedError.
+func IsCompacted(err error) bool {
+	var compactedErr *CompactedError
+	return errors.As(err, &compactedErr)
+}
+
+// Watch streams the changes of keys under prefix, starting at fromRevision
+// (or at the current revision when it is zero), until ctx is cancelled or the
+// watch fails, then closes the returned channel. The first response, without
+// events, is sent once the watch is established: changes made after it are
+// guaranteed to be delivered. A start revision that has been compacted ends
+// the watch with a CompactedError.
+func (e *EtcdManager) Watch(ctx context.Context, prefix string, fromRevision int64) <-chan WatchResponse {
+	out := make(chan WatchResponse)
+	if e.client == nil {
+		go func() {
+			defer close(out)
+			select {
+			case out <- WatchResponse{Err: fmt.Errorf("etcd client is not initialized")}:
+			case <-ctx.Done():
+			}
+		}()
+		return out
+	}
+
+	opts := []clientv3.OpOption{clientv3.WithPrefix(), clientv3.WithCreatedNotify()}
+	if fromRevision > 0 {
+		opts = append(opts, clientv3.WithRev(fromRevision))
+	}
+	go func() {
+		defer close(out)
+		for resp := range e.client.Watch(ctx, prefix, opts...) {
+			watchResp := WatchResponse{Revision: resp.Header.Revision, Err: resp.Err()}
+			if resp.CompactRevision != 0 {
+				watchResp.Err = &CompactedError{CompactRevision: resp.CompactRevision}
+			}
+			for _, ev := range resp.Events {
+				event := Event{Key: string(ev.Kv.Key), Value: string(ev.Kv.Value), Revision: ev.Kv.ModRevision}
+				if ev.Type == clientv3.EventTypeDelete {
+					event.Type = EventDelete
+				}
+				watchResp.Events = append(watchResp.Events, event)
+			}
+			if len(watchResp.Events) == 0 && watchResp.Err == nil && !resp.Created {
+				continue // Progress notification.
+			}
+			select {
+			case out <- watchResp:
+			case <-ctx.Done():
+				return
+			}
+			if watchResp.Err != nil {
+				return
+			}
+		}
+	}()
+	return out
+}
+
+// WatchChanges signals on the returned channel whenever a key under prefix is
+// written or deleted, until ctx is cancelled. Signals are coalesced: a
+// receiver that falls behind sees one signal for many changes. Failed watches
+// are resumed where they stopped; when that is impossible, for example because
+// the revision was compacted, a signal is sent since changes may have been
+// missed.
+func WatchChanges(ctx context.Context, manager Manager, prefix string) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	signal := func() {
+		select {
+		case changes <- struct{}{}:
+		default:
+		}
+	}
+	go func() {
+		var fromRevision int64
+		for {
+			for resp := range manager.Watch(ctx, prefix, fromRevision) {
+				if resp.Err != nil {
+					log.Printf("Error watching %s: %v", prefix, resp.Err)
+					if IsCompacted(resp.Err) {
+						fromRevision = 0
+					}
+					break
+				}
+				if resp.Revision > 0 {
+					fromRevision = resp.Revision + 1
+				}
+				if len(resp.Events) > 0 {
+					signal()
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+			if fromRevision == 0 {
+				signal() // Restarting from the current revision skips the gap.
+			}
+		}
+	}()
+	return changes
+}
+
 // Get retrieves the value for a key from Etcd.
-func (e *EtcdManager) Get(key string) (string, error) {
+func (e *EtcdManager) Get(ctx context.Context, key string) (string, error) {
 	if e.client == nil {
 		return "", fmt.Errorf("etcd client is not initialized")
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := e.withTimeout(ctx)
 	defer cancel()
 
 	resp, err := e.client.Get(ctx, key)
@@ -133,3 +379,87 @@ func (e *EtcdManager) Get(key string) (string, error) {
 
 	return string(resp.Kvs[0].Value), nil
 }
+
+// GetWithRevision is like Get, but also returns the revision at which the key
+// was last modified, for use with CommitIfUnchanged.
+func (e *EtcdManager) GetWithRevision(ctx context.Context, key string) (string, int64, error) {
+	if e.client == nil {
+		return "", 0, fmt.Errorf("etcd client is not initialized")
+	}
+
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+
+	resp, err := e.client.Get(ctx, key)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if len(resp.Kvs) == 0 {
+		return "", 0, &KeyNotFoundError{Key: key}
+	}
+
+	return string(resp.Kvs[0].Value), resp.Kvs[0].ModRevision, nil
+}
+
+// CommitIfUnchanged applies ops in one transaction if every key in revisions
+// was last modified at its revision, as returned by GetWithRevision. A
+// revision of zero expects the key to be absent. It reports whether the ops
+// were applied.
+func (e *EtcdManager) CommitIfUnchanged(ctx context.Context, revisions map[string]int64, ops []Op) (bool, error) {
+	if e.client == nil {
+		return false, fmt.Errorf("etcd client is not initialized")
+	}
+
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+
+	cmps := make([]clientv3.Cmp, 0, len(revisions))
+	for key, revision := range revisions {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(key), "=", revision))
+	}
+	txnOps := make([]clientv3.Op, 0, len(ops))
+	for _, op := range ops {
+		if op.Delete {
+			txnOps = append(txnOps, clientv3.OpDelete(op.Key))
+		} else {
+			txnOps = append(txnOps, clientv3.OpPut(op.Key, op.Value))
+		}
+	}
+	resp, err := e.client.Txn(ctx).If(cmps...).Then(txnOps...).Commit()
+	if err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// GetRange retrieves up to limit key-value pairs under prefix in key order,
+// starting after startAfter (or at the beginning of the prefix when it is
+// empty). It also reports whether more keys remain after the returned page.
+func (e *EtcdManager) GetRange(ctx context.Context, prefix, startAfter string, limit int) ([]KeyValue, bool, error) {
+	if e.client == nil {
+		return nil, false, fmt.Errorf("etcd client is not initialized")
+	}
+
+	ctx, cancel := e.withTimeout(ctx)
+	defer cancel()
+
+	start := prefix
+	if startAfter != "" {
+		start = startAfter + "\x00" // Smallest key strictly greater than startAfter.
+	}
+	resp, err := e.client.Get(ctx, start,
+		clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		clientv3.WithLimit(int64(limit)),
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	kvs := make([]KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		kvs = append(kvs, KeyValue{Key: string(kv.Key), Value: string(kv.Value)})
+	}
+	return kvs, resp.More, nil
+}
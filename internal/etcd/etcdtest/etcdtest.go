@@ -0,0 +1,296 @@
+// Package etcdtest provides an in-memory etcd.Manager for tests.
+package etcdtest
+
+import (
+	"context"
+	"fmt"
+	"sharded-counters/internal/etcd"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Manager is an in-memory etcd.Manager. Like etcd, it keeps a revision that is
+// incremented by every change and a history of changes that watches replay
+// from, until the history is compacted. Leases never expire on their own:
+// they live until they are revoked or Expire is called. It is safe for
+// concurrent use.
+type Manager struct {
+	mu        sync.Mutex
+	kvs       map[string]kv
+	revision  int64
+	history   []etcd.Event  // Every change since the compacted revision, in order.
+	compacted int64         // Changes up to this revision are no longer in the history.
+	changed   chan struct{} // Closed and replaced on every change to wake watches.
+	leases    map[int64]*lease
+	nextLease int64
+}
+
+type kv struct {
+	value    string
+	revision int64 // Revision of the last modification.
+	lease    int64 // Lease the key is attached to, or zero.
+}
+
+// NewManager returns an empty Manager.
+func NewManager() *Manager {
+	return &Manager{kvs: make(map[string]kv), changed: make(chan struct{}), leases: make(map[int64]*lease)}
+}
+
+// Revision returns the current revision.
+func (m *Manager) Revision() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.revision
+}
+
+// Compact discards the history up to and including revision. Watches starting
+// at or before it fail with an etcd.CompactedError.
+func (m *Manager) Compact(revision int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if revision > m.revision {
+		revision = m.revision
+	}
+	if revision <= m.compacted {
+		return
+	}
+	i := sort.Search(len(m.history), func(i int) bool { return m.history[i].Revision > revision })
+	m.history = append([]etcd.Event(nil), m.history[i:]...)
+	m.compacted = revision
+}
+
+// Expire expires the lease of a key, deleting every key attached to the
+// lease. A key without a lease is deleted on its own.
+func (m *Manager) Expire(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.kvs[key]
+	if !ok {
+		return
+	}
+	if l, ok := m.leases[entry.lease]; ok {
+		m.endLease(l)
+		return
+	}
+	m.delete(key)
+}
+
+// put stores a key and records the change; the caller must hold mu.
+func (m *Manager) put(key, value string) {
+	m.putWithLease(key, value, 0)
+}
+
+// putWithLease stores a key attached to a lease; the caller must hold mu.
+func (m *Manager) putWithLease(key, value string, leaseID int64) {
+	m.revision++
+	m.kvs[key] = kv{value: value, revision: m.revision, lease: leaseID}
+	m.record(etcd.Event{Type: etcd.EventPut, Key: key, Value: value, Revision: m.revision})
+}
+
+// delete removes a key and records the change; the caller must hold mu.
+func (m *Manager) delete(key string) {
+	if _, ok := m.kvs[key]; !ok {
+		return
+	}
+	delete(m.kvs, key)
+	m.revision++
+	m.record(etcd.Event{Type: etcd.EventDelete, Key: key, Revision: m.revision})
+}
+
+// endLease deletes the keys of a lease and marks it as lost; the caller must
+// hold mu.
+func (m *Manager) endLease(l *lease) {
+	delete(m.leases, l.id)
+	var keys []string
+	for key, entry := range m.kvs {
+		if entry.lease == l.id {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		m.delete(key)
+	}
+	close(l.done)
+}
+
+// record appends a change to the history and wakes watches; the caller must hold mu.
+func (m *Manager) record(event etcd.Event) {
+	m.history = append(m.history, event)
+	close(m.changed)
+	m.changed = make(chan struct{})
+}
+
+func (m *Manager) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := m.GetWithRevision(ctx, key)
+	return value, err
+}
+
+func (m *Manager) GetWithRevision(ctx context.Context, key string) (string, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entry, ok := m.kvs[key]
+	if !ok {
+		return "", 0, &etcd.KeyNotFoundError{Key: key}
+	}
+	return entry.value, entry.revision, nil
+}
+
+func (m *Manager) SaveMetadata(ctx context.Context, key, value string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.put(key, value)
+	return nil
+}
+
+func (m *Manager) GetKeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key := range m.kvs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (m *Manager) GetRange(ctx context.Context, prefix, startAfter string, limit int) ([]etcd.KeyValue, bool, error) {
+	keys, _ := m.GetKeysWithPrefix(ctx, prefix)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var kvs []etcd.KeyValue
+	for _, key := range keys {
+		if key <= startAfter {
+			continue
+		}
+		if len(kvs) == limit {
+			return kvs, true, nil
+		}
+		if entry, ok := m.kvs[key]; ok {
+			kvs = append(kvs, etcd.KeyValue{Key: key, Value: entry.value})
+		}
+	}
+	return kvs, false, nil
+}
+
+func (m *Manager) CountKeysWithPrefix(ctx context.Context, prefix string) (int64, error) {
+	keys, err := m.GetKeysWithPrefix(ctx, prefix)
+	return int64(len(keys)), err
+}
+
+func (m *Manager) CommitIfUnchanged(ctx context.Context, revisions map[string]int64, ops []etcd.Op) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, revision := range revisions {
+		if m.kvs[key].revision != revision {
+			return false, nil
+		}
+	}
+	for _, op := range ops {
+		if op.Delete {
+			m.delete(op.Key)
+		} else {
+			m.put(op.Key, op.Value)
+		}
+	}
+	return true, nil
+}
+
+// GrantLease grants a lease that lives until it is revoked or expired with
+// Expire; ttl is ignored.
+func (m *Manager) GrantLease(ctx context.Context, ttl time.Duration) (etcd.Lease, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.nextLease++
+	l := &lease{manager: m, id: m.nextLease, done: make(chan struct{})}
+	m.leases[l.id] = l
+	return l, nil
+}
+
+// lease is a lease granted by a Manager.
+type lease struct {
+	manager *Manager
+	id      int64
+	done    chan struct{}
+}
+
+func (l *lease) Put(ctx context.Context, key, value string) error {
+	l.manager.mu.Lock()
+	defer l.manager.mu.Unlock()
+	if _, ok := l.manager.leases[l.id]; !ok {
+		return fmt.Errorf("lease %d not found", l.id)
+	}
+	l.manager.putWithLease(key, value, l.id)
+	return nil
+}
+
+func (l *lease) Done() <-chan struct{} {
+	return l.done
+}
+
+func (l *lease) Revoke(ctx context.Context) error {
+	l.manager.mu.Lock()
+	defer l.manager.mu.Unlock()
+	if _, ok := l.manager.leases[l.id]; !ok {
+		return fmt.Errorf("lease %d not found", l.id)
+	}
+	l.manager.endLease(l)
+	return nil
+}
+
+// Watch streams the changes under prefix like etcd.EtcdManager.Watch does.
+func (m *Manager) Watch(ctx context.Context, prefix string, fromRevision int64) <-chan etcd.WatchResponse {
+	out := make(chan etcd.WatchResponse)
+	go func() {
+		defer close(out)
+		send := func(resp etcd.WatchResponse) bool {
+			select {
+			case out <- resp:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		m.mu.Lock()
+		current, compacted := m.revision, m.compacted
+		m.mu.Unlock()
+		if fromRevision > 0 && fromRevision <= compacted {
+			send(etcd.WatchResponse{Revision: current, Err: &etcd.CompactedError{CompactRevision: compacted + 1}})
+			return
+		}
+		if fromRevision <= 0 {
+			fromRevision = current + 1
+		}
+		if !send(etcd.WatchResponse{Revision: current}) {
+			return
+		}
+
+		for {
+			m.mu.Lock()
+			var events []etcd.Event
+			for _, event := range m.history {
+				if event.Revision >= fromRevision && strings.HasPrefix(event.Key, prefix) {
+					events = append(events, event)
+				}
+			}
+			current, changed := m.revision, m.changed
+			m.mu.Unlock()
+
+			if len(events) > 0 && !send(etcd.WatchResponse{Events: events, Revision: current}) {
+				return
+			}
+			fromRevision = current + 1
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out
+}
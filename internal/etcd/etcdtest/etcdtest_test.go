@@ -0,0 +1,157 @@
+package etcdtest_test
+
+import (
+	"context"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/etcd/etcdtest"
+	"testing"
+	"time"
+)
+
+// next returns the next response of a watch, failing the test if none arrives.
+func next(t *testing.T, watch <-chan etcd.WatchResponse) etcd.WatchResponse {
+	t.Helper()
+	select {
+	case resp, ok := <-watch:
+		if !ok {
+			t.Fatal("Watch closed unexpectedly")
+		}
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a watch response")
+	}
+	return etcd.WatchResponse{}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := etcdtest.NewManager()
+
+	watch := m.Watch(ctx, "shards/", 0)
+	created := next(t, watch)
+	if len(created.Events) != 0 || created.Err != nil {
+		t.Fatalf("Expected an empty created response, got %+v", created)
+	}
+
+	m.SaveMetadata(ctx, "counters/a", "ignored")
+	lease, _ := m.GrantLease(ctx, time.Second)
+	lease.Put(ctx, "shards/1", "ok")
+	m.Expire("shards/1")
+
+	var events []etcd.Event
+	for len(events) < 2 {
+		events = append(events, next(t, watch).Events...)
+	}
+	if events[0].Type != etcd.EventPut || events[0].Key != "shards/1" || events[0].Value != "ok" {
+		t.Errorf("Expected a put of shards/1, got %+v", events[0])
+	}
+	if events[1].Type != etcd.EventDelete || events[1].Key != "shards/1" {
+		t.Errorf("Expected a delete of shards/1, got %+v", events[1])
+	}
+	if events[1].Revision != m.Revision() {
+		t.Errorf("Expected the delete at revision %d, got %d", m.Revision(), events[1].Revision)
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := etcdtest.NewManager()
+
+	m.SaveMetadata(ctx, "shards/1", "a")
+	resumeFrom := m.Revision() + 1
+	m.SaveMetadata(ctx, "shards/2", "b")
+	m.CommitIfUnchanged(ctx, nil, []etcd.Op{{Key: "shards/1", Delete: true}})
+
+	// Test Case 1: Changes since the revision are replayed
+	t.Run("Replay", func(t *testing.T) {
+		watch := m.Watch(ctx, "shards/", resumeFrom)
+		next(t, watch)
+		events := next(t, watch).Events
+		if len(events) != 2 || events[0].Key != "shards/2" || events[1].Type != etcd.EventDelete {
+			t.Errorf("Expected the put of shards/2 and the delete of shards/1, got %+v", events)
+		}
+	})
+
+	// Test Case 2: Compacted revisions cannot be resumed from
+	t.Run("Compacted", func(t *testing.T) {
+		m.Compact(resumeFrom)
+		resp := next(t, m.Watch(ctx, "shards/", resumeFrom))
+		if !etcd.IsCompacted(resp.Err) {
+			t.Fatalf("Expected a CompactedError, got %v", resp.Err)
+		}
+		watch := m.Watch(ctx, "shards/", resumeFrom+1)
+		next(t, watch)
+		if events := next(t, watch).Events; len(events) != 1 || events[0].Key != "shards/1" {
+			t.Errorf("Expected the delete of shards/1, got %+v", events)
+		}
+	})
+}
+
+func TestWatchChanges(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := etcdtest.NewManager()
+
+	changes := etcd.WatchChanges(ctx, m, "shards/")
+	// Wait for the watch to be established.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.SaveMetadata(ctx, "shards/probe", "")
+		select {
+		case <-changes:
+		case <-time.After(10 * time.Millisecond):
+			if time.Now().After(deadline) {
+				t.Fatal("Timed out waiting for the watch")
+			}
+			continue
+		}
+		break
+	}
+
+	// Many changes are coalesced into at most one pending signal.
+	for i := 0; i < 10; i++ {
+		m.SaveMetadata(ctx, "shards/1", "ok")
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a change signal")
+	}
+	m.SaveMetadata(ctx, "counters/a", "")
+	select {
+	case <-changes:
+		// A signal for the last of the shard writes may still be pending.
+	case <-time.After(50 * time.Millisecond):
+	}
+	select {
+	case <-changes:
+		t.Error("Expected no signal for keys outside the prefix")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	m := etcdtest.NewManager()
+
+	lease, _ := m.GrantLease(ctx, time.Second)
+	lease.Put(ctx, "shards/1", "ok")
+	lease.Put(ctx, "shards/1/extra", "ok")
+	m.SaveMetadata(ctx, "counters/a", "kept")
+
+	// Expiring one key of the lease expires the whole lease.
+	m.Expire("shards/1")
+	select {
+	case <-lease.Done():
+	default:
+		t.Fatal("Expected the lease to be lost")
+	}
+	if keys, _ := m.GetKeysWithPrefix(ctx, ""); len(keys) != 1 || keys[0] != "counters/a" {
+		t.Errorf("Expected only the key without a lease to remain, got %v", keys)
+	}
+	if err := lease.Put(ctx, "shards/1", "ok"); err == nil {
+		t.Error("Expected a put under a lost lease to fail")
+	}
+}
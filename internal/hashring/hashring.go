@@ -0,0 +1,96 @@
+package hashring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points each member gets on the ring
+// when no other value is configured.
+const DefaultVirtualNodes = 128
+
+// Ring is an immutable consistent-hash ring. Every member is hashed onto the
+// ring at several points (virtual nodes) so that keys spread evenly and only
+// the keys next to a joining or leaving member change owners.
+type Ring struct {
+	points  []uint64          // Sorted hashes of all virtual nodes.
+	owners  map[uint64]string // Virtual node hash => member.
+	members int
+}
+
+// New builds a ring of the given members with vnodes virtual nodes each.
+// vnodes below one is treated as DefaultVirtualNodes.
+func New(members []string, vnodes int) *Ring {
+	if vnodes < 1 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &Ring{owners: make(map[uint64]string, len(members)*vnodes)}
+	seen := make(map[string]bool, len(members))
+	for _, member := range members {
+		if seen[member] {
+			continue
+		}
+		seen[member] = true
+		r.members++
+		for i := 0; i < vnodes; i++ {
+			point := hash(member + "#" + strconv.Itoa(i))
+			if owner, taken := r.owners[point]; taken && owner < member {
+				continue // Resolve the rare collision the same way on every node.
+			}
+			r.owners[point] = member
+		}
+	}
+	r.points = make([]uint64, 0, len(r.owners))
+	for point := range r.owners {
+		r.points = append(r.points, point)
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Len returns the number of distinct members on the ring.
+func (r *Ring) Len() int {
+	return r.members
+}
+
+// Lookup returns up to n distinct members responsible for key, starting with
+// the member owning the first virtual node clockwise from the key's hash.
+func (r *Ring) Lookup(key string, n int) []string {
+	if n > r.members {
+		n = r.members
+	}
+	if n <= 0 {
+		return nil
+	}
+	h := hash(key)
+	start := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+
+	result := make([]string, 0, n)
+	picked := make(map[string]bool, n)
+	for i := 0; i < len(r.points) && len(result) < n; i++ {
+		member := r.owners[r.points[(start+i)%len(r.points)]]
+		if !picked[member] {
+			picked[member] = true
+			result = append(result, member)
+		}
+	}
+	return result
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	return mix(h.Sum64())
+}
+
+// mix finalizes a hash so that keys differing only in a trailing suffix, such
+// as virtual node indexes, still land far apart on the ring.
+func mix(x uint64) uint64 {
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
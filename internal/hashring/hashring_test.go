@@ -0,0 +1,136 @@
+package hashring_test
+
+import (
+	"fmt"
+	"sharded-counters/internal/hashring"
+	"testing"
+)
+
+const numKeys = 10000
+
+func shardIDs(n int) []string {
+	ids := make([]string, n)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("shard-%d", i)
+	}
+	return ids
+}
+
+// placements returns the members each test key is placed on.
+func placements(ring *hashring.Ring, replicas int) map[string][]string {
+	result := make(map[string][]string, numKeys)
+	for i := 0; i < numKeys; i++ {
+		key := fmt.Sprintf("counter-%d", i)
+		result[key] = ring.Lookup(key, replicas)
+	}
+	return result
+}
+
+// moved counts the keys whose placement differs between before and after.
+func moved(before, after map[string][]string) int {
+	count := 0
+	for key, members := range before {
+		if fmt.Sprint(members) != fmt.Sprint(after[key]) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestLookup(t *testing.T) {
+	ring := hashring.New(shardIDs(5), 64)
+
+	// Test Case 1: Placement is deterministic and members are distinct
+	t.Run("Deterministic", func(t *testing.T) {
+		again := hashring.New([]string{"shard-4", "shard-3", "shard-2", "shard-1", "shard-0"}, 64)
+		for key, members := range placements(ring, 3) {
+			if fmt.Sprint(members) != fmt.Sprint(again.Lookup(key, 3)) {
+				t.Fatalf("Expected member order not to matter for %s", key)
+			}
+			if len(members) != 3 || members[0] == members[1] || members[1] == members[2] || members[0] == members[2] {
+				t.Fatalf("Expected 3 distinct members for %s, got %v", key, members)
+			}
+		}
+	})
+
+	// Test Case 2: Asking for more members than exist returns all of them
+	t.Run("More Than Members", func(t *testing.T) {
+		if got := ring.Lookup("counter", 10); len(got) != 5 {
+			t.Errorf("Expected 5 members, got %v", got)
+		}
+		if got := hashring.New(nil, 64).Lookup("counter", 1); len(got) != 0 {
+			t.Errorf("Expected no members on an empty ring, got %v", got)
+		}
+	})
+
+	// Test Case 3: Keys spread evenly across members
+	t.Run("Balanced", func(t *testing.T) {
+		load := make(map[string]int)
+		for _, members := range placements(ring, 1) {
+			load[members[0]]++
+		}
+		for member, n := range load {
+			if n < numKeys/5*7/10 || n > numKeys/5*13/10 {
+				t.Errorf("Expected about %d keys on %s, got %d", numKeys/5, member, n)
+			}
+		}
+	})
+}
+
+func TestMovement(t *testing.T) {
+	const shards = 10
+	before := hashring.New(shardIDs(shards), hashring.DefaultVirtualNodes)
+
+	// Test Case 1: A joining shard only takes keys, about 1/(n+1) of them
+	t.Run("Join", func(t *testing.T) {
+		after := hashring.New(shardIDs(shards+1), hashring.DefaultVirtualNodes)
+		old, updated := placements(before, 1), placements(after, 1)
+		for key, members := range updated {
+			if members[0] != old[key][0] && members[0] != fmt.Sprintf("shard-%d", shards) {
+				t.Fatalf("Key %s moved between existing shards: %v => %v", key, old[key], members)
+			}
+		}
+		n := moved(old, updated)
+		t.Logf("%d of %d keys moved when a shard joined", n, numKeys)
+		if n > numKeys*2/(shards+1) {
+			t.Errorf("Expected about %d keys to move, got %d", numKeys/(shards+1), n)
+		}
+	})
+
+	// Test Case 2: Only the keys of a leaving shard move
+	t.Run("Leave", func(t *testing.T) {
+		after := hashring.New(shardIDs(shards-1), hashring.DefaultVirtualNodes)
+		old, updated := placements(before, 1), placements(after, 1)
+		leaving := fmt.Sprintf("shard-%d", shards-1)
+		for key, members := range old {
+			if members[0] != leaving && updated[key][0] != members[0] {
+				t.Fatalf("Key %s moved off a remaining shard: %v => %v", key, members, updated[key])
+			}
+		}
+		n := moved(old, updated)
+		t.Logf("%d of %d keys moved when a shard left", n, numKeys)
+		if n > numKeys*2/shards {
+			t.Errorf("Expected about %d keys to move, got %d", numKeys/shards, n)
+		}
+	})
+
+	// Test Case 3: With replicas, a leaving shard only affects the sets it was part of
+	t.Run("Leave With Replicas", func(t *testing.T) {
+		after := hashring.New(shardIDs(shards-1), hashring.DefaultVirtualNodes)
+		old, updated := placements(before, 3), placements(after, 3)
+		leaving := fmt.Sprintf("shard-%d", shards-1)
+		affected := 0
+		for _, members := range old {
+			for _, member := range members {
+				if member == leaving {
+					affected++
+				}
+			}
+		}
+		n := moved(old, updated)
+		t.Logf("%d of %d replica sets changed when a shard left", n, numKeys)
+		if n != affected {
+			t.Errorf("Expected exactly the %d sets containing the leaving shard to change, got %d", affected, n)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package loadbalancer
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -43,43 +44,69 @@ func (lb *LoadBalancer) GetShards() []*shardmetadata.Shard {
 	return lb.shards
 }
 
-func (lb *LoadBalancer) ForwardRequest(method string, urlPath string, payload []byte, queryParams map[string]string) error {
+// ForwardRequest forwards the request to a healthy shard picked by the selection
+// strategy and returns the shard's response body and status code. The request is
+// aborted when ctx is cancelled or its deadline passes.
+func (lb *LoadBalancer) ForwardRequest(ctx context.Context, method string, urlPath string, payload []byte, queryParams map[string]string) (string, int, error) {
 	// Filter out healthy shards and set new shards, key => shards/<shard-id>
-	lb.FilterHealthyShards()
+	lb.FilterHealthyShards(ctx)
 	// Select the shard based on selection strategy
 	selectedShard, err := lb.selectionStrategy.SelectShard(lb.GetShards())
 	if err != nil {
-		return fmt.Errorf("failed to select a shard: %v", err)
+		return "", 0, fmt.Errorf("failed to select a shard: %v", err)
 	}
 
 	// Forward the request to the selected shard.
-	_, _, err = lb.ForwardRequestToShard(method, selectedShard, urlPath, payload, queryParams)
-	if err != nil {
-		return err
-	}
-	return nil
+	return lb.ForwardRequestToShard(ctx, method, selectedShard, urlPath, payload, queryParams)
 }
 
-func (lb *LoadBalancer) FilterHealthyShards() error {
-	var healthyShards []*shardmetadata.Shard
+// FilterHealthyShards keeps the shards that take writes. Shards that are ok
+// are preferred; degraded shards are only kept when no shard is ok.
+func (lb *LoadBalancer) FilterHealthyShards(ctx context.Context) error {
+	var healthyShards, degradedShards []*shardmetadata.Shard
 	for _, shardData := range lb.GetShards() {
 		// fetch shard metrics from etcd
-		shardMetrics, err := shardmetadata.GetShardMetrics(lb.etcdClient, shardData.ShardID)
+		shardMetrics, err := shardmetadata.GetShardMetrics(ctx, lb.etcdClient, shardData.ShardID)
 		if err != nil {
 			log.Printf("error fetching shard metrics from etcd: %v", err)
 			continue
 		}
 
-		// Check if the shard is healthy.
-		if shardMetrics.Health == "ok" {
+		switch shardMetrics.Health {
+		case shardmetadata.HealthOK:
 			healthyShards = append(healthyShards, shardMetrics)
+		case shardmetadata.HealthDegraded:
+			degradedShards = append(degradedShards, shardMetrics)
 		}
 	}
+	if len(healthyShards) == 0 {
+		healthyShards = degradedShards
+	}
 	lb.SetShards(healthyShards)
 	return nil
 }
 
-func (lb *LoadBalancer) ForwardRequestToShard(method string, shard *shardmetadata.Shard, urlPath string, payload []byte, queryParams map[string]string) (string, int, error) {
+// FilterReadableShards keeps the shards that can serve reads: every shard but
+// those that are down, including draining and read-only shards, which take no
+// new writes but still hold values.
+func (lb *LoadBalancer) FilterReadableShards(ctx context.Context) {
+	var readableShards []*shardmetadata.Shard
+	for _, shardData := range lb.GetShards() {
+		shardMetrics, err := shardmetadata.GetShardMetrics(ctx, lb.etcdClient, shardData.ShardID)
+		if err != nil {
+			log.Printf("error fetching shard metrics from etcd: %v", err)
+			continue
+		}
+		if shardmetadata.AcceptsReads(shardMetrics.Health) {
+			readableShards = append(readableShards, shardMetrics)
+		}
+	}
+	lb.SetShards(readableShards)
+}
+
+// ForwardRequestToShard sends the request to the given shard. The request is
+// aborted when ctx is cancelled or its deadline passes.
+func (lb *LoadBalancer) ForwardRequestToShard(ctx context.Context, method string, shard *shardmetadata.Shard, urlPath string, payload []byte, queryParams map[string]string) (string, int, error) {
 	// Construct the base URL for the shard's API endpoint.
 	baseURL := fmt.Sprintf("http://%s:%s/%s", shard.ShardID, shardPort, urlPath)
 
@@ -105,7 +132,7 @@ func (lb *LoadBalancer) ForwardRequestToShard(method string, shard *shardmetadat
 	}
 
 	// Create the HTTP request.
-	req, err := http.NewRequest(method, urlObj.String(), bodyReader)
+	req, err := http.NewRequestWithContext(ctx, method, urlObj.String(), bodyReader)
 	if err != nil {
 		return "", 0, fmt.Errorf("failed to create request for shard: %v", err)
 	}
@@ -118,7 +145,7 @@ func (lb *LoadBalancer) ForwardRequestToShard(method string, shard *shardmetadat
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return "", 0, fmt.Errorf("failed to forward request to shard: %v", err)
+		return "", 0, fmt.Errorf("failed to forward request to shard: %w", err)
 	}
 	defer resp.Body.Close()
 
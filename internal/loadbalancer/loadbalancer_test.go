@@ -0,0 +1,75 @@
+package loadbalancer_test
+
+import (
+	"context"
+	"encoding/json"
+	"sharded-counters/internal/etcd/etcdtest"
+	"sharded-counters/internal/loadbalancer"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// newLoadBalancer returns a load balancer over shards published with the given health.
+func newLoadBalancer(t *testing.T, health map[string]string) *loadbalancer.LoadBalancer {
+	t.Helper()
+	m := etcdtest.NewManager()
+	var shards []*shardmetadata.Shard
+	for shardID, h := range health {
+		value, err := json.Marshal(shardmetadata.Shard{ShardID: shardID, Health: h})
+		if err != nil {
+			t.Fatalf("Failed to marshal shard: %v", err)
+		}
+		m.SaveMetadata(context.Background(), shardmetadata.ShardKeyPrefix+shardID, string(value))
+		shards = append(shards, &shardmetadata.Shard{ShardID: shardID})
+	}
+	return loadbalancer.NewLoadBalancer(shards, nil, m)
+}
+
+func shardIDs(lb *loadbalancer.LoadBalancer) string {
+	var ids []string
+	for _, shard := range lb.GetShards() {
+		ids = append(ids, shard.ShardID)
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+func TestFilterByHealth(t *testing.T) {
+	ctx := context.Background()
+	all := map[string]string{
+		"ok":        shardmetadata.HealthOK,
+		"degraded":  shardmetadata.HealthDegraded,
+		"draining":  shardmetadata.HealthDraining,
+		"read-only": shardmetadata.HealthReadOnly,
+		"down":      shardmetadata.HealthDown,
+	}
+
+	// Test Case 1: Writes go to ok shards
+	t.Run("Writes", func(t *testing.T) {
+		lb := newLoadBalancer(t, all)
+		lb.FilterHealthyShards(ctx)
+		if got := shardIDs(lb); got != "ok" {
+			t.Errorf("Expected writes to go to the ok shard, got %q", got)
+		}
+	})
+
+	// Test Case 2: Degraded shards take writes when no shard is ok
+	t.Run("Writes Without Ok Shards", func(t *testing.T) {
+		lb := newLoadBalancer(t, map[string]string{"degraded": shardmetadata.HealthDegraded, "read-only": shardmetadata.HealthReadOnly})
+		lb.FilterHealthyShards(ctx)
+		if got := shardIDs(lb); got != "degraded" {
+			t.Errorf("Expected writes to fall back to the degraded shard, got %q", got)
+		}
+	})
+
+	// Test Case 3: Reads go to every shard that is not down
+	t.Run("Reads", func(t *testing.T) {
+		lb := newLoadBalancer(t, all)
+		lb.FilterReadableShards(ctx)
+		if got := shardIDs(lb); got != "degraded,draining,ok,read-only" {
+			t.Errorf("Expected reads from every shard but the down one, got %q", got)
+		}
+	})
+}
@@ -3,14 +3,38 @@ package loadbalancer
 import (
 	"fmt"
 	shardmetadata "sharded-counters/internal/shard_metadata"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// MetricsStrategy selects a shard based on CPU utilization.
-type MetricsStrategy struct{}
+// MetricsStrategy selects a shard based on the load signals it publishes.
+type MetricsStrategy struct {
+	// MaxStaleness is the age beyond which a shard's metrics are not
+	// trusted; zero trusts metrics of any age.
+	MaxStaleness time.Duration
+	// Weights maps load signals (see shardmetadata.Signals) to their weight
+	// in the selection; nil selects by CPU utilization alone.
+	Weights map[string]float64
+}
 
-// SelectShard selects the shard with the least CPU utilization.
+// SelectShard selects the least loaded shard. Shards whose metrics are stale
+// are only considered when no shard has fresh metrics.
 func (m *MetricsStrategy) SelectShard(shards []*shardmetadata.Shard) (*shardmetadata.Shard, error) {
-	return m.selectShardByCPU(shards)
+	now := time.Now()
+	var fresh []*shardmetadata.Shard
+	for _, shard := range shards {
+		if !shard.IsStale(now, m.MaxStaleness) {
+			fresh = append(fresh, shard)
+		}
+	}
+	if len(fresh) > 0 {
+		shards = fresh
+	}
+	if m.Weights == nil {
+		return m.selectShardByCPU(shards)
+	}
+	return m.selectShardByWeights(shards)
 }
 
 func (m *MetricsStrategy) selectShardByCPU(shards []*shardmetadata.Shard) (*shardmetadata.Shard, error) {
@@ -30,3 +54,75 @@ func (m *MetricsStrategy) selectShardByCPU(shards []*shardmetadata.Shard) (*shar
 
 	return selectedShard, nil
 }
+
+// selectShardByWeights selects the shard with the lowest weighted load. Each
+// signal is scaled by its highest value among the shards, so that signals of
+// different units weigh as configured.
+func (m *MetricsStrategy) selectShardByWeights(shards []*shardmetadata.Shard) (*shardmetadata.Shard, error) {
+	if len(shards) == 0 {
+		return &shardmetadata.Shard{}, fmt.Errorf("no shard to select from")
+	}
+
+	maxima := make(map[string]float64, len(m.Weights))
+	for signal := range m.Weights {
+		for _, shard := range shards {
+			if value, _ := shard.Signal(signal); value > maxima[signal] {
+				maxima[signal] = value
+			}
+		}
+	}
+
+	var selectedShard *shardmetadata.Shard
+	var minLoad float64
+	for _, shard := range shards {
+		load := 0.0
+		for _, signal := range shardmetadata.Signals { // In a fixed order, so ties break alike.
+			if weight := m.Weights[signal]; maxima[signal] > 0 {
+				value, _ := shard.Signal(signal)
+				load += weight * value / maxima[signal]
+			}
+		}
+		if selectedShard == nil || load < minLoad {
+			minLoad = load
+			selectedShard = shard
+		}
+	}
+	return selectedShard, nil
+}
+
+// ParseSelectionWeights parses the signals that drive shard selection: a
+// single signal such as "cpu", or a comma-separated list of weighted signals
+// such as "cpu=0.5,latency=0.3,in_flight=0.2". "cpu" alone returns nil, the
+// CPU-only selection.
+func ParseSelectionWeights(value string) (map[string]float64, error) {
+	value = strings.TrimSpace(value)
+	if value == "" || value == shardmetadata.SignalCPU {
+		return nil, nil
+	}
+	weights := make(map[string]float64)
+	total := 0.0
+	for _, part := range strings.Split(value, ",") {
+		signal, weightStr, weighted := strings.Cut(strings.TrimSpace(part), "=")
+		signal = strings.TrimSpace(signal)
+		if _, ok := (&shardmetadata.Shard{}).Signal(signal); !ok {
+			return nil, fmt.Errorf("unknown signal %q in shard selection %q (valid: %s)", signal, value, strings.Join(shardmetadata.Signals, ", "))
+		}
+		if _, ok := weights[signal]; ok {
+			return nil, fmt.Errorf("signal %q repeated in shard selection %q", signal, value)
+		}
+		weight := 1.0
+		if weighted {
+			var err error
+			weight, err = strconv.ParseFloat(strings.TrimSpace(weightStr), 64)
+			if err != nil || weight < 0 {
+				return nil, fmt.Errorf("invalid weight %q for signal %q in shard selection", weightStr, signal)
+			}
+		}
+		weights[signal] = weight
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("shard selection %q has no positive weight", value)
+	}
+	return weights, nil
+}
@@ -2,6 +2,7 @@ package loadbalancer_test
 
 import (
 	"testing"
+	"time"
 
 	"sharded-counters/internal/loadbalancer"
 	shardmetadata "sharded-counters/internal/shard_metadata"
@@ -61,3 +62,111 @@ func TestSelectShardByCPU(t *testing.T) {
 		}
 	})
 }
+
+func TestSelectShardSkipsStaleMetrics(t *testing.T) {
+	strategy := &loadbalancer.MetricsStrategy{MaxStaleness: 10 * time.Second}
+	fresh := time.Now().Format(time.RFC3339Nano)
+	stale := time.Now().Add(-time.Minute).Format(time.RFC3339Nano)
+
+	// Test Case 1: A stale low CPU figure does not attract writes
+	t.Run("PreferFreshMetrics", func(t *testing.T) {
+		shards := []*shardmetadata.Shard{
+			{ShardID: "shard1", CPUUtilization: 5.0, UpdatedTime: stale},
+			{ShardID: "shard2", CPUUtilization: 60.0, UpdatedTime: fresh},
+		}
+		selectedShard, err := strategy.SelectShard(shards)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if selectedShard.ShardID != "shard2" {
+			t.Errorf("Expected shard2, got %s", selectedShard.ShardID)
+		}
+	})
+
+	// Test Case 2: Stale shards are still picked when none is fresh
+	t.Run("AllStale", func(t *testing.T) {
+		shards := []*shardmetadata.Shard{
+			{ShardID: "shard1", CPUUtilization: 30.0, UpdatedTime: stale},
+			{ShardID: "shard2", CPUUtilization: 10.0},
+		}
+		selectedShard, err := strategy.SelectShard(shards)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if selectedShard.ShardID != "shard2" {
+			t.Errorf("Expected shard2, got %s", selectedShard.ShardID)
+		}
+	})
+}
+
+func TestSelectShardByWeights(t *testing.T) {
+	shards := []*shardmetadata.Shard{
+		{ShardID: "shard1", CPUUtilization: 10.0, P99LatencyMs: 80, InFlight: 40},
+		{ShardID: "shard2", CPUUtilization: 40.0, P99LatencyMs: 5, InFlight: 2},
+		{ShardID: "shard3", CPUUtilization: 30.0, P99LatencyMs: 20, InFlight: 30},
+	}
+
+	// Test Case 1: A single signal other than CPU drives selection
+	t.Run("SingleSignal", func(t *testing.T) {
+		strategy := &loadbalancer.MetricsStrategy{Weights: map[string]float64{shardmetadata.SignalInFlight: 1}}
+		selectedShard, err := strategy.SelectShard(shards)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if selectedShard.ShardID != "shard2" {
+			t.Errorf("Expected shard2, got %s", selectedShard.ShardID)
+		}
+	})
+
+	// Test Case 2: Signals are combined by weight
+	t.Run("WeightedCombination", func(t *testing.T) {
+		strategy := &loadbalancer.MetricsStrategy{Weights: map[string]float64{
+			shardmetadata.SignalCPU:     0.9,
+			shardmetadata.SignalLatency: 0.1,
+		}}
+		selectedShard, err := strategy.SelectShard(shards)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if selectedShard.ShardID != "shard1" {
+			t.Errorf("Expected shard1, got %s", selectedShard.ShardID)
+		}
+	})
+
+	// Test Case 3: Empty shard list
+	t.Run("EmptyShardList", func(t *testing.T) {
+		strategy := &loadbalancer.MetricsStrategy{Weights: map[string]float64{shardmetadata.SignalMemory: 1}}
+		if _, err := strategy.SelectShard(nil); err == nil {
+			t.Fatal("Expected an error, but got none")
+		}
+	})
+}
+
+func TestParseSelectionWeights(t *testing.T) {
+	for _, value := range []string{"", "cpu"} {
+		weights, err := loadbalancer.ParseSelectionWeights(value)
+		if err != nil || weights != nil {
+			t.Errorf("Expected CPU-only selection for %q, got %v (%v)", value, weights, err)
+		}
+	}
+
+	weights, err := loadbalancer.ParseSelectionWeights("cpu=0.5, latency=0.3,in_flight")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]float64{"cpu": 0.5, "latency": 0.3, "in_flight": 1}
+	if len(weights) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, weights)
+	}
+	for signal, weight := range expected {
+		if weights[signal] != weight {
+			t.Errorf("Expected weight %v for %s, got %v", weight, signal, weights[signal])
+		}
+	}
+
+	for _, value := range []string{"disk", "cpu=-1", "cpu=abc", "cpu,cpu", "cpu=0,memory=0"} {
+		if _, err := loadbalancer.ParseSelectionWeights(value); err == nil {
+			t.Errorf("Expected an error for %q", value)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package metadatacache
+
+import (
+	"context"
+	"log"
+	"sharded-counters/internal/etcd"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxEntries bounds the number of cached keys when no other value is
+// configured.
+const DefaultMaxEntries = 100000
+
+// reconnectDelay is the pause before a failed watch is re-established.
+const reconnectDelay = time.Second
+
+// Stats describes how well the cache is doing.
+type Stats struct {
+	Entries    int     `json:"entries"`
+	Hits       int64   `json:"hits"`
+	Misses     int64   `json:"misses"`
+	HitRatio   float64 `json:"hit_ratio"`
+	Reconnects int64   `json:"reconnects"`
+	Watching   bool    `json:"watching"` // Whether every cached prefix is being watched.
+}
+
+// Manager is an etcd.Manager that serves reads of keys under the cached
+// prefixes from memory. Every prefix is watched, and cached values are updated
+// or dropped as soon as the watch reports a change, so reads touch etcd only
+// on misses. While the watch of a prefix is down, reads of its keys go to etcd
+// and the prefix's cached values are discarded, since changes may have been
+// missed.
+//
+// Writes go straight to etcd; the keys they touch are re-read afterwards so
+// that the cache reflects its own writes without waiting for the watch.
+type Manager struct {
+	etcd.Manager
+	prefixes   []string
+	maxEntries int
+
+	mu          sync.RWMutex
+	entries     map[string]entry
+	watching    map[string]bool      // Prefixes whose watch is established.
+	generations map[string]int64     // Bumped on every watch restart of a prefix.
+	inflight    map[string]*inflight // Keys being read from etcd on a miss.
+
+	hits       atomic.Int64
+	misses     atomic.Int64
+	reconnects atomic.Int64
+}
+
+type entry struct {
+	value    string
+	revision int64 // Revision of the last change of the key.
+}
+
+// inflight tracks the misses of a key that are being read from etcd. If the
+// key changes in the meantime, the values read may be stale and are not cached.
+type inflight struct {
+	readers int
+	changed bool
+}
+
+// New creates a cache of the keys under prefixes in front of manager, watched
+// through the manager itself. No key is cached until Run has established the
+// watches. maxEntries below one is treated as DefaultMaxEntries.
+func New(manager etcd.Manager, maxEntries int, prefixes ...string) *Manager {
+	if maxEntries < 1 {
+		maxEntries = DefaultMaxEntries
+	}
+	return &Manager{
+		Manager:     manager,
+		prefixes:    prefixes,
+		maxEntries:  maxEntries,
+		entries:     make(map[string]entry),
+		watching:    make(map[string]bool),
+		generations: make(map[string]int64),
+		inflight:    make(map[string]*inflight),
+	}
+}
+
+// Run watches every cached prefix, re-establishing failed watches, until ctx
+// is cancelled.
+func (m *Manager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, prefix := range m.prefixes {
+		wg.Add(1)
+		go func(prefix string) {
+			defer wg.Done()
+			m.watch(ctx, prefix)
+		}(prefix)
+	}
+	wg.Wait()
+}
+
+func (m *Manager) watch(ctx context.Context, prefix string) {
+	for {
+		// Resuming would replay the missed changes, but entries read in the
+		// meantime would be served before the replay caught up with them, so
+		// every restart starts afresh.
+		for resp := range m.Manager.Watch(ctx, prefix, 0) {
+			if resp.Err != nil {
+				log.Printf("Metadata cache watch of %s failed: %v", prefix, resp.Err)
+				break
+			}
+			m.apply(prefix, resp.Events)
+		}
+		m.stopWatching(prefix)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectDelay):
+		}
+		m.reconnects.Add(1)
+	}
+}
+
+// apply updates the cache with watched events and marks the prefix as watched.
+func (m *Manager) apply(prefix string, events []etcd.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watching[prefix] = true
+	for _, ev := range events {
+		if read, ok := m.inflight[ev.Key]; ok {
+			read.changed = true
+		}
+		current, ok := m.entries[ev.Key]
+		if !ok || current.revision > ev.Revision {
+			continue // Only keys that are read are cached.
+		}
+		if ev.Type == etcd.EventDelete {
+			delete(m.entries, ev.Key)
+			continue
+		}
+		m.entries[ev.Key] = entry{value: ev.Value, revision: ev.Revision}
+	}
+}
+
+// stopWatching discards the cached values of a prefix whose watch ended.
+func (m *Manager) stopWatching(prefix string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.watching[prefix] = false
+	m.generations[prefix]++
+	for key := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(m.entries, key)
+		}
+	}
+}
+
+// watchedPrefix returns the cached prefix of key and its watch generation, if
+// the key is cached and the prefix is being watched.
+func (m *Manager) watchedPrefix(key string) (string, int64, bool) {
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(key, prefix) && m.watching[prefix] {
+			return prefix, m.generations[prefix], true
+		}
+	}
+	return "", 0, false
+}
+
+// Get retrieves the value for a key, from memory when it is cached.
+func (m *Manager) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := m.GetWithRevision(ctx, key)
+	return value, err
+}
+
+// GetWithRevision is like Get, but also returns the key's modification revision.
+func (m *Manager) GetWithRevision(ctx context.Context, key string) (string, int64, error) {
+	m.mu.RLock()
+	e, cached := m.entries[key]
+	_, _, watched := m.watchedPrefix(key)
+	m.mu.RUnlock()
+	if !watched {
+		return m.Manager.GetWithRevision(ctx, key)
+	}
+	if cached {
+		m.hits.Add(1)
+		return e.value, e.revision, nil
+	}
+	m.misses.Add(1)
+	return m.load(ctx, key)
+}
+
+// load reads a key from etcd and caches it unless it changed during the read.
+func (m *Manager) load(ctx context.Context, key string) (string, int64, error) {
+	m.mu.Lock()
+	prefix, generation, watched := m.watchedPrefix(key)
+	if !watched {
+		m.mu.Unlock()
+		return m.Manager.GetWithRevision(ctx, key)
+	}
+	read, ok := m.inflight[key]
+	if !ok {
+		read = &inflight{}
+		m.inflight[key] = read
+	}
+	read.readers++
+	m.mu.Unlock()
+
+	value, revision, err := m.Manager.GetWithRevision(ctx, key)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	read.readers--
+	if read.readers == 0 {
+		delete(m.inflight, key)
+	}
+	if err != nil || read.changed || m.generations[prefix] != generation || !m.watching[prefix] {
+		return value, revision, err
+	}
+	if current, ok := m.entries[key]; ok && current.revision >= revision {
+		return value, revision, nil
+	}
+	if _, ok := m.entries[key]; !ok && len(m.entries) >= m.maxEntries {
+		// Evict an arbitrary key to stay within maxEntries.
+		for evicted := range m.entries {
+			delete(m.entries, evicted)
+			break
+		}
+	}
+	m.entries[key] = entry{value: value, revision: revision}
+	return value, revision, nil
+}
+
+// refresh re-reads keys that were just written through the cache.
+func (m *Manager) refresh(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		m.mu.Lock()
+		_, cached := m.entries[key]
+		delete(m.entries, key)
+		if read, ok := m.inflight[key]; ok {
+			read.changed = true
+		}
+		m.mu.Unlock()
+		if cached {
+			m.load(ctx, key)
+		}
+	}
+}
+
+// SaveMetadata saves a key-value pair in Etcd.
+func (m *Manager) SaveMetadata(ctx context.Context, key, value string) error {
+	defer m.refresh(ctx, key)
+	return m.Manager.SaveMetadata(ctx, key, value)
+}
+
+// CommitIfUnchanged applies ops in one transaction if every key in revisions
+// was last modified at its revision. A failed commit also refreshes the
+// compared keys, so that a retry based on a cached read sees the values that
+// won.
+func (m *Manager) CommitIfUnchanged(ctx context.Context, revisions map[string]int64, ops []etcd.Op) (bool, error) {
+	keys := make([]string, 0, len(revisions)+len(ops))
+	for key := range revisions {
+		keys = append(keys, key)
+	}
+	for _, op := range ops {
+		keys = append(keys, op.Key)
+	}
+	defer m.refresh(ctx, keys...)
+	return m.Manager.CommitIfUnchanged(ctx, revisions, ops)
+}
+
+// Stats returns the cache's counters.
+func (m *Manager) Stats() Stats {
+	m.mu.RLock()
+	stats := Stats{Entries: len(m.entries), Watching: len(m.prefixes) > 0}
+	for _, prefix := range m.prefixes {
+		stats.Watching = stats.Watching && m.watching[prefix]
+	}
+	m.mu.RUnlock()
+
+	stats.Hits = m.hits.Load()
+	stats.Misses = m.misses.Load()
+	stats.Reconnects = m.reconnects.Load()
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
@@ -0,0 +1,338 @@
+package metadatacache_test
+
+import (
+	"context"
+	"errors"
+	"sharded-counters/internal/etcd"
+	metadatacache "sharded-counters/internal/metadata_cache"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEtcd is an etcd.Manager that counts reads and hands every watch to the
+// test, which feeds it responses. Only the methods used by the cache are
+// backed by the map.
+type fakeEtcd struct {
+	watches chan chan etcd.WatchResponse
+
+	mu        sync.Mutex
+	store     map[string]string
+	revisions map[string]int64
+	revision  int64
+	gets      int
+	onGet     func(key string) // Called before a read, without holding mu.
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{
+		watches:   make(chan chan etcd.WatchResponse),
+		store:     make(map[string]string),
+		revisions: make(map[string]int64),
+	}
+}
+
+func (f *fakeEtcd) put(key, value string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.revision++
+	f.store[key] = value
+	f.revisions[key] = f.revision
+	return f.revision
+}
+
+func (f *fakeEtcd) reads() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.gets
+}
+
+func (f *fakeEtcd) Get(ctx context.Context, key string) (string, error) {
+	value, _, err := f.GetWithRevision(ctx, key)
+	return value, err
+}
+
+func (f *fakeEtcd) GetWithRevision(ctx context.Context, key string) (string, int64, error) {
+	if f.onGet != nil {
+		f.onGet(key)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.gets++
+	value, ok := f.store[key]
+	if !ok {
+		return "", 0, &etcd.KeyNotFoundError{Key: key}
+	}
+	return value, f.revisions[key], nil
+}
+
+func (f *fakeEtcd) SaveMetadata(ctx context.Context, key, value string) error {
+	f.put(key, value)
+	return nil
+}
+
+func (f *fakeEtcd) GetKeysWithPrefix(ctx context.Context, prefix string) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for key := range f.store {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (f *fakeEtcd) GetRange(ctx context.Context, prefix, startAfter string, limit int) ([]etcd.KeyValue, bool, error) {
+	return nil, false, errors.New("not implemented")
+}
+
+func (f *fakeEtcd) CountKeysWithPrefix(ctx context.Context, prefix string) (int64, error) {
+	keys, _ := f.GetKeysWithPrefix(ctx, prefix)
+	return int64(len(keys)), nil
+}
+
+func (f *fakeEtcd) CommitIfUnchanged(ctx context.Context, revisions map[string]int64, ops []etcd.Op) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, revision := range revisions {
+		if f.revisions[key] != revision {
+			return false, nil
+		}
+	}
+	f.revision++
+	for _, op := range ops {
+		if op.Delete {
+			delete(f.store, op.Key)
+			delete(f.revisions, op.Key)
+		} else {
+			f.store[op.Key] = op.Value
+			f.revisions[op.Key] = f.revision
+		}
+	}
+	return true, nil
+}
+
+func (f *fakeEtcd) GrantLease(ctx context.Context, ttl time.Duration) (etcd.Lease, error) {
+	return nil, errors.New("not implemented")
+}
+
+func (f *fakeEtcd) Watch(ctx context.Context, prefix string, fromRevision int64) <-chan etcd.WatchResponse {
+	ch := make(chan etcd.WatchResponse)
+	f.watches <- ch
+	return ch
+}
+
+// startCache runs a cache of at most maxEntries keys of the "counters/" prefix and returns its first
+// watch, already established.
+func startCache(t *testing.T, store *fakeEtcd, maxEntries int) (*metadatacache.Manager, chan etcd.WatchResponse) {
+	t.Helper()
+	cache := metadatacache.New(store, maxEntries, "counters/")
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go cache.Run(ctx)
+
+	watch := <-store.watches
+	watch <- etcd.WatchResponse{}
+	waitFor(t, func() bool { return cache.Stats().Watching })
+	return cache, watch
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheHitsAndMisses(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeEtcd()
+	store.put("counters/a", "v1")
+	cache, _ := startCache(t, store, 0)
+
+	for i := 0; i < 3; i++ {
+		value, err := cache.Get(ctx, "counters/a")
+		if err != nil || value != "v1" {
+			t.Fatalf("Expected v1, got %q (%v)", value, err)
+		}
+	}
+	if store.reads() != 1 {
+		t.Errorf("Expected 1 etcd read, got %d", store.reads())
+	}
+
+	// Keys outside the cached prefixes always go to etcd.
+	store.put("other/b", "x")
+	cache.Get(ctx, "other/b")
+	cache.Get(ctx, "other/b")
+	if store.reads() != 3 {
+		t.Errorf("Expected uncached keys to be read from etcd, got %d reads", store.reads())
+	}
+
+	stats := cache.Stats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Entries != 1 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeEtcd()
+	for _, key := range []string{"counters/a", "counters/b", "counters/c"} {
+		store.put(key, "v1")
+	}
+	cache, _ := startCache(t, store, 2)
+
+	// Test Case 1: New keys are still cached once the cache is full
+	t.Run("Full", func(t *testing.T) {
+		cache.Get(ctx, "counters/a")
+		cache.Get(ctx, "counters/b")
+		cache.Get(ctx, "counters/c")
+		if entries := cache.Stats().Entries; entries != 2 {
+			t.Errorf("Expected the cache to stay at 2 entries, got %d", entries)
+		}
+		before := store.reads()
+		cache.Get(ctx, "counters/c")
+		if store.reads() != before {
+			t.Errorf("Expected the newest key to be cached, got %d etcd reads", store.reads()-before)
+		}
+	})
+
+	// Test Case 2: Evicted keys are read from etcd again
+	t.Run("Evicted", func(t *testing.T) {
+		before := store.reads()
+		for _, key := range []string{"counters/a", "counters/b"} {
+			if value, err := cache.Get(ctx, key); err != nil || value != "v1" {
+				t.Fatalf("Expected v1 for %s, got %q (%v)", key, value, err)
+			}
+		}
+		if store.reads() == before {
+			t.Errorf("Expected an evicted key to be read from etcd")
+		}
+		if entries := cache.Stats().Entries; entries != 2 {
+			t.Errorf("Expected the cache to stay at 2 entries, got %d", entries)
+		}
+	})
+}
+
+func TestCacheFollowsWatch(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeEtcd()
+	rev := store.put("counters/a", "v1")
+	cache, watch := startCache(t, store, 0)
+	cache.Get(ctx, "counters/a")
+
+	// Test Case 1: Puts replace the cached value
+	t.Run("Put", func(t *testing.T) {
+		rev = store.put("counters/a", "v2")
+		watch <- etcd.WatchResponse{Events: []etcd.Event{{Type: etcd.EventPut, Key: "counters/a", Value: "v2", Revision: rev}}}
+		waitFor(t, func() bool { value, _ := cache.Get(ctx, "counters/a"); return value == "v2" })
+		if store.reads() != 1 {
+			t.Errorf("Expected the update to come from the watch, got %d etcd reads", store.reads())
+		}
+	})
+
+	// Test Case 2: Deletes drop the cached value
+	t.Run("Delete", func(t *testing.T) {
+		store.CommitIfUnchanged(ctx, nil, []etcd.Op{{Key: "counters/a", Delete: true}})
+		watch <- etcd.WatchResponse{Events: []etcd.Event{{Type: etcd.EventDelete, Key: "counters/a", Revision: rev + 1}}}
+		waitFor(t, func() bool { return cache.Stats().Entries == 0 })
+		if _, err := cache.Get(ctx, "counters/a"); !etcd.IsKeyNotFound(err) {
+			t.Errorf("Expected KeyNotFoundError, got %v", err)
+		}
+	})
+}
+
+func TestCacheSkipsReadsRacingWithChanges(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeEtcd()
+	store.put("counters/a", "v1")
+	cache, watch := startCache(t, store, 0)
+
+	// The key changes while the miss is being read from etcd.
+	store.onGet = func(key string) {
+		store.onGet = nil
+		watch <- etcd.WatchResponse{Events: []etcd.Event{{Type: etcd.EventPut, Key: "counters/a", Value: "v0", Revision: 1}}}
+		watch <- etcd.WatchResponse{} // Returns once the event has been applied.
+	}
+	cache.Get(ctx, "counters/a")
+	if entries := cache.Stats().Entries; entries != 0 {
+		t.Errorf("Expected a read racing with a change not to be cached, got %d entries", entries)
+	}
+}
+
+func TestCacheReconnects(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeEtcd()
+	store.put("counters/a", "v1")
+	cache, watch := startCache(t, store, 0)
+	cache.Get(ctx, "counters/a")
+
+	watch <- etcd.WatchResponse{Err: errors.New("compacted")}
+	close(watch)
+	waitFor(t, func() bool { return !cache.Stats().Watching })
+	if entries := cache.Stats().Entries; entries != 0 {
+		t.Errorf("Expected cached values to be discarded, got %d entries", entries)
+	}
+
+	// Reads go to etcd until the watch is back.
+	before := store.reads()
+	cache.Get(ctx, "counters/a")
+	cache.Get(ctx, "counters/a")
+	if store.reads() != before+2 {
+		t.Errorf("Expected reads to bypass the cache, got %d etcd reads", store.reads()-before)
+	}
+
+	watch = <-store.watches
+	watch <- etcd.WatchResponse{}
+	waitFor(t, func() bool { return cache.Stats().Watching })
+	if reconnects := cache.Stats().Reconnects; reconnects != 1 {
+		t.Errorf("Expected 1 reconnect, got %d", reconnects)
+	}
+}
+
+func TestCacheSeesOwnWrites(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeEtcd()
+	store.put("counters/a", "v1")
+	store.put("counters/b", "v1")
+	cache, _ := startCache(t, store, 0)
+	cache.Get(ctx, "counters/a")
+	cache.Get(ctx, "counters/b")
+
+	// No watch event is delivered in either case.
+
+	// Test Case 1: A save is seen by the next read
+	t.Run("Save", func(t *testing.T) {
+		if err := cache.SaveMetadata(ctx, "counters/a", "v2"); err != nil {
+			t.Fatalf("SaveMetadata failed: %v", err)
+		}
+		if value, _ := cache.Get(ctx, "counters/a"); value != "v2" {
+			t.Errorf("Expected v2 after a save through the cache, got %q", value)
+		}
+	})
+
+	// Test Case 2: A commit is seen by the next read, deletes included
+	t.Run("Commit", func(t *testing.T) {
+		_, revision, err := cache.GetWithRevision(ctx, "counters/a")
+		if err != nil {
+			t.Fatalf("GetWithRevision failed: %v", err)
+		}
+		ops := []etcd.Op{{Key: "counters/a", Value: "v3"}, {Key: "counters/b", Delete: true}}
+		committed, err := cache.CommitIfUnchanged(ctx, map[string]int64{"counters/a": revision}, ops)
+		if err != nil || !committed {
+			t.Fatalf("CommitIfUnchanged failed: %v", err)
+		}
+		if value, _ := cache.Get(ctx, "counters/a"); value != "v3" {
+			t.Errorf("Expected v3 after a commit through the cache, got %q", value)
+		}
+		if _, err := cache.Get(ctx, "counters/b"); !etcd.IsKeyNotFound(err) {
+			t.Errorf("Expected KeyNotFoundError after a delete through the cache, got %v", err)
+		}
+	})
+}
@@ -6,14 +6,23 @@ import (
 	"log"
 	"net/http"
 	"runtime/debug"
+	"sharded-counters/internal/config"
+	countermetadata "sharded-counters/internal/counter_metadata"
 	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/loadbalancer"
+	metadatacache "sharded-counters/internal/metadata_cache"
+	shardmetadata "sharded-counters/internal/shard_metadata"
 	counter "sharded-counters/internal/shard_store"
 	"time"
 )
 
 type Dependencies struct {
 	CounterManager *counter.CounterManager
-	EtcdManager    *etcd.EtcdManager
+	EtcdManager    etcd.Manager // The metadata cache on app servers, etcd itself on shards.
+	MetadataCache  *metadatacache.Manager
+	Config         *config.Config
+	Placement      countermetadata.Placement
+	Selection      loadbalancer.SelectionStrategy // Picks the shard a write goes to.
 	// Add other dependencies as needed.
 }
 
@@ -34,12 +43,16 @@ func Middleware(deps *Dependencies, next http.Handler) http.Handler {
 		// Create a response recorder to capture response details.
 		recorder := &responseRecorder{ResponseWriter: w, statusCode: http.StatusOK}
 
+		// Count the request towards the load and error rate the shard publishes.
+		finish := shardmetadata.TrackRequest()
+
 		// Recover from any panic to prevent server crash
 		defer func() {
 			if err := recover(); err != nil {
 				log.Printf("Recovered from panic: %v\nStack Trace:\n%s", err, debug.Stack())
 				http.Error(recorder, "Internal Server Error", http.StatusInternalServerError)
 			}
+			finish(recorder.statusCode)
 		}()
 
 		next.ServeHTTP(recorder, r)
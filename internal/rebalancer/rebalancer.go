@@ -0,0 +1,404 @@
+package rebalancer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/loadbalancer"
+	"sharded-counters/internal/responsehandler"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ShardHandoffUrl is the shard endpoint that moves a counter's partial value
+// to another shard.
+const ShardHandoffUrl = "counter/shard/handoff"
+
+// listPageSize is the number of counter records reconciled per etcd read.
+const listPageSize = 100
+
+// lateWriteWindow is how long after a shard is removed from a counter's record
+// app servers may still route writes to it: until their cached record catches
+// up and requests forwarded with the old record have finished.
+const lateWriteWindow = 30 * time.Second
+
+// HandoffRequest asks a shard to move its partial value of a counter to the
+// target shard.
+type HandoffRequest struct {
+	CounterID   string `json:"counter_id"`
+	TargetShard string `json:"target_shard"`
+}
+
+// HandoffResponse reports the value a shard moved to the target shard.
+type HandoffResponse struct {
+	CounterID string `json:"counter_id"`
+	Moved     int64  `json:"moved"`
+}
+
+// HandoffFunc moves the partial value of a counter from one shard to another.
+type HandoffFunc func(ctx context.Context, from, to string, counterID string) error
+
+// Rebalancer keeps the shard lists of counters in line with the shards that
+// are alive. Counters spread over every shard pick up new shards, counters
+// placed on a subset follow their placement, and shards that are draining
+// hand their partial values over before they are removed from a record.
+// Shards that vanished without draining are removed once they have been gone
+// for the dead shard grace period; their values are lost.
+//
+// Reconciling is idempotent, so several app servers may run a rebalancer at
+// the same time.
+type Rebalancer struct {
+	manager        etcd.Manager
+	placement      countermetadata.Placement
+	deadShardGrace time.Duration
+	handoff        HandoffFunc
+
+	missingSince map[string]time.Time // Shards in records that are not alive, by when they were first missed.
+	lastShards   string               // Fingerprint of the shards seen by the last reconcile.
+
+	sweepDelay time.Duration
+	sweeps     map[sweep]time.Time // Hand-offs still owed by removed shards, by when they are due.
+}
+
+// sweep is a hand-off of the writes a shard received after it was removed
+// from a counter's record.
+type sweep struct {
+	From, To, CounterID string
+}
+
+// New creates a rebalancer that hands partial values over through the shards'
+// handoff endpoint, bounding every hand-off by timeout.
+func New(manager etcd.Manager, placement countermetadata.Placement, deadShardGrace, timeout time.Duration) *Rebalancer {
+	lb := loadbalancer.NewLoadBalancer(nil, nil, manager)
+	return NewWithHandoff(manager, placement, deadShardGrace, func(ctx context.Context, from, to string, counterID string) error {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		return requestHandoff(ctx, lb, from, to, counterID)
+	})
+}
+
+// NewWithHandoff creates a rebalancer that moves partial values with handoff.
+func NewWithHandoff(manager etcd.Manager, placement countermetadata.Placement, deadShardGrace time.Duration, handoff HandoffFunc) *Rebalancer {
+	if placement == nil {
+		placement = countermetadata.HashRingPlacement{}
+	}
+	return &Rebalancer{
+		manager:        manager,
+		placement:      placement,
+		deadShardGrace: deadShardGrace,
+		handoff:        handoff,
+		missingSince:   make(map[string]time.Time),
+		sweepDelay:     lateWriteWindow,
+		sweeps:         make(map[sweep]time.Time),
+	}
+}
+
+// SetSweepDelay sets how long after removing a shard from a counter's record
+// the writes that still reached it are handed over.
+func (rb *Rebalancer) SetSweepDelay(delay time.Duration) {
+	rb.sweepDelay = delay
+}
+
+// Run reconciles whenever changes fires and the set of shards or their health
+// differs from the last pass, and unconditionally every interval so that
+// failed hand-offs are retried and late writes swept, until stop is closed.
+func (rb *Rebalancer) Run(interval time.Duration, changes <-chan struct{}, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		force := false
+		select {
+		case <-ticker.C:
+			force = true
+		case <-changes:
+		case <-stop:
+			return
+		}
+		if err := rb.reconcile(context.Background(), force); err != nil {
+			log.Printf("Error rebalancing counters: %v", err)
+		}
+	}
+}
+
+// Reconcile updates the shard lists of all counters once.
+func (rb *Rebalancer) Reconcile(ctx context.Context) error {
+	return rb.reconcile(ctx, true)
+}
+
+func (rb *Rebalancer) reconcile(ctx context.Context, force bool) error {
+	alive, draining, err := rb.shardStates(ctx)
+	if err != nil {
+		return err
+	}
+	rb.sweepLateWrites(ctx, alive)
+	fingerprint := shardFingerprint(alive, draining)
+	if !force && fingerprint == rb.lastShards {
+		return nil
+	}
+
+	// Shards that take new counters: alive and not draining.
+	var targets []*shardmetadata.Shard
+	for _, shard := range alive {
+		if !draining[shard.ShardID] {
+			targets = append(targets, shard)
+		}
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no shards available to rebalance onto")
+	}
+
+	isAlive := make(map[string]bool, len(alive))
+	for _, shard := range alive {
+		isAlive[shard.ShardID] = true
+		delete(rb.missingSince, shard.ShardID)
+	}
+
+	failed := 0
+	unsaved := make(map[string]bool) // Dead shards still listed by a record that failed to save.
+	cursor := ""
+	for {
+		page, err := countermetadata.ListCounters(ctx, rb.manager, countermetadata.ListOptions{Cursor: cursor, Limit: listPageSize})
+		if err != nil {
+			return err
+		}
+		for _, record := range page.Records {
+			err := rb.rebalanceCounter(ctx, record, targets, isAlive)
+			if etcd.IsKeyNotFound(err) {
+				continue // Deleted while the page was being reconciled.
+			}
+			if err != nil {
+				log.Printf("Error rebalancing counter %s: %v", record.CounterID, err)
+				failed++
+				for _, shardID := range record.Shards {
+					if !isAlive[shardID] {
+						unsaved[shardID] = true
+					}
+				}
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	// Forget dead shards that are past the grace period once they have been
+	// removed from every record; the others keep their grace period running.
+	for shardID, since := range rb.missingSince {
+		if time.Since(since) >= rb.deadShardGrace && !unsaved[shardID] {
+			delete(rb.missingSince, shardID)
+		}
+	}
+
+	if failed > 0 {
+		// Retry on the next change as well as on the next tick.
+		rb.lastShards = ""
+		return fmt.Errorf("%d counters could not be rebalanced", failed)
+	}
+	rb.lastShards = fingerprint
+	return nil
+}
+
+// rebalanceCounter moves one counter onto its desired shards. Shards leaving
+// the counter stay in its record until their partial value has been handed
+// over, so reads keep counting it in the meantime. The listed record only
+// names the counter: the shards are computed from its current record.
+func (rb *Rebalancer) rebalanceCounter(ctx context.Context, record *countermetadata.CounterRecord, targets []*shardmetadata.Shard, isAlive map[string]bool) error {
+	var desired []*shardmetadata.Shard
+	var leaving []string
+	now := time.Now()
+	record, err := rb.saveShards(ctx, record.CounterID, func(record *countermetadata.CounterRecord) ([]string, error) {
+		desired = targets
+		if record.ShardCount > 0 && record.ShardCount < len(targets) {
+			var err error
+			desired, err = rb.placement.Rebalance(ctx, rb.manager, record.CounterID, record.Shards, targets, record.ShardCount)
+			if err != nil {
+				return nil, err
+			}
+		}
+		wanted := make(map[string]bool, len(desired))
+		for _, shard := range desired {
+			wanted[shard.ShardID] = true
+		}
+
+		// Keep leaving shards that can still hand over their value, and dead
+		// shards that may yet come back.
+		shards := countermetadata.GetShardIds(desired)
+		leaving = nil
+		for _, shardID := range record.Shards {
+			if wanted[shardID] {
+				continue
+			}
+			if isAlive[shardID] {
+				leaving = append(leaving, shardID)
+				shards = append(shards, shardID)
+				continue
+			}
+			since, ok := rb.missingSince[shardID]
+			if !ok {
+				since = now
+				rb.missingSince[shardID] = since
+			}
+			if now.Sub(since) < rb.deadShardGrace {
+				shards = append(shards, shardID)
+				continue
+			}
+			log.Printf("Removing dead shard %s from counter %s; its partial value is lost", shardID, record.CounterID)
+		}
+		return shards, nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(leaving) == 0 {
+		return nil
+	}
+
+	// Hand every leaving shard's value over, then drop the shards that
+	// succeeded. A second hand-off sweeps up increments that were routed with
+	// the old record while the first was in flight, and a last one, once app
+	// servers have seen the new record, those routed with it since.
+	target := desired[0].ShardID
+	var done []string
+	var errs []string
+	for _, shardID := range leaving {
+		if err := rb.handoff(ctx, shardID, target, record.CounterID); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		done = append(done, shardID)
+	}
+	if len(done) > 0 {
+		if _, err := rb.saveShards(ctx, record.CounterID, func(record *countermetadata.CounterRecord) ([]string, error) {
+			return removeShards(record.Shards, done), nil
+		}); err != nil {
+			return err
+		}
+		for _, shardID := range done {
+			if err := rb.handoff(ctx, shardID, target, record.CounterID); err != nil {
+				log.Printf("Error sweeping counter %s from shard %s: %v", record.CounterID, shardID, err)
+			}
+			rb.sweeps[sweep{From: shardID, To: target, CounterID: record.CounterID}] = now.Add(rb.sweepDelay)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("hand-off failed: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// sweepLateWrites hands over the writes that removed shards received from app
+// servers routing with an outdated record. Failed sweeps are retried on the
+// next pass; those of shards that are gone are dropped, as their values are
+// lost anyway.
+func (rb *Rebalancer) sweepLateWrites(ctx context.Context, alive []*shardmetadata.Shard) {
+	isAlive := make(map[string]bool, len(alive))
+	for _, shard := range alive {
+		isAlive[shard.ShardID] = true
+	}
+	now := time.Now()
+	for s, due := range rb.sweeps {
+		if !isAlive[s.From] {
+			delete(rb.sweeps, s)
+			continue
+		}
+		if now.Before(due) {
+			continue
+		}
+		if err := rb.handoff(ctx, s.From, s.To, s.CounterID); err != nil {
+			log.Printf("Error sweeping counter %s from shard %s: %v", s.CounterID, s.From, err)
+			continue
+		}
+		delete(rb.sweeps, s)
+	}
+}
+
+// saveShards stores the shard list shardsFor computes from the counter's
+// current record, recomputing it whenever a concurrent writer, such as the
+// rebalancer of another app server, changes the record first.
+func (rb *Rebalancer) saveShards(ctx context.Context, counterID string, shardsFor func(record *countermetadata.CounterRecord) ([]string, error)) (*countermetadata.CounterRecord, error) {
+	return countermetadata.UpdateCounterShards(ctx, rb.manager, counterID, func(record *countermetadata.CounterRecord) ([]string, error) {
+		shards, err := shardsFor(record)
+		if err == nil && !countermetadata.SameShards(record.Shards, shards) {
+			log.Printf("Rebalancing counter %s: %v => %v", counterID, record.Shards, shards)
+		}
+		return shards, err
+	})
+}
+
+// shardStates returns the alive shards and which of them are draining.
+func (rb *Rebalancer) shardStates(ctx context.Context) ([]*shardmetadata.Shard, map[string]bool, error) {
+	alive, err := shardmetadata.GetAliveShards(ctx, rb.manager)
+	if err != nil {
+		return nil, nil, err
+	}
+	draining := make(map[string]bool)
+	for _, shard := range alive {
+		metrics, err := shardmetadata.GetShardMetrics(ctx, rb.manager, shard.ShardID)
+		if err != nil {
+			if etcd.IsKeyNotFound(err) {
+				continue // Expired since it was listed; treated as alive until the next pass.
+			}
+			return nil, nil, err
+		}
+		if metrics.Health == shardmetadata.HealthDraining {
+			draining[shard.ShardID] = true
+		}
+	}
+	sort.Slice(alive, func(i, j int) bool { return alive[i].ShardID < alive[j].ShardID })
+	return alive, draining, nil
+}
+
+// requestHandoff asks the from shard to move its partial value of the counter to the to shard.
+func requestHandoff(ctx context.Context, lb *loadbalancer.LoadBalancer, from, to string, counterID string) error {
+	payload, err := json.Marshal(HandoffRequest{CounterID: counterID, TargetShard: to})
+	if err != nil {
+		return fmt.Errorf("failed to marshal hand-off request: %v", err)
+	}
+	respBody, statusCode, err := lb.ForwardRequestToShard(ctx, http.MethodPost, &shardmetadata.Shard{ShardID: from}, ShardHandoffUrl, payload, nil)
+	if err != nil {
+		return fmt.Errorf("hand-off from shard %s failed: %v (status Code: %d)", from, err, statusCode)
+	}
+	handoff := &HandoffResponse{}
+	response := &responsehandler.Response{Data: handoff}
+	if err := json.Unmarshal([]byte(respBody), response); err != nil {
+		return fmt.Errorf("failed to parse hand-off response from shard %s: %v", from, err)
+	}
+	if handoff.Moved != 0 {
+		log.Printf("Moved %d of counter %s from shard %s to %s", handoff.Moved, counterID, from, to)
+	}
+	return nil
+}
+
+func shardFingerprint(alive []*shardmetadata.Shard, draining map[string]bool) string {
+	var b strings.Builder
+	for _, shard := range alive {
+		b.WriteString(shard.ShardID)
+		if draining[shard.ShardID] {
+			b.WriteString("(draining)")
+		}
+		b.WriteString(",")
+	}
+	return b.String()
+}
+
+func removeShards(shards, removed []string) []string {
+	drop := make(map[string]bool, len(removed))
+	for _, shardID := range removed {
+		drop[shardID] = true
+	}
+	var kept []string
+	for _, shardID := range shards {
+		if !drop[shardID] {
+			kept = append(kept, shardID)
+		}
+	}
+	return kept
+}
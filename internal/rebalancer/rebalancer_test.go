@@ -0,0 +1,345 @@
+package rebalancer_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/etcd/etcdtest"
+	"sharded-counters/internal/rebalancer"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// registerShard publishes a shard with the given health, as the shard would.
+func registerShard(t *testing.T, m *etcdtest.Manager, shardID, health string) {
+	t.Helper()
+	value, err := json.Marshal(shardmetadata.Shard{ShardID: shardID, Health: health})
+	if err != nil {
+		t.Fatalf("Failed to marshal shard: %v", err)
+	}
+	lease, err := m.GrantLease(context.Background(), 6*time.Second)
+	if err != nil {
+		t.Fatalf("GrantLease failed: %v", err)
+	}
+	lease.Put(context.Background(), shardmetadata.ShardKeyPrefix+shardID, string(value))
+}
+
+func createCounter(t *testing.T, m *etcdtest.Manager, counterID string, shardCount int) {
+	t.Helper()
+	if _, err := countermetadata.CreateCounter(context.Background(), m, counterID, countermetadata.CreateOptions{ShardCount: shardCount}); err != nil {
+		t.Fatalf("CreateCounter failed: %v", err)
+	}
+}
+
+func counterShards(t *testing.T, m *etcdtest.Manager, counterID string) []string {
+	t.Helper()
+	record, err := countermetadata.GetCounterRecord(context.Background(), m, counterID)
+	if err != nil {
+		t.Fatalf("GetCounterRecord failed: %v", err)
+	}
+	shards := append([]string(nil), record.Shards...)
+	sort.Strings(shards)
+	return shards
+}
+
+type handoffCall struct {
+	From, To, CounterID string
+}
+
+// recordingHandoff records every hand-off and fails those out of failing shards.
+type recordingHandoff struct {
+	calls   []handoffCall
+	failing map[string]bool
+}
+
+func (h *recordingHandoff) handoff(ctx context.Context, from, to string, counterID string) error {
+	h.calls = append(h.calls, handoffCall{From: from, To: to, CounterID: counterID})
+	if h.failing[from] {
+		return errors.New("shard unreachable")
+	}
+	return nil
+}
+
+func TestRebalanceShardJoins(t *testing.T) {
+	mockEtcd := etcdtest.NewManager()
+	registerShard(t, mockEtcd, "shard1", shardmetadata.HealthOK)
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthOK)
+	createCounter(t, mockEtcd, "everywhere", 0)
+	createCounter(t, mockEtcd, "narrow", 1)
+
+	registerShard(t, mockEtcd, "shard3", shardmetadata.HealthOK)
+	h := &recordingHandoff{}
+	rb := rebalancer.NewWithHandoff(mockEtcd, countermetadata.HashRingPlacement{}, time.Minute, h.handoff)
+	if err := rb.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	if got := counterShards(t, mockEtcd, "everywhere"); strings.Join(got, ",") != "shard1,shard2,shard3" {
+		t.Errorf("Expected counter on all shards, got %v", got)
+	}
+	if got := counterShards(t, mockEtcd, "narrow"); len(got) != 1 {
+		t.Errorf("Expected counter to stay on one shard, got %v", got)
+	}
+	for _, call := range h.calls {
+		if call.CounterID == "everywhere" {
+			t.Errorf("Expected no hand-off for a counter gaining a shard, got %+v", call)
+		}
+	}
+}
+
+func TestRebalanceDrainingShard(t *testing.T) {
+	mockEtcd := etcdtest.NewManager()
+	registerShard(t, mockEtcd, "shard1", shardmetadata.HealthOK)
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthOK)
+	createCounter(t, mockEtcd, "counter", 0)
+
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthDraining)
+	h := &recordingHandoff{}
+	rb := rebalancer.NewWithHandoff(mockEtcd, nil, time.Minute, h.handoff)
+	if err := rb.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	if got := counterShards(t, mockEtcd, "counter"); strings.Join(got, ",") != "shard1" {
+		t.Errorf("Expected draining shard to be removed, got %v", got)
+	}
+	if len(h.calls) == 0 || h.calls[0] != (handoffCall{From: "shard2", To: "shard1", CounterID: "counter"}) {
+		t.Errorf("Expected hand-off from shard2 to shard1, got %+v", h.calls)
+	}
+	owned, err := countermetadata.CountOwnedCounters(context.Background(), mockEtcd, "shard2")
+	if err != nil {
+		t.Fatalf("CountOwnedCounters failed: %v", err)
+	}
+	if owned != 0 {
+		t.Errorf("Expected draining shard to own no counters, got %d", owned)
+	}
+}
+
+func TestRebalanceKeepsConcurrentChanges(t *testing.T) {
+	ctx := context.Background()
+	mockEtcd := etcdtest.NewManager()
+	registerShard(t, mockEtcd, "shard1", shardmetadata.HealthOK)
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthOK)
+	createCounter(t, mockEtcd, "counter", 0)
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthDraining)
+
+	// While shard2 hands its value over, another app server adds shard3 to
+	// the counter and the counter is reset.
+	h := &recordingHandoff{}
+	rb := rebalancer.NewWithHandoff(mockEtcd, nil, time.Minute, func(ctx context.Context, from, to string, counterID string) error {
+		if len(h.calls) == 0 {
+			if err := countermetadata.SaveCounterMetadata(ctx, mockEtcd, counterID, countermetadata.GetShardObjList([]string{"shard1", "shard2", "shard3"})); err != nil {
+				t.Fatalf("SaveCounterMetadata failed: %v", err)
+			}
+			if _, err := countermetadata.ResetCounter(ctx, mockEtcd, counterID); err != nil {
+				t.Fatalf("ResetCounter failed: %v", err)
+			}
+		}
+		return h.handoff(ctx, from, to, counterID)
+	})
+	if err := rb.Reconcile(ctx); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+
+	if got := counterShards(t, mockEtcd, "counter"); strings.Join(got, ",") != "shard1,shard3" {
+		t.Errorf("Expected only the draining shard to be removed, got %v", got)
+	}
+	record, err := countermetadata.GetCounterRecord(ctx, mockEtcd, "counter")
+	if err != nil {
+		t.Fatalf("GetCounterRecord failed: %v", err)
+	}
+	if record.Epoch != 1 {
+		t.Errorf("Expected the reset to be kept, got epoch %d", record.Epoch)
+	}
+}
+
+func TestRebalanceFailedHandoff(t *testing.T) {
+	mockEtcd := etcdtest.NewManager()
+	registerShard(t, mockEtcd, "shard1", shardmetadata.HealthOK)
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthOK)
+	createCounter(t, mockEtcd, "counter", 0)
+
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthDraining)
+	h := &recordingHandoff{failing: map[string]bool{"shard2": true}}
+	rb := rebalancer.NewWithHandoff(mockEtcd, nil, time.Minute, h.handoff)
+	if err := rb.Reconcile(context.Background()); err == nil {
+		t.Fatal("Expected Reconcile to report the failed hand-off")
+	}
+
+	// The shard keeps its value, so it must stay in the record to be read.
+	if got := counterShards(t, mockEtcd, "counter"); strings.Join(got, ",") != "shard1,shard2" {
+		t.Errorf("Expected shard to stay until handed off, got %v", got)
+	}
+
+	h.failing = nil
+	if err := rb.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile retry failed: %v", err)
+	}
+	if got := counterShards(t, mockEtcd, "counter"); strings.Join(got, ",") != "shard1" {
+		t.Errorf("Expected shard to be removed after retry, got %v", got)
+	}
+}
+
+func TestRebalanceDeadShard(t *testing.T) {
+	mockEtcd := etcdtest.NewManager()
+	registerShard(t, mockEtcd, "shard1", shardmetadata.HealthOK)
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthOK)
+	createCounter(t, mockEtcd, "counter", 0)
+
+	// The shard's lease expires without draining.
+	mockEtcd.Expire(shardmetadata.ShardKeyPrefix + "shard2")
+
+	t.Run("Within Grace Period", func(t *testing.T) {
+		h := &recordingHandoff{}
+		rb := rebalancer.NewWithHandoff(mockEtcd, nil, time.Hour, h.handoff)
+		if err := rb.Reconcile(context.Background()); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+		if got := counterShards(t, mockEtcd, "counter"); strings.Join(got, ",") != "shard1,shard2" {
+			t.Errorf("Expected missing shard to be kept, got %v", got)
+		}
+	})
+
+	t.Run("After Grace Period", func(t *testing.T) {
+		h := &recordingHandoff{}
+		rb := rebalancer.NewWithHandoff(mockEtcd, nil, 0, h.handoff)
+		if err := rb.Reconcile(context.Background()); err != nil {
+			t.Fatalf("Reconcile failed: %v", err)
+		}
+		if got := counterShards(t, mockEtcd, "counter"); strings.Join(got, ",") != "shard1" {
+			t.Errorf("Expected dead shard to be removed, got %v", got)
+		}
+		if len(h.calls) != 0 {
+			t.Errorf("Expected no hand-off from a dead shard, got %+v", h.calls)
+		}
+	})
+}
+
+func TestRebalanceOnWatch(t *testing.T) {
+	mockEtcd := etcdtest.NewManager()
+	registerShard(t, mockEtcd, "shard1", shardmetadata.HealthOK)
+	createCounter(t, mockEtcd, "counter", 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stop := make(chan struct{})
+	defer close(stop)
+	h := &recordingHandoff{}
+	rb := rebalancer.NewWithHandoff(mockEtcd, nil, time.Minute, h.handoff)
+	go rb.Run(time.Hour, etcd.WatchChanges(ctx, mockEtcd, shardmetadata.ShardKeyPrefix), stop)
+
+	// The watch may not be established yet, so keep announcing the shard.
+	deadline := time.Now().Add(5 * time.Second)
+	for strings.Join(counterShards(t, mockEtcd, "counter"), ",") != "shard1,shard2" {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected the joining shard to be added, got %v", counterShards(t, mockEtcd, "counter"))
+		}
+		registerShard(t, mockEtcd, "shard2", shardmetadata.HealthOK)
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lastShardPlacement places every counter on the shard with the highest ID.
+type lastShardPlacement struct{}
+
+func (lastShardPlacement) Place(ctx context.Context, manager etcd.Manager, counterID string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	sorted := append([]*shardmetadata.Shard(nil), shards...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ShardID > sorted[j].ShardID })
+	return sorted[:count], nil
+}
+
+func (p lastShardPlacement) Rebalance(ctx context.Context, manager etcd.Manager, counterID string, current []string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	return p.Place(ctx, manager, counterID, shards, count)
+}
+
+func TestRebalanceSweepsLateWrites(t *testing.T) {
+	mockEtcd := etcdtest.NewManager()
+	registerShard(t, mockEtcd, "shard1", shardmetadata.HealthOK)
+	createCounter(t, mockEtcd, "counter", 1)
+
+	// The counter moves to the joining shard while shard1 stays alive.
+	registerShard(t, mockEtcd, "shard2", shardmetadata.HealthOK)
+	h := &recordingHandoff{}
+	rb := rebalancer.NewWithHandoff(mockEtcd, lastShardPlacement{}, time.Minute, h.handoff)
+	rb.SetSweepDelay(0)
+	if err := rb.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if got := counterShards(t, mockEtcd, "counter"); strings.Join(got, ",") != "shard2" {
+		t.Fatalf("Expected counter to move to shard2, got %v", got)
+	}
+	moved := handoffCall{From: "shard1", To: "shard2", CounterID: "counter"}
+	if len(h.calls) != 2 || h.calls[0] != moved || h.calls[1] != moved {
+		t.Fatalf("Expected a hand-off and a sweep, got %+v", h.calls)
+	}
+
+	// App servers may still have written to shard1 with the old record.
+	t.Run("Delayed Sweep", func(t *testing.T) {
+		h.calls = nil
+		h.failing = map[string]bool{"shard1": true}
+		rb.Reconcile(context.Background())
+		h.failing = nil
+		rb.Reconcile(context.Background())
+		if len(h.calls) != 2 || h.calls[0] != moved || h.calls[1] != moved {
+			t.Errorf("Expected the sweep to be retried until it succeeds, got %+v", h.calls)
+		}
+	})
+
+	t.Run("Swept Once", func(t *testing.T) {
+		h.calls = nil
+		rb.Reconcile(context.Background())
+		if len(h.calls) != 0 {
+			t.Errorf("Expected no further hand-offs, got %+v", h.calls)
+		}
+	})
+}
+
+// flakyPlacement is a lastShardPlacement that fails to rebalance while failing is set.
+type flakyPlacement struct {
+	lastShardPlacement
+	failing bool
+}
+
+func (p *flakyPlacement) Rebalance(ctx context.Context, manager etcd.Manager, counterID string, current []string, shards []*shardmetadata.Shard, count int) ([]*shardmetadata.Shard, error) {
+	if p.failing {
+		return nil, errors.New("placement unavailable")
+	}
+	return p.lastShardPlacement.Rebalance(ctx, manager, counterID, current, shards, count)
+}
+
+func TestRebalanceDeadShardAfterFailedSave(t *testing.T) {
+	mockEtcd := etcdtest.NewManager()
+	for _, shardID := range []string{"shard1", "shard2", "shard3", "shard4"} {
+		registerShard(t, mockEtcd, shardID, shardmetadata.HealthOK)
+	}
+	if _, err := countermetadata.CreateCounter(context.Background(), mockEtcd, "counter", countermetadata.CreateOptions{ShardCount: 2, Placement: lastShardPlacement{}}); err != nil {
+		t.Fatalf("CreateCounter failed: %v", err)
+	}
+	mockEtcd.Expire(shardmetadata.ShardKeyPrefix + "shard4")
+
+	grace := 50 * time.Millisecond
+	placement := &flakyPlacement{}
+	rb := rebalancer.NewWithHandoff(mockEtcd, placement, grace, (&recordingHandoff{}).handoff)
+	rb.Reconcile(context.Background()) // Starts the grace period of shard4.
+
+	// The grace period ends while the record cannot be saved.
+	time.Sleep(grace)
+	placement.failing = true
+	if err := rb.Reconcile(context.Background()); err == nil {
+		t.Fatal("Expected Reconcile to report the failed record")
+	}
+
+	// The next pass must not start a new grace period.
+	placement.failing = false
+	if err := rb.Reconcile(context.Background()); err != nil {
+		t.Fatalf("Reconcile failed: %v", err)
+	}
+	if got := counterShards(t, mockEtcd, "counter"); strings.Join(got, ",") != "shard2,shard3" {
+		t.Errorf("Expected dead shard to be removed, got %v", got)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"net/http"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/responsehandler"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"time"
+)
+
+// ShardSnapshotStatsHandler reports the age and size of the shard's latest snapshot.
+func ShardSnapshotStatsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	responsehandler.SendSuccessResponse(w, "Snapshot stats fetched successfully", deps.CounterManager.SnapshotStats())
+}
+
+// ShardSnapshotHandler takes a snapshot of the shard's counters on demand.
+func ShardSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	if err := deps.CounterManager.Snapshot(); err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to take snapshot", err.Error())
+		return
+	}
+	responsehandler.SendSuccessResponse(w, "Snapshot taken successfully", deps.CounterManager.SnapshotStats())
+}
+
+// MetadataCacheStatsHandler reports the hit ratio and watch state of the app
+// server's metadata cache.
+func MetadataCacheStatsHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	if deps.MetadataCache == nil {
+		responsehandler.SendErrorResponse(w, http.StatusNotFound, "Metadata cache is not enabled", "the metadata cache only runs on app servers")
+		return
+	}
+	responsehandler.SendSuccessResponse(w, "Metadata cache stats fetched successfully", deps.MetadataCache.Stats())
+}
+
+// ShardStatus is the metrics a shard published, as seen by the app server.
+type ShardStatus struct {
+	*shardmetadata.Shard
+	MetricsAgeSeconds *float64 `json:"metrics_age_seconds"` // Unset when the shard published no valid timestamp.
+	Stale             bool     `json:"stale"`               // Whether the metrics are too old to route writes by.
+}
+
+// ShardsStatusHandler reports the health and metrics of every registered
+// shard, along with how old the metrics are.
+func ShardsStatusHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	shards, err := shardmetadata.GetAliveShards(r.Context(), deps.EtcdManager)
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to list shards", err.Error())
+		return
+	}
+	now := time.Now()
+	statuses := []ShardStatus{}
+	for _, shard := range shards {
+		metrics, err := shardmetadata.GetShardMetrics(r.Context(), deps.EtcdManager, shard.ShardID)
+		if etcd.IsKeyNotFound(err) {
+			continue // Deregistered since it was listed.
+		}
+		if err != nil {
+			responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to fetch shard metrics", err.Error())
+			return
+		}
+		status := ShardStatus{Shard: metrics, Stale: metrics.IsStale(now, deps.Config.ShardMetricsMaxAge)}
+		if age, ok := metrics.MetricsAge(now); ok {
+			seconds := age.Seconds()
+			status.MetricsAgeSeconds = &seconds
+		}
+		statuses = append(statuses, status)
+	}
+	responsehandler.SendSuccessResponse(w, "Shards fetched successfully", statuses)
+}
+
+// ShardDrainStatus reports whether the shard is draining and how many
+// counters it still holds values for.
+type ShardDrainStatus struct {
+	Draining          bool `json:"draining"`
+	RemainingCounters int  `json:"remaining_counters"`
+}
+
+// ShardDrainStatusHandler reports the drain progress of the shard.
+func ShardDrainStatusHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	status := ShardDrainStatus{Draining: shardmetadata.IsDraining(), RemainingCounters: deps.CounterManager.CountNonZero()}
+	responsehandler.SendSuccessResponse(w, "Drain status fetched successfully", status)
+}
+
+// ShardDrainHandler starts draining the shard: it is reported as draining in
+// its metrics, so it takes no new writes and the rebalancer hands its values
+// over to other shards.
+func ShardDrainHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	shardmetadata.SetDraining(true)
+	status := ShardDrainStatus{Draining: true, RemainingCounters: deps.CounterManager.CountNonZero()}
+	responsehandler.SendSuccessResponse(w, "Shard draining", status)
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/loadbalancer"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/responsehandler"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	counter "sharded-counters/internal/shard_store"
+	"sharded-counters/internal/utils"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// maxTrackedCounters bounds the number of counters whose last-known shard
+// contributions are remembered by the app server.
+const maxTrackedCounters = 100000
+
+// MissingShard describes an assigned shard that did not contribute to a read.
+type MissingShard struct {
+	ShardID        string     `json:"shard_id"`
+	Error          string     `json:"error"`
+	LastKnownValue *int64     `json:"last_known_value,omitempty"`
+	LastKnownAt    *time.Time `json:"last_known_at,omitempty"`
+}
+
+// counterAggregate is the result of summing a counter across its shards.
+type counterAggregate struct {
+	Total       int64
+	Contributed []string
+	Missing     []MissingShard
+}
+
+// contribution is a shard's partial value of a counter at a point in time.
+type contribution struct {
+	Value      int64
+	ObservedAt time.Time
+}
+
+// contributionCache remembers the latest partial value each shard reported
+// for each counter, so reads can report what a missing shard last held.
+type contributionCache struct {
+	mu       sync.Mutex
+	counters map[string]map[string]contribution
+	capacity int
+}
+
+var lastKnownContributions = newContributionCache(maxTrackedCounters)
+
+func newContributionCache(capacity int) *contributionCache {
+	return &contributionCache{counters: make(map[string]map[string]contribution), capacity: capacity}
+}
+
+// record stores a shard's partial value of a counter.
+func (c *contributionCache) record(counterID, shardID string, value int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	shards, ok := c.counters[counterID]
+	if !ok {
+		if len(c.counters) >= c.capacity {
+			// Evict an arbitrary counter to stay within capacity.
+			for evicted := range c.counters {
+				delete(c.counters, evicted)
+				break
+			}
+		}
+		shards = make(map[string]contribution)
+		c.counters[counterID] = shards
+	}
+	shards[shardID] = contribution{Value: value, ObservedAt: time.Now()}
+}
+
+// forget drops everything remembered about a counter.
+func (c *contributionCache) forget(counterID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.counters, counterID)
+}
+
+// lookup returns the last partial value a shard reported for a counter.
+func (c *contributionCache) lookup(counterID, shardID string) (contribution, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last, ok := c.counters[counterID][shardID]
+	return last, ok
+}
+
+// errShardUnavailable fails reads that need every shard of a counter when one
+// of them cannot contribute.
+var errShardUnavailable = errors.New("shard unavailable")
+
+// aggregateCounterSum queries the counter's readable (healthy or draining)
+// shards concurrently and sums their partial values. The fan-out is bounded
+// by timeout; shards that have not answered by then are cancelled. A failed
+// or unreadable shard fails the read with errShardUnavailable unless
+// allowPartial is set, in which case it is reported as missing along with its
+// last-known contribution. Unreadable shards are never queried. A shard that
+// has seen a newer epoch than the record's fails the read with
+// counter.ErrStaleEpoch even then, as the record itself is out of date.
+func aggregateCounterSum(ctx context.Context, record *countermetadata.CounterRecord, etcdManager etcd.Manager, timeout time.Duration, allowPartial bool) (*counterAggregate, error) {
+	counterID := record.CounterID
+	counterShards := countermetadata.GetShardObjList(record.Shards)
+	lb := loadbalancer.NewLoadBalancer(counterShards, nil, etcdManager)
+	lb.FilterReadableShards(ctx)
+
+	aggregate := &counterAggregate{Contributed: []string{}}
+	queried := make(map[string]bool)
+	for _, shard := range lb.GetShards() {
+		queried[shard.ShardID] = true
+	}
+	for _, shard := range counterShards {
+		if !queried[shard.ShardID] {
+			if !allowPartial {
+				return nil, fmt.Errorf("shard %s is not healthy: %w", shard.ShardID, errShardUnavailable)
+			}
+			aggregate.Missing = append(aggregate.Missing, missingShard(counterID, shard.ShardID, "shard is not healthy"))
+		}
+	}
+
+	calls := fanOutToShards(ctx, timeout, lb.GetShards(), func(ctx context.Context, shard *shardmetadata.Shard) (int64, error) {
+		return queryShardCounter(ctx, lb, shard, counterID, record.Epoch)
+	})
+
+	for _, call := range calls {
+		if call.Err != nil {
+			if errors.Is(call.Err, counter.ErrStaleEpoch) {
+				return nil, call.Err
+			}
+			if !allowPartial {
+				return nil, fmt.Errorf("%v: %w", call.Err, errShardUnavailable)
+			}
+			aggregate.Missing = append(aggregate.Missing, missingShard(counterID, call.Shard.ShardID, call.Err.Error()))
+			continue
+		}
+		lastKnownContributions.record(counterID, call.Shard.ShardID, call.Value)
+
+		// Add the shard's counter value to the total.
+		sum, ok := utils.CheckedAdd(aggregate.Total, call.Value)
+		if !ok {
+			return nil, fmt.Errorf("counter %s total overflows int64", counterID)
+		}
+		aggregate.Total = sum
+		aggregate.Contributed = append(aggregate.Contributed, call.Shard.ShardID)
+	}
+
+	return aggregate, nil
+}
+
+// rereadCounterRecord reads a counter's record from etcd itself, for reads
+// that found the cached record older than what a shard has seen.
+func rereadCounterRecord(ctx context.Context, deps *middleware.Dependencies, counterID string) (*countermetadata.CounterRecord, error) {
+	manager := deps.EtcdManager
+	if deps.MetadataCache != nil {
+		manager = deps.MetadataCache.Manager
+	}
+	return countermetadata.GetCounterRecord(ctx, manager, counterID)
+}
+
+// missingShard describes a shard that did not contribute, with its last-known value if any.
+func missingShard(counterID, shardID, reason string) MissingShard {
+	missing := MissingShard{ShardID: shardID, Error: reason}
+	if last, ok := lastKnownContributions.lookup(counterID, shardID); ok {
+		missing.LastKnownValue = &last.Value
+		missing.LastKnownAt = &last.ObservedAt
+	}
+	return missing
+}
+
+// queryShardCounter fetches the shard's partial value of a counter in the given epoch.
+func queryShardCounter(ctx context.Context, lb *loadbalancer.LoadBalancer, shardData *shardmetadata.Shard, counterID string, epoch int64) (int64, error) {
+	// Send api request to the shard
+	qyeryParams := map[string]string{"counter_id": counterID, "epoch": strconv.FormatInt(epoch, 10)}
+	respBody, statusCode, err := lb.ForwardRequestToShard(ctx, "GET", shardData, "counter/shard", nil, qyeryParams)
+	// read the response body {"success":true,"message":"","data":{"counter_id":"12345abcdef6ii978","value":1}}
+	if isStaleEpochResponse(respBody, statusCode) {
+		return 0, fmt.Errorf("shard %s: %w", shardData.ShardID, counter.ErrStaleEpoch)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to query shard %s: %v (status Code: %d)", shardData.ShardID, err, statusCode)
+	}
+	// Decode straight into the typed payload so large values keep full int64 precision.
+	shardValue := &ShardCounterResponse{}
+	response := &responsehandler.Response{Data: shardValue}
+	if err := json.Unmarshal([]byte(respBody), response); err != nil {
+		return 0, fmt.Errorf("failed to parse response from shard %s: %v", shardData.ShardID, err)
+	}
+	// Check for API-level success.
+	if !response.Success {
+		return 0, fmt.Errorf("shard %s returned unsuccessful response for counter id %s", shardData.ShardID, counterID)
+	}
+	return shardValue.Value, nil
+}
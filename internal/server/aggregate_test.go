@@ -0,0 +1,136 @@
+package server_test
+
+import (
+	"net/http"
+	"sharded-counters/internal/server"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadDeadline(t *testing.T) {
+	c := newTestCluster(t, "shard1", "shard2")
+	c.deps.Config.ShardQueryTimeout = 100 * time.Millisecond
+	c.seedCounter(t, "slow-counter", map[string]int64{"shard1": 3, "shard2": 0})
+	c.shards["shard2"].hang(t)
+
+	// Test Case 1: A shard that does not answer in time fails the read
+	t.Run("Full Read", func(t *testing.T) {
+		start := time.Now()
+		code, _ := serve(t, c.deps, server.GetCounterHandler, http.MethodGet, "/counter?counter_id=slow-counter", nil, nil)
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("Expected the read to fail with 503, got %d", code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected the read to give up after the deadline, took %v", elapsed)
+		}
+	})
+
+	// Test Case 2: The shards that answered in time still contribute
+	t.Run("Partial Read", func(t *testing.T) {
+		resp := &server.CounterValueResponse{}
+		start := time.Now()
+		code, _ := serve(t, c.deps, server.GetCounterHandler, http.MethodGet, "/counter?counter_id=slow-counter&partial=true", nil, resp)
+		if code != http.StatusOK {
+			t.Fatalf("Expected the partial read to succeed, got %d", code)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected the read to give up after the deadline, took %v", elapsed)
+		}
+		if resp.Value != 3 || len(resp.MissingShards) != 1 || resp.MissingShards[0].ShardID != "shard2" {
+			t.Fatalf("Expected 3 without shard2, got %d missing %+v", resp.Value, resp.MissingShards)
+		}
+		if !strings.Contains(resp.MissingShards[0].Error, "context deadline exceeded") {
+			t.Errorf("Expected shard2 to miss the deadline, got %q", resp.MissingShards[0].Error)
+		}
+	})
+}
+
+func TestPartialRead(t *testing.T) {
+	c := newTestCluster(t, "shard1", "shard2")
+	c.seedCounter(t, "partial-counter", map[string]int64{"shard1": 3, "shard2": 4})
+	defer server.SetMaxTrackedCounters(10)()
+
+	read := func(t *testing.T, target string) (int, *server.CounterValueResponse) {
+		t.Helper()
+		resp := &server.CounterValueResponse{}
+		code, _ := serve(t, c.deps, server.GetCounterHandler, http.MethodGet, target, nil, resp)
+		return code, resp
+	}
+
+	// Test Case 1: A read every shard answers is complete
+	t.Run("Complete", func(t *testing.T) {
+		code, resp := read(t, "/counter?counter_id=partial-counter&partial=true")
+		if code != http.StatusOK || !resp.Complete || resp.Value != 7 || len(resp.Contributors) != 2 {
+			t.Errorf("Expected a complete read of 7, got %d: %+v", code, resp)
+		}
+	})
+
+	failing := c.shards["shard2"]
+	failing.fail()
+	defer failing.setIntercept(nil)
+
+	// Test Case 2: A failed shard fails the read unless partial results are allowed
+	t.Run("Not Allowed", func(t *testing.T) {
+		if code, _ := read(t, "/counter?counter_id=partial-counter"); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected the read to fail with 503, got %d", code)
+		}
+	})
+
+	// Test Case 3: A partial read reports the missing shard and what it last held
+	t.Run("Incomplete", func(t *testing.T) {
+		code, resp := read(t, "/counter?counter_id=partial-counter&partial=true")
+		if code != http.StatusOK || resp.Complete || resp.Value != 3 {
+			t.Fatalf("Expected an incomplete read of 3, got %d: %+v", code, resp)
+		}
+		if len(resp.Contributors) != 1 || resp.Contributors[0] != "shard1" {
+			t.Errorf("Expected only shard1 to contribute, got %v", resp.Contributors)
+		}
+		if len(resp.MissingShards) != 1 || resp.MissingShards[0].ShardID != "shard2" {
+			t.Fatalf("Expected shard2 to be missing, got %+v", resp.MissingShards)
+		}
+		if last := resp.MissingShards[0].LastKnownValue; last == nil || *last != 4 {
+			t.Errorf("Expected shard2 to have last held 4, got %v", last)
+		}
+	})
+
+	// Test Case 4: Counters beyond the capacity of the cache lose their last-known values
+	t.Run("Eviction", func(t *testing.T) {
+		defer server.SetMaxTrackedCounters(1)()
+		failing.setIntercept(nil)
+		for _, counterID := range []string{"partial-counter", "other-counter"} {
+			c.createCounter(t, counterID, "shard1", "shard2")
+			if code, _ := read(t, "/counter?counter_id="+counterID); code != http.StatusOK {
+				t.Fatalf("Expected the read of %s to succeed, got %d", counterID, code)
+			}
+		}
+		failing.fail()
+
+		_, resp := read(t, "/counter?counter_id=other-counter&partial=true")
+		if len(resp.MissingShards) != 1 || resp.MissingShards[0].LastKnownValue == nil {
+			t.Errorf("Expected the tracked counter to keep its last-known value, got %+v", resp.MissingShards)
+		}
+		_, resp = read(t, "/counter?counter_id=partial-counter&partial=true")
+		if len(resp.MissingShards) != 1 || resp.MissingShards[0].LastKnownValue != nil {
+			t.Errorf("Expected the evicted counter to have no last-known value, got %+v", resp.MissingShards)
+		}
+	})
+
+	// Test Case 5: A shard that is not healthy fails the read unless partial results are allowed
+	t.Run("Unhealthy Shard", func(t *testing.T) {
+		failing.setIntercept(nil)
+		c.setHealth(t, "shard2", shardmetadata.HealthDown)
+		queries := c.shards["shard2"].requestCount("/counter/shard")
+		if code, _ := read(t, "/counter?counter_id=partial-counter"); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected the read to fail with 503, got %d", code)
+		}
+		code, resp := read(t, "/counter?counter_id=partial-counter&partial=true")
+		if code != http.StatusOK || resp.Complete || len(resp.MissingShards) != 1 || resp.MissingShards[0].Error != "shard is not healthy" {
+			t.Errorf("Expected shard2 to be missing as unhealthy, got %d: %+v", code, resp)
+		}
+		if n := c.shards["shard2"].requestCount("/counter/shard") - queries; n != 0 {
+			t.Errorf("Expected the unhealthy shard not to be queried, got %d queries", n)
+		}
+	})
+}
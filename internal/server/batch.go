@@ -0,0 +1,294 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/loadbalancer"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/responsehandler"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	counter "sharded-counters/internal/shard_store"
+	"sync"
+)
+
+// maxBatchOperations bounds the number of operations accepted in one batch.
+const maxBatchOperations = 10000
+
+const shardBatchUrl = "counter/shard/batch"
+
+// BatchRequest represents the payload of the batch mutation APIs.
+type BatchRequest struct {
+	Operations []IncrementCounterReq `json:"operations"`
+}
+
+// BatchOperationResult reports the outcome of a single batched operation.
+type BatchOperationResult struct {
+	CounterID string `json:"counter_id"`
+	Delta     int64  `json:"delta"`
+	Success   bool   `json:"success"`
+	Shard     string `json:"shard,omitempty"`
+	Value     *int64 `json:"value,omitempty"` // New value of the shard's partial count.
+	Error     string `json:"error,omitempty"`
+}
+
+// BatchResponse represents the response payload of the batch mutation APIs.
+type BatchResponse struct {
+	Results []BatchOperationResult `json:"results"`
+	Failed  int                    `json:"failed"`
+}
+
+// shardBatch collects the operations routed to one shard along with their
+// positions in the original request.
+type shardBatch struct {
+	shard   *shardmetadata.Shard
+	indexes []int
+	request BatchRequest
+}
+
+// BatchCounterHandler applies many counter mutations in one request, sending
+// one batched request to every selected shard.
+func BatchCounterHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+
+	etcdManager := deps.EtcdManager
+
+	// Parse the request body.
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+
+	// Validate input.
+	if len(req.Operations) == 0 {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Operations are required", "Missing field: operations")
+		return
+	}
+	if len(req.Operations) > maxBatchOperations {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Too many operations", fmt.Sprintf("a batch may hold at most %d operations", maxBatchOperations))
+		return
+	}
+
+	results := make([]BatchOperationResult, len(req.Operations))
+	records := make(map[string]*countermetadata.CounterRecord)
+	var pending []int
+	var allShards []*shardmetadata.Shard
+	seenShards := make(map[string]bool)
+	for i, op := range req.Operations {
+		results[i] = BatchOperationResult{CounterID: op.CounterID, Delta: op.GetDelta()}
+		if msg := validateBatchOperation(op); msg != "" {
+			results[i].Error = msg
+			continue
+		}
+		if _, ok := records[op.CounterID]; ok {
+			pending = append(pending, i)
+			continue
+		}
+		record, err := loadMutationRecord(r.Context(), deps, op.CounterID)
+		switch {
+		case etcd.IsKeyNotFound(err):
+			results[i].Error = "counter does not exist"
+			continue
+		case errors.Is(err, countermetadata.ErrCounterDeleted):
+			results[i].Error = "counter has been deleted"
+			continue
+		case err != nil:
+			results[i].Error = fmt.Sprintf("failed to retrieve counter metadata: %v", err)
+			continue
+		}
+		records[op.CounterID] = record
+		pending = append(pending, i)
+		for _, shard := range countermetadata.GetShardObjList(record.Shards) {
+			if !seenShards[shard.ShardID] {
+				seenShards[shard.ShardID] = true
+				allShards = append(allShards, shard)
+			}
+		}
+	}
+
+	// Fetch shard health once for every shard involved in the batch.
+	lb := loadbalancer.NewLoadBalancer(allShards, deps.Selection, etcdManager)
+	lb.FilterHealthyShards(r.Context())
+	healthy := make(map[string]*shardmetadata.Shard)
+	for _, shard := range lb.GetShards() {
+		healthy[shard.ShardID] = shard
+	}
+	sendBatches(r.Context(), deps, lb, healthy, req.Operations, pending, records, results)
+
+	// Operations on counters reset since their records were read are retried
+	// once in the counter's current epoch.
+	var stale []int
+	reread := make(map[string]bool)
+	for _, i := range pending {
+		if results[i].Success || results[i].Error != counter.ErrStaleEpoch.Error() {
+			continue
+		}
+		counterID := req.Operations[i].CounterID
+		if !reread[counterID] {
+			reread[counterID] = true
+			record, err := rereadCounterRecord(r.Context(), deps, counterID)
+			if err != nil {
+				delete(records, counterID)
+			} else {
+				records[counterID] = record
+			}
+		}
+		if _, ok := records[counterID]; ok {
+			stale = append(stale, i)
+		}
+	}
+	sendBatches(r.Context(), deps, lb, healthy, req.Operations, stale, records, results)
+
+	resp := BatchResponse{Results: results}
+	for _, result := range results {
+		if !result.Success {
+			resp.Failed++
+		}
+	}
+	message := "Batch applied successfully"
+	if resp.Failed > 0 {
+		message = "Batch applied with partial failures"
+	}
+	responsehandler.SendSuccessResponse(w, message, resp)
+}
+
+// sendBatches selects one of the healthy shards of each operation's counter,
+// sends one batched request per shard concurrently and records the outcome of
+// every operation listed in indexes.
+func sendBatches(ctx context.Context, deps *middleware.Dependencies, lb *loadbalancer.LoadBalancer, healthy map[string]*shardmetadata.Shard, ops []IncrementCounterReq, indexes []int, records map[string]*countermetadata.CounterRecord, results []BatchOperationResult) {
+	// Select one shard per counter and group operations by shard.
+	selected := make(map[string]*shardmetadata.Shard)
+	batches := make(map[string]*shardBatch)
+	for _, i := range indexes {
+		op := ops[i]
+		results[i].Shard, results[i].Error = "", ""
+		record := records[op.CounterID]
+		shard, ok := selected[op.CounterID]
+		if !ok {
+			var candidates []*shardmetadata.Shard
+			for _, shardID := range record.Shards {
+				if h, ok := healthy[shardID]; ok {
+					candidates = append(candidates, h)
+				}
+			}
+			var err error
+			shard, err = deps.Selection.SelectShard(candidates)
+			if err != nil {
+				results[i].Error = fmt.Sprintf("failed to select a shard: %v", err)
+				continue
+			}
+			selected[op.CounterID] = shard
+		}
+		batch, ok := batches[shard.ShardID]
+		if !ok {
+			batch = &shardBatch{shard: shard}
+			batches[shard.ShardID] = batch
+		}
+		delta, epoch := op.GetDelta(), record.Epoch
+		batch.indexes = append(batch.indexes, i)
+		batch.request.Operations = append(batch.request.Operations, IncrementCounterReq{CounterID: op.CounterID, Delta: &delta, Epoch: &epoch})
+	}
+
+	// Send one request per shard concurrently.
+	var wg sync.WaitGroup
+	for _, batch := range batches {
+		wg.Add(1)
+		go func(batch *shardBatch) {
+			defer wg.Done()
+			shardResults, err := sendShardBatch(ctx, lb, batch)
+			for j, idx := range batch.indexes {
+				results[idx].Shard = batch.shard.ShardID
+				if err != nil {
+					results[idx].Error = err.Error()
+					continue
+				}
+				results[idx].Success = shardResults[j].Success
+				results[idx].Value = shardResults[j].Value
+				results[idx].Error = shardResults[j].Error
+			}
+		}(batch)
+	}
+	wg.Wait()
+}
+
+// validateBatchOperation returns a description of what is wrong with op, or "" if it is valid.
+func validateBatchOperation(op IncrementCounterReq) string {
+	if op.CounterID == "" {
+		return "Missing field: counter_id"
+	}
+	if op.Delta != nil && *op.Delta == 0 {
+		return "invalid value in delta"
+	}
+	return ""
+}
+
+// sendShardBatch forwards a batch to its shard and returns one result per operation.
+func sendShardBatch(ctx context.Context, lb *loadbalancer.LoadBalancer, batch *shardBatch) ([]BatchOperationResult, error) {
+	payload, err := json.Marshal(batch.request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal shard batch: %v", err)
+	}
+	respBody, statusCode, err := lb.ForwardRequestToShard(ctx, http.MethodPost, batch.shard, shardBatchUrl, payload, nil)
+	if err != nil {
+		// The shard may have applied some operations before failing.
+		return nil, fmt.Errorf("batch request to shard %s failed, operations may be partially applied: %v (status Code: %d)", batch.shard.ShardID, err, statusCode)
+	}
+	shardResp := &BatchResponse{}
+	response := &responsehandler.Response{Data: shardResp}
+	if err := json.Unmarshal([]byte(respBody), response); err != nil {
+		return nil, fmt.Errorf("failed to parse batch response from shard %s: %v", batch.shard.ShardID, err)
+	}
+	if len(shardResp.Results) != len(batch.indexes) {
+		return nil, fmt.Errorf("shard %s returned %d results for %d operations", batch.shard.ShardID, len(shardResp.Results), len(batch.indexes))
+	}
+	return shardResp.Results, nil
+}
+
+// BatchShardCounterHandler applies a batch of mutations to the shard's in-memory counters.
+func BatchShardCounterHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	// Parse the request body.
+	var req BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+	// Refuse the whole batch rather than failing every operation alike.
+	if err := checkShardWritable(); err != nil {
+		sendShardMutationError(w, "Failed to apply batch", err)
+		return
+	}
+
+	resp := BatchResponse{Results: make([]BatchOperationResult, len(req.Operations))}
+	for i, op := range req.Operations {
+		result := BatchOperationResult{CounterID: op.CounterID, Delta: op.GetDelta()}
+		if msg := validateBatchOperation(op); msg != "" {
+			result.Error = msg
+		} else if newValue, err := applyShardDelta(deps.CounterManager, &op, op.GetDelta()); err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Success = true
+			result.Value = &newValue
+		}
+		if !result.Success {
+			resp.Failed++
+		}
+		resp.Results[i] = result
+	}
+	responsehandler.SendSuccessResponse(w, "Batch applied", resp)
+}
@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"net/http"
+	"sharded-counters/internal/server"
+	"testing"
+)
+
+func TestBatchGroupsOperationsByShard(t *testing.T) {
+	c := newTestCluster(t, "shard1", "shard2")
+	c.createCounter(t, "a", "shard1")
+	c.createCounter(t, "b", "shard1")
+	c.createCounter(t, "c", "shard2")
+
+	delta := func(d int64) *int64 { return &d }
+	req := server.BatchRequest{Operations: []server.IncrementCounterReq{
+		{CounterID: "a", Delta: delta(1)},
+		{CounterID: "b", Delta: delta(2)},
+		{CounterID: "c", Delta: delta(-3)},
+		{CounterID: "a", Delta: delta(4)},
+		{CounterID: "unknown"},
+		{CounterID: "b", Delta: delta(0)},
+	}}
+	resp := &server.BatchResponse{}
+	if code, _ := serve(t, c.deps, server.BatchCounterHandler, http.MethodPost, "/counter/batch", req, resp); code != http.StatusOK {
+		t.Fatalf("Expected the batch to be applied, got %d", code)
+	}
+
+	// Test Case 1: Every shard gets one request for all of its operations
+	t.Run("One Request Per Shard", func(t *testing.T) {
+		for _, shardID := range []string{"shard1", "shard2"} {
+			if n := c.shards[shardID].requestCount("/counter/shard/batch"); n != 1 {
+				t.Errorf("Expected shard %s to get 1 batch request, got %d", shardID, n)
+			}
+		}
+		if value := c.shards["shard1"].counters.Get("a"); value != 5 {
+			t.Errorf("Expected a to be 5, got %d", value)
+		}
+		if value := c.shards["shard2"].counters.Get("c"); value != -3 {
+			t.Errorf("Expected c to be -3, got %d", value)
+		}
+	})
+
+	// Test Case 2: Results follow the order of the operations
+	t.Run("Results", func(t *testing.T) {
+		if len(resp.Results) != len(req.Operations) {
+			t.Fatalf("Expected %d results, got %d", len(req.Operations), len(resp.Results))
+		}
+		for i, shardID := range []string{"shard1", "shard1", "shard2", "shard1"} {
+			result := resp.Results[i]
+			if !result.Success || result.Shard != shardID || result.CounterID != req.Operations[i].CounterID {
+				t.Errorf("Expected operation %d to succeed on %s, got %+v", i, shardID, result)
+			}
+		}
+		if value := resp.Results[3].Value; value == nil || *value != 5 {
+			t.Errorf("Expected the second increment of a to return 5, got %v", value)
+		}
+		if result := resp.Results[4]; result.Success || result.Error != "counter does not exist" {
+			t.Errorf("Expected the unknown counter to fail, got %+v", result)
+		}
+		if result := resp.Results[5]; result.Success || result.Error == "" {
+			t.Errorf("Expected the zero delta to fail, got %+v", result)
+		}
+		if resp.Failed != 2 {
+			t.Errorf("Expected 2 failed operations, got %d", resp.Failed)
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/loadbalancer"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/responsehandler"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	counter "sharded-counters/internal/shard_store"
+	"sharded-counters/internal/utils"
+	"time"
+)
+
+// maxBulkCounters bounds the number of counters read in one bulk request.
+const maxBulkCounters = 1000
+
+const shardValuesUrl = "counter/shard/values"
+
+// CounterValuesRequest represents the payload of the bulk read APIs.
+type CounterValuesRequest struct {
+	CounterIDs []string         `json:"counter_ids"`
+	Epochs     map[string]int64 `json:"epochs,omitempty"` // Reset epochs, set by the app server for shard queries.
+}
+
+// CounterValueResult reports the total of one counter in a bulk read.
+type CounterValueResult struct {
+	CounterID string `json:"counter_id"`
+	Value     int64  `json:"value"`
+	Error     string `json:"error,omitempty"`
+}
+
+// CounterValuesResponse represents the response payload of the app bulk read API.
+type CounterValuesResponse struct {
+	Counters []CounterValueResult `json:"counters"`
+	Failed   int                  `json:"failed"`
+}
+
+// ShardCounterValuesResponse represents the response payload of the shard bulk read API.
+type ShardCounterValuesResponse struct {
+	Values map[string]int64  `json:"values"`
+	Errors map[string]string `json:"errors,omitempty"` // Counters that could not be read in the requested epoch.
+}
+
+// GetCounterValuesHandler returns the totals of many counters, sending one
+// multi-counter query to every shard involved.
+func GetCounterValuesHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+
+	etcdManager := deps.EtcdManager
+
+	// Parse the request body.
+	var req CounterValuesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+
+	// Validate input.
+	if len(req.CounterIDs) == 0 {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter IDs are required", "Missing field: counter_ids")
+		return
+	}
+	if len(req.CounterIDs) > maxBulkCounters {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Too many counter IDs", fmt.Sprintf("a bulk read may hold at most %d counter IDs", maxBulkCounters))
+		return
+	}
+
+	// Resolve the record of every counter.
+	results := make([]CounterValueResult, len(req.CounterIDs))
+	records := make(map[string]*countermetadata.CounterRecord)
+	for i, counterID := range req.CounterIDs {
+		results[i].CounterID = counterID
+		if counterID == "" {
+			results[i].Error = "Missing counter_id"
+			continue
+		}
+		if _, ok := records[counterID]; ok {
+			continue
+		}
+		record, err := countermetadata.GetCounterRecord(r.Context(), etcdManager, counterID)
+		if etcd.IsKeyNotFound(err) {
+			results[i].Error = "Counter ID does not exist"
+			continue
+		}
+		if err != nil {
+			results[i].Error = fmt.Sprintf("failed to retrieve counter metadata: %v", err)
+			continue
+		}
+		records[counterID] = record
+	}
+
+	totals := sumCounterValues(r.Context(), deps, records)
+
+	resp := CounterValuesResponse{Counters: results}
+	for i := range results {
+		if results[i].Error == "" {
+			results[i] = totals[results[i].CounterID]
+		}
+		if results[i].Error != "" {
+			resp.Failed++
+		}
+	}
+
+	message := "Counters aggregated successfully"
+	if resp.Failed > 0 {
+		message = "Counters aggregated with partial failures"
+	}
+	responsehandler.SendSuccessResponse(w, message, resp)
+}
+
+// sumCounterValues computes the totals of many counters, sending one
+// multi-counter query to every readable shard involved. Like single reads,
+// shards filtered out as unreadable do not contribute; a counter that depends
+// on a shard whose query failed gets an error instead of a value. Counters
+// that a shard has seen in a newer epoch than their record's are summed once
+// more with the record etcd has now.
+func sumCounterValues(ctx context.Context, deps *middleware.Dependencies, records map[string]*countermetadata.CounterRecord) map[string]CounterValueResult {
+	totals, stale := sumCounterValuesOnce(ctx, deps.EtcdManager, deps.Config.ShardQueryTimeout, records)
+	if len(stale) == 0 {
+		return totals
+	}
+	reread := make(map[string]*countermetadata.CounterRecord, len(stale))
+	for _, counterID := range stale {
+		record, err := rereadCounterRecord(ctx, deps, counterID)
+		if err != nil {
+			totals[counterID] = CounterValueResult{CounterID: counterID, Error: fmt.Sprintf("failed to retrieve counter metadata: %v", err)}
+			continue
+		}
+		reread[counterID] = record
+	}
+	retried, _ := sumCounterValuesOnce(ctx, deps.EtcdManager, deps.Config.ShardQueryTimeout, reread)
+	for counterID, total := range retried {
+		totals[counterID] = total
+	}
+	return totals
+}
+
+// sumCounterValuesOnce is a single pass of sumCounterValues. It also returns
+// the counters that failed because a shard has seen a newer epoch.
+func sumCounterValuesOnce(ctx context.Context, etcdManager etcd.Manager, timeout time.Duration, records map[string]*countermetadata.CounterRecord) (map[string]CounterValueResult, []string) {
+	// Group counters by shard.
+	counterShards := make(map[string][]*shardmetadata.Shard, len(records))
+	epochs := make(map[string]int64, len(records))
+	shardCounters := make(map[string][]string)
+	var allShards []*shardmetadata.Shard
+	for counterID, record := range records {
+		counterShards[counterID] = countermetadata.GetShardObjList(record.Shards)
+		epochs[counterID] = record.Epoch
+		for _, shard := range counterShards[counterID] {
+			if _, ok := shardCounters[shard.ShardID]; !ok {
+				allShards = append(allShards, shard)
+			}
+			shardCounters[shard.ShardID] = append(shardCounters[shard.ShardID], counterID)
+		}
+	}
+
+	lb := loadbalancer.NewLoadBalancer(allShards, nil, etcdManager)
+	lb.FilterReadableShards(ctx)
+
+	// Query every readable shard once for all of its counters.
+	shardValues := make(map[string]*ShardCounterValuesResponse)
+	shardErrors := make(map[string]error)
+	calls := fanOutToShards(ctx, timeout, lb.GetShards(), func(ctx context.Context, shard *shardmetadata.Shard) (*ShardCounterValuesResponse, error) {
+		return queryShardValues(ctx, lb, shard, shardCounters[shard.ShardID], epochs)
+	})
+	for _, call := range calls {
+		if call.Err != nil {
+			shardErrors[call.Shard.ShardID] = call.Err
+			continue
+		}
+		shardValues[call.Shard.ShardID] = call.Value
+	}
+
+	// Sum the partial values of every counter.
+	totals := make(map[string]CounterValueResult, len(counterShards))
+	var stale []string
+	for counterID, shards := range counterShards {
+		result := CounterValueResult{CounterID: counterID}
+		var total int64
+		for _, shard := range shards {
+			if err, failed := shardErrors[shard.ShardID]; failed {
+				result.Error = err.Error()
+				break
+			}
+			values, queried := shardValues[shard.ShardID]
+			if !queried {
+				continue // Unreadable shards do not contribute.
+			}
+			if msg, failed := values.Errors[counterID]; failed {
+				if msg == counter.ErrStaleEpoch.Error() {
+					stale = append(stale, counterID)
+				}
+				result.Error = fmt.Sprintf("shard %s: %s", shard.ShardID, msg)
+				break
+			}
+			lastKnownContributions.record(counterID, shard.ShardID, values.Values[counterID])
+			sum, ok := utils.CheckedAdd(total, values.Values[counterID])
+			if !ok {
+				result.Error = fmt.Sprintf("counter %s total overflows int64", counterID)
+				break
+			}
+			total = sum
+		}
+		if result.Error == "" {
+			result.Value = total
+		}
+		totals[counterID] = result
+	}
+	return totals, stale
+}
+
+// queryShardValues fetches the shard's partial values of the given counters
+// in their reset epochs.
+func queryShardValues(ctx context.Context, lb *loadbalancer.LoadBalancer, shard *shardmetadata.Shard, counterIDs []string, epochs map[string]int64) (*ShardCounterValuesResponse, error) {
+	req := CounterValuesRequest{CounterIDs: counterIDs, Epochs: make(map[string]int64, len(counterIDs))}
+	for _, counterID := range counterIDs {
+		req.Epochs[counterID] = epochs[counterID]
+	}
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal shard query: %v", err)
+	}
+	respBody, statusCode, err := lb.ForwardRequestToShard(ctx, http.MethodPost, shard, shardValuesUrl, payload, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shard %s: %v (status Code: %d)", shard.ShardID, err, statusCode)
+	}
+	shardResp := &ShardCounterValuesResponse{}
+	response := &responsehandler.Response{Data: shardResp}
+	if err := json.Unmarshal([]byte(respBody), response); err != nil {
+		return nil, fmt.Errorf("failed to parse response from shard %s: %v", shard.ShardID, err)
+	}
+	if !response.Success {
+		return nil, fmt.Errorf("shard %s returned unsuccessful response", shard.ShardID)
+	}
+	return shardResp, nil
+}
+
+// GetShardCounterValuesHandler returns the shard's partial values of many counters.
+func GetShardCounterValuesHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	// Parse the request body.
+	var req CounterValuesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+
+	resp := ShardCounterValuesResponse{Values: make(map[string]int64, len(req.CounterIDs))}
+	for _, counterID := range req.CounterIDs {
+		epoch, ok := req.Epochs[counterID]
+		if !ok {
+			resp.Values[counterID] = deps.CounterManager.Get(counterID)
+			continue
+		}
+		value, err := deps.CounterManager.GetAtEpoch(counterID, epoch)
+		if err != nil {
+			if resp.Errors == nil {
+				resp.Errors = make(map[string]string)
+			}
+			resp.Errors[counterID] = err.Error()
+			continue
+		}
+		resp.Values[counterID] = value
+	}
+	responsehandler.SendSuccessResponse(w, "Counter values fetched successfully", resp)
+}
@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"net/http"
+	"sharded-counters/internal/server"
+	"strings"
+	"testing"
+)
+
+func TestBulkReadReportsErrorsPerCounter(t *testing.T) {
+	c := newTestCluster(t, "shard1", "shard2")
+	c.seedCounter(t, "spread", map[string]int64{"shard1": 4, "shard2": 6})
+	c.seedCounter(t, "healthy", map[string]int64{"shard1": 7})
+	c.createCounter(t, "broken", "shard2")
+
+	read := func(t *testing.T, counterIDs ...string) *server.CounterValuesResponse {
+		t.Helper()
+		resp := &server.CounterValuesResponse{}
+		req := server.CounterValuesRequest{CounterIDs: counterIDs}
+		if code, _ := serve(t, c.deps, server.GetCounterValuesHandler, http.MethodPost, "/counter/values", req, resp); code != http.StatusOK {
+			t.Fatalf("Expected the bulk read to succeed, got %d", code)
+		}
+		return resp
+	}
+
+	// Test Case 1: Every shard is queried once for all of its counters
+	t.Run("One Query Per Shard", func(t *testing.T) {
+		resp := read(t, "spread", "healthy", "broken", "spread")
+		if resp.Failed != 0 {
+			t.Errorf("Expected no failures, got %+v", resp.Counters)
+		}
+		for i, want := range []int64{10, 7, 0, 10} {
+			if resp.Counters[i].Value != want {
+				t.Errorf("Expected counter %d to be %d, got %+v", i, want, resp.Counters[i])
+			}
+		}
+		for _, shardID := range []string{"shard1", "shard2"} {
+			if n := c.shards[shardID].requestCount("/counter/shard/values"); n != 1 {
+				t.Errorf("Expected shard %s to be queried once, got %d", shardID, n)
+			}
+		}
+	})
+
+	// Test Case 2: A failed shard fails only the counters it holds
+	t.Run("Failed Shard", func(t *testing.T) {
+		c.shards["shard2"].fail()
+		defer c.shards["shard2"].setIntercept(nil)
+
+		resp := read(t, "spread", "healthy", "broken", "unknown", "")
+		if resp.Counters[1].Error != "" || resp.Counters[1].Value != 7 {
+			t.Errorf("Expected healthy to be read, got %+v", resp.Counters[1])
+		}
+		for _, i := range []int{0, 2} {
+			if !strings.Contains(resp.Counters[i].Error, "shard2") {
+				t.Errorf("Expected %s to fail on shard2, got %+v", resp.Counters[i].CounterID, resp.Counters[i])
+			}
+		}
+		if resp.Counters[3].Error != "Counter ID does not exist" {
+			t.Errorf("Expected the unknown counter to fail, got %+v", resp.Counters[3])
+		}
+		if resp.Counters[4].Error != "Missing counter_id" {
+			t.Errorf("Expected the empty counter ID to fail, got %+v", resp.Counters[4])
+		}
+		if resp.Failed != 4 {
+			t.Errorf("Expected 4 failed counters, got %d", resp.Failed)
+		}
+	})
+}
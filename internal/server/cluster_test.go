@@ -0,0 +1,241 @@
+package server_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sharded-counters/internal/config"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/etcd/etcdtest"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/server"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	counter "sharded-counters/internal/shard_store"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// testCluster runs shards as httptest servers next to the app dependencies.
+// Requests the app sends to http://<shard ID>:8080 reach the shard's server.
+type testCluster struct {
+	etcd   *etcdtest.Manager
+	deps   *middleware.Dependencies // Dependencies of the app server.
+	shards map[string]*testShard
+}
+
+// testShard is a shard of a testCluster. It counts the requests it receives
+// and lets tests replace its handlers with intercept.
+type testShard struct {
+	counters *counter.CounterManager
+	router   http.Handler // Shard endpoints, which intercepts may still call.
+
+	mu        sync.Mutex
+	requests  map[string]int // Requests received by path.
+	intercept http.HandlerFunc
+}
+
+// newTestCluster starts the given shards and registers them as alive.
+// Counters created implicitly get one shard.
+func newTestCluster(t *testing.T, shardIDs ...string) *testCluster {
+	t.Helper()
+	m := etcdtest.NewManager()
+	cfg := config.Default()
+	cfg.DefaultShardCount = 1
+	c := &testCluster{
+		etcd: m,
+		deps: &middleware.Dependencies{
+			EtcdManager: m,
+			Config:      cfg,
+			Placement:   countermetadata.HashRingPlacement{},
+			Selection:   firstShard{},
+		},
+		shards: make(map[string]*testShard),
+	}
+
+	lease, err := m.GrantLease(context.Background(), 6*time.Second)
+	if err != nil {
+		t.Fatalf("GrantLease failed: %v", err)
+	}
+	addrs := make(map[string]string)
+	for _, shardID := range shardIDs {
+		shard := &testShard{counters: counter.NewCounterManager(), requests: make(map[string]int)}
+		srv := httptest.NewServer(shard.routes())
+		t.Cleanup(srv.Close)
+		c.shards[shardID] = shard
+		addrs[shardID] = srv.Listener.Addr().String()
+		if err := shardmetadata.FetchAndStoreMetrics(context.Background(), lease, shardID); err != nil {
+			t.Fatalf("FetchAndStoreMetrics failed: %v", err)
+		}
+	}
+
+	original := http.DefaultTransport
+	http.DefaultTransport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			shardAddr, ok := addrs[host]
+			if !ok {
+				return nil, fmt.Errorf("no shard %s in the test cluster", host)
+			}
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, shardAddr)
+		},
+	}
+	t.Cleanup(func() { http.DefaultTransport = original })
+	return c
+}
+
+// firstShard selects the first shard, so that routing does not depend on the
+// load of the machine running the tests.
+type firstShard struct{}
+
+func (firstShard) SelectShard(shards []*shardmetadata.Shard) (*shardmetadata.Shard, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no shard to select from")
+	}
+	return shards[0], nil
+}
+
+// routes registers the shard endpoints as main does.
+func (s *testShard) routes() http.Handler {
+	deps := &middleware.Dependencies{CounterManager: s.counters}
+	router := mux.NewRouter()
+	router.Handle("/counter/shard/increment", middleware.Middleware(deps, http.HandlerFunc(server.IncrementShardCounterHandler))).Methods(http.MethodPut)
+	router.Handle("/counter/shard/decrement", middleware.Middleware(deps, http.HandlerFunc(server.DecrementShardCounterHandler))).Methods(http.MethodPut)
+	router.Handle("/counter/shard/batch", middleware.Middleware(deps, http.HandlerFunc(server.BatchShardCounterHandler))).Methods(http.MethodPost)
+	router.Handle("/counter/shard", middleware.Middleware(deps, http.HandlerFunc(server.GetShardCounterHandler))).Methods(http.MethodGet)
+	router.Handle("/counter/shard", middleware.Middleware(deps, http.HandlerFunc(server.DeleteShardCounterHandler))).Methods(http.MethodDelete)
+	router.Handle("/counter/shard/values", middleware.Middleware(deps, http.HandlerFunc(server.GetShardCounterValuesHandler))).Methods(http.MethodPost)
+	router.Handle("/counter/shard/handoff", middleware.Middleware(deps, http.HandlerFunc(server.HandoffShardCounterHandler))).Methods(http.MethodPost)
+	s.router = router
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+		intercept := s.intercept
+		s.mu.Unlock()
+		if intercept != nil {
+			intercept(w, r)
+			return
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// setIntercept makes the shard answer every request with handler; nil
+// restores the shard endpoints.
+func (s *testShard) setIntercept(handler http.HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.intercept = handler
+}
+
+// fail makes the shard answer every request with a 500 until the intercept
+// is cleared.
+func (s *testShard) fail() {
+	s.setIntercept(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "shard is down", http.StatusInternalServerError)
+	})
+}
+
+// hang makes the shard answer nothing until the request is cancelled or the
+// test ends.
+func (s *testShard) hang(t *testing.T) {
+	release := make(chan struct{})
+	s.setIntercept(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+	})
+	t.Cleanup(func() {
+		s.setIntercept(nil)
+		close(release)
+	})
+}
+
+// requestCount returns the number of requests the shard received for path.
+func (s *testShard) requestCount(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+// createCounter stores a counter assigned to the given shards.
+func (c *testCluster) createCounter(t *testing.T, counterID string, shardIDs ...string) {
+	t.Helper()
+	if err := countermetadata.SaveCounterMetadata(context.Background(), c.etcd, counterID, countermetadata.GetShardObjList(shardIDs)); err != nil {
+		t.Fatalf("SaveCounterMetadata failed: %v", err)
+	}
+}
+
+// seedCounter creates a counter on the shards of values, in shard ID order,
+// and gives each shard its partial value.
+func (c *testCluster) seedCounter(t *testing.T, counterID string, values map[string]int64) {
+	t.Helper()
+	shardIDs := make([]string, 0, len(values))
+	for shardID := range values {
+		shardIDs = append(shardIDs, shardID)
+	}
+	sort.Strings(shardIDs)
+	c.createCounter(t, counterID, shardIDs...)
+	for _, shardID := range shardIDs {
+		if _, err := c.shards[shardID].counters.Add(counterID, values[shardID]); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+}
+
+// staleRecords serves the given keys with old values, like a metadata cache
+// that has not caught up with etcd yet.
+type staleRecords struct {
+	etcd.Manager
+	values map[string]string
+}
+
+func (s *staleRecords) Get(ctx context.Context, key string) (string, error) {
+	if value, ok := s.values[key]; ok {
+		return value, nil
+	}
+	return s.Manager.Get(ctx, key)
+}
+
+// staleRecord returns an etcd manager that keeps serving the counter's current
+// record after it changes.
+func (c *testCluster) staleRecord(t *testing.T, counterID string) *staleRecords {
+	t.Helper()
+	key := countermetadata.CounterPrefix + "/" + counterID
+	value, err := c.etcd.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	return &staleRecords{Manager: c.etcd, values: map[string]string{key: value}}
+}
+
+// setHealth publishes health as the shard's current health.
+func (c *testCluster) setHealth(t *testing.T, shardID, health string) {
+	t.Helper()
+	ctx := context.Background()
+	metrics, err := shardmetadata.GetShardMetrics(ctx, c.etcd, shardID)
+	if err != nil {
+		t.Fatalf("GetShardMetrics failed: %v", err)
+	}
+	metrics.Health = health
+	value, err := json.Marshal(metrics)
+	if err != nil {
+		t.Fatalf("Failed to marshal shard: %v", err)
+	}
+	if err := c.etcd.SaveMetadata(ctx, shardmetadata.ShardKeyPrefix+shardID, string(value)); err != nil {
+		t.Fatalf("SaveMetadata failed: %v", err)
+	}
+}
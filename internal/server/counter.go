@@ -1,8 +1,11 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
 	countermetadata "sharded-counters/internal/counter_metadata"
 	"sharded-counters/internal/etcd"
@@ -10,23 +13,73 @@ import (
 	"sharded-counters/internal/middleware"
 	"sharded-counters/internal/responsehandler"
 	shardmetadata "sharded-counters/internal/shard_metadata"
+	counter "sharded-counters/internal/shard_store"
 	"sharded-counters/internal/utils"
+	"strconv"
+	"time"
 )
 
-// CounterRequest represents the request payload for creating a counter.
+// IncrementCounterReq represents the request payload for mutating a counter.
 type IncrementCounterReq struct {
 	CounterID string `json:"counter_id"`
+	Delta     *int64 `json:"delta,omitempty"` // Signed amount to apply; defaults to 1.
+	Epoch     *int64 `json:"epoch,omitempty"` // Reset epoch of the counter, set by the app server for shards.
+
+	// OperationID makes shards apply the request only once; set by shards
+	// handing off a value, which requires Epoch.
+	OperationID string `json:"operation_id,omitempty"`
+}
+
+// GetDelta returns the amount the request applies, defaulting to one when delta is omitted.
+func (req *IncrementCounterReq) GetDelta() int64 {
+	if req.Delta == nil {
+		return 1
+	}
+	return *req.Delta
+}
+
+// validateMutation checks the common fields of increment and decrement requests.
+func validateMutation(w http.ResponseWriter, req *IncrementCounterReq) bool {
+	if req.CounterID == "" {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing field: counter_id")
+		return false
+	}
+	if req.Delta != nil && *req.Delta == 0 {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Delta must be non-zero", "invalid value in delta")
+		return false
+	}
+	return true
 }
 
+// CounterRequest represents the request payload for creating a counter.
 type CounterRequest struct {
-	Name string `json:"name"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	ShardCount  *int   `json:"shard_count,omitempty"` // Number of shards to spread the counter over.
 }
 
-// CounterResponse represents the response payload after creating a counter.
+// CounterResponse represents the stored record of a counter.
 type CounterResponse struct {
-	CounterID   string   `json:"counter_id"`
-	CounterName string   `json:"counter_name"`
-	Shards      []string `json:"shards"`
+	CounterID   string    `json:"counter_id"`
+	CounterName string    `json:"counter_name"`
+	Description string    `json:"description,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Shards      []string  `json:"shards"`
+	Version     int64     `json:"version"`
+	Epoch       int64     `json:"epoch"`
+}
+
+// newCounterResponse converts a stored counter record to its API representation.
+func newCounterResponse(record *countermetadata.CounterRecord) CounterResponse {
+	return CounterResponse{
+		CounterID:   record.CounterID,
+		CounterName: record.Name,
+		Description: record.Description,
+		CreatedAt:   record.CreatedAt,
+		Shards:      record.Shards,
+		Version:     record.Version,
+		Epoch:       record.Epoch,
+	}
 }
 
 type ShardCounterResponse struct {
@@ -34,6 +87,15 @@ type ShardCounterResponse struct {
 	Value     int64  `json:"value"`
 }
 
+// CounterValueResponse represents the record and aggregated value of a counter.
+type CounterValueResponse struct {
+	CounterResponse
+	Value         int64          `json:"value"`
+	Contributors  []string       `json:"contributing_shards"` // Shards whose partial values make up Value.
+	Complete      bool           `json:"complete"`            // Whether every assigned shard contributed.
+	MissingShards []MissingShard `json:"missing_shards,omitempty"`
+}
+
 const shardIncrementUrl = "counter/shard/increment"
 const shardDecrementUrl = "counter/shard/decrement"
 
@@ -60,6 +122,14 @@ func CreateCounterHandler(w http.ResponseWriter, r *http.Request) {
 		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter name is required", "Missing field: name")
 		return
 	}
+	shardCount := deps.Config.DefaultShardCount
+	if req.ShardCount != nil {
+		if *req.ShardCount < 1 {
+			responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Shard count must be positive", "invalid value in shard_count")
+			return
+		}
+		shardCount = *req.ShardCount
+	}
 
 	// Generate a unique Counter ID.
 	counterID, err := utils.GenerateUniqueID()
@@ -68,18 +138,68 @@ func CreateCounterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	shardIds, err := countermetadata.LoadOrStore(etcdManager, counterID)
+	record, err := countermetadata.CreateCounter(r.Context(), etcdManager, counterID, countermetadata.CreateOptions{
+		Name:        req.Name,
+		Description: req.Description,
+		ShardCount:  shardCount,
+		Placement:   deps.Placement,
+	})
+	if errors.Is(err, countermetadata.ErrNameTaken) {
+		// Creation is idempotent by name: return the counter that already has it.
+		existing, err := countermetadata.GetCounterRecordByName(r.Context(), etcdManager, req.Name)
+		if err != nil {
+			responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to look up counter name", err.Error())
+			return
+		}
+		responsehandler.SendSuccessResponse(w, "Counter already exists", newCounterResponse(existing))
+		return
+	}
 	if err != nil {
-		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve CounterID", err.Error())
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to create counter", err.Error())
 		return
 	}
 
-	// Respond with the assigned shards.
-	resp := CounterResponse{
-		CounterID: counterID,
-		Shards:    countermetadata.GetShardIds(shardIds),
+	// Respond with the stored record.
+	responsehandler.SendSuccessResponse(w, "Counter created successfully", newCounterResponse(record))
+}
+
+// defaultCreateOptions describes counters created implicitly by a mutation.
+func defaultCreateOptions(deps *middleware.Dependencies) countermetadata.CreateOptions {
+	return countermetadata.CreateOptions{ShardCount: deps.Config.DefaultShardCount, Placement: deps.Placement}
+}
+
+// loadMutationRecord returns the record of the counter a mutation applies to.
+// Unknown counters are created when the auto-create policy allows their ID
+// and reported with a KeyNotFoundError otherwise. Deleted counters are
+// reported with ErrCounterDeleted.
+func loadMutationRecord(ctx context.Context, deps *middleware.Dependencies, counterID string) (*countermetadata.CounterRecord, error) {
+	if deps.Config.AutoCreate.Allows(counterID) {
+		return countermetadata.LoadOrStoreRecord(ctx, deps.EtcdManager, counterID, defaultCreateOptions(deps))
+	}
+	record, err := countermetadata.GetCounterRecord(ctx, deps.EtcdManager, counterID)
+	if !etcd.IsKeyNotFound(err) {
+		return record, err
+	}
+	deleted, deletedErr := countermetadata.IsCounterDeleted(ctx, deps.EtcdManager, counterID)
+	if deletedErr != nil {
+		return nil, deletedErr
+	}
+	if deleted {
+		return nil, countermetadata.ErrCounterDeleted
+	}
+	return nil, err
+}
+
+// sendMutationLookupError reports why loadMutationRecord failed.
+func sendMutationLookupError(w http.ResponseWriter, err error) {
+	switch {
+	case etcd.IsKeyNotFound(err):
+		responsehandler.SendErrorResponse(w, http.StatusNotFound, "Counter ID does not exist", "unknown counter_id; create the counter with POST /counter first")
+	case errors.Is(err, countermetadata.ErrCounterDeleted):
+		responsehandler.SendErrorResponse(w, http.StatusGone, "Counter has been deleted", "invalid value in counter_id")
+	default:
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve counter metadata", err.Error())
 	}
-	responsehandler.SendSuccessResponse(w, "Counter created successfully", resp)
 }
 
 // IncrementCounterHandler handles the counter increment API.
@@ -91,8 +211,6 @@ func IncrementCounterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	etcdManager := deps.EtcdManager
-
 	// Parse the request body.
 	var req IncrementCounterReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -101,30 +219,19 @@ func IncrementCounterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate input.
-	if req.CounterID == "" {
-		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing field: counter_id")
+	if !validateMutation(w, &req) {
 		return
 	}
 
-	counterShards, err := countermetadata.LoadOrStore(etcdManager, req.CounterID)
+	record, err := loadMutationRecord(r.Context(), deps, req.CounterID)
 	if err != nil {
-		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve CounterID", err.Error())
+		sendMutationLookupError(w, err)
 		return
 	}
 
-	// Load balancing logic
-	strategy := &loadbalancer.MetricsStrategy{}
-	lb := loadbalancer.NewLoadBalancer(counterShards, strategy, etcdManager)
-
-	// Marshal the request payload.
-	payload, err := json.Marshal(req)
-	if err != nil {
-		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to marshal request payload", err.Error())
-		return
-	}
-	// Forward the request to the selected shard.
-	if err := lb.ForwardRequest("PUT", shardIncrementUrl, payload, nil); err != nil {
-		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to forward request through load balancer", err.Error())
+	// Forward the request to one of the counter's shards.
+	if respBody, statusCode, err := forwardMutation(r.Context(), deps, record, req, shardIncrementUrl); err != nil {
+		sendForwardError(w, "Failed to forward request through load balancer", respBody, statusCode, err)
 		return
 	}
 
@@ -139,8 +246,6 @@ func DecrementCounterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	etcdManager := deps.EtcdManager
-
 	// Parse the request body.
 	var req IncrementCounterReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -149,36 +254,96 @@ func DecrementCounterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate input.
-	if req.CounterID == "" {
-		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing field: counter_id")
+	if !validateMutation(w, &req) {
 		return
 	}
 
-	// Retrieve assigned shards (pods) for counter
-	counterShards, metadataErr := countermetadata.GetCounterMetadata(etcdManager, req.CounterID)
-	if etcd.IsKeyNotFound(metadataErr) {
-		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID does not exist", "invalid value in counter_id")
+	// Retrieve the counter record, including its assigned shards (pods)
+	record, err := loadMutationRecord(r.Context(), deps, req.CounterID)
+	if err != nil {
+		sendMutationLookupError(w, err)
 		return
+	}
 
+	// Forward the request to one of the counter's shards.
+	if respBody, statusCode, err := forwardMutation(r.Context(), deps, record, req, shardDecrementUrl); err != nil {
+		sendForwardError(w, "Failed to forward request through load balancer", respBody, statusCode, err)
+		return
 	}
 
-	// Load balancing logic
-	strategy := &loadbalancer.MetricsStrategy{}
-	lb := loadbalancer.NewLoadBalancer(counterShards, strategy, etcdManager)
+	responsehandler.SendSuccessResponse(w, "Counter decremented successfully", nil)
+}
+
+// forwardMutation sends a mutation to one of the counter's shards with the
+// delta and the record's epoch made explicit. A shard that has seen a newer
+// epoch means the counter was reset after the record was read, so the record
+// is read again and the mutation retried once.
+func forwardMutation(ctx context.Context, deps *middleware.Dependencies, record *countermetadata.CounterRecord, req IncrementCounterReq, path string) (string, int, error) {
+	delta := req.GetDelta()
+	req.Delta = &delta
+	req.OperationID = "" // Only hand-offs are deduplicated.
+	for retried := false; ; retried = true {
+		lb := loadbalancer.NewLoadBalancer(countermetadata.GetShardObjList(record.Shards), deps.Selection, deps.EtcdManager)
+		req.Epoch = &record.Epoch
+		payload, err := json.Marshal(req)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to marshal request payload: %w", err)
+		}
+		respBody, statusCode, err := lb.ForwardRequest(ctx, "PUT", path, payload, nil)
+		if err == nil || retried || !isStaleEpochResponse(respBody, statusCode) {
+			return respBody, statusCode, err
+		}
+		fresh, rereadErr := rereadCounterRecord(ctx, deps, req.CounterID)
+		if rereadErr != nil {
+			return respBody, statusCode, err
+		}
+		record = fresh
+	}
+}
+
+// ResetCounterReq represents the request payload for resetting a counter.
+type ResetCounterReq struct {
+	CounterID string `json:"counter_id"`
+}
 
-	// Marshal the request payload.
-	payload, err := json.Marshal(req)
+// ResetCounterHandler zeroes a counter on all of its shards at once by
+// starting a new epoch in its metadata. Shards drop their values from older
+// epochs the next time the counter is mutated or read, so no shard has to be
+// reachable for the reset to take effect.
+func ResetCounterHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
 	if err != nil {
-		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to marshal request payload", err.Error())
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
 		return
 	}
-	// Forward the request to the selected shard.
-	if err := lb.ForwardRequest("PUT", shardDecrementUrl, payload, nil); err != nil {
-		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to forward request through load balancer", err.Error())
+
+	// Parse the request body.
+	var req ResetCounterReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
 		return
 	}
 
-	responsehandler.SendSuccessResponse(w, "Counter decremented successfully", nil)
+	// Validate input.
+	if req.CounterID == "" {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing field: counter_id")
+		return
+	}
+
+	record, err := countermetadata.ResetCounter(r.Context(), deps.EtcdManager, req.CounterID)
+	if etcd.IsKeyNotFound(err) {
+		responsehandler.SendErrorResponse(w, http.StatusNotFound, "Counter ID does not exist", "invalid value in counter_id")
+		return
+	}
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to reset counter", err.Error())
+		return
+	}
+	// Contributions seen before the reset no longer describe the counter.
+	lastKnownContributions.forget(req.CounterID)
+
+	responsehandler.SendSuccessResponse(w, "Counter reset successfully", newCounterResponse(record))
 }
 
 func IncrementShardCounterHandler(w http.ResponseWriter, r *http.Request) {
@@ -196,12 +361,15 @@ func IncrementShardCounterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate input.
-	if req.CounterID == "" {
-		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing field: counter_id")
+	if !validateMutation(w, &req) {
+		return
+	}
+	// call shard store to add delta to in memory shard counter (upsert behaviour)
+	newValue, err := applyShardDelta(deps.CounterManager, &req, req.GetDelta())
+	if err != nil {
+		sendShardMutationError(w, "Failed to increment shard counter", err)
 		return
 	}
-	// call shard store to increment in memory shard counter (upsert behaviour)
-	newValue := deps.CounterManager.Increment(req.CounterID)
 	resp := ShardCounterResponse{
 		CounterID: req.CounterID,
 		Value:     newValue,
@@ -225,12 +393,20 @@ func DecrementShardCounterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate input.
-	if req.CounterID == "" {
-		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing field: counter_id")
+	if !validateMutation(w, &req) {
+		return
+	}
+	// call shard store to subtract delta from in memory shard counter (upsert behaviour)
+	delta := req.GetDelta()
+	if delta == math.MinInt64 {
+		sendShardMutationError(w, "Failed to decrement shard counter", counter.ErrOverflow)
+		return
+	}
+	newValue, err := applyShardDelta(deps.CounterManager, &req, -delta)
+	if err != nil {
+		sendShardMutationError(w, "Failed to decrement shard counter", err)
 		return
 	}
-	// call shard store to decrement in memory shard counter (upsert behaviour)
-	newValue := deps.CounterManager.Decrement(req.CounterID)
 	resp := ShardCounterResponse{
 		CounterID: req.CounterID,
 		Value:     newValue,
@@ -247,8 +423,6 @@ func GetCounterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	etcdManager := deps.EtcdManager
-
 	// Retrieve `counter_id` from query parameters.
 	counterID := r.URL.Query().Get("counter_id")
 	if counterID == "" {
@@ -256,26 +430,128 @@ func GetCounterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Retrieve assigned shards (pods) for counter
-	counterShards, metadataErr := countermetadata.GetCounterMetadata(etcdManager, counterID)
+	// Retrieve the counter record, including its assigned shards (pods)
+	record, metadataErr := countermetadata.GetCounterRecord(r.Context(), deps.EtcdManager, counterID)
 	if etcd.IsKeyNotFound(metadataErr) {
 		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID does not exist", "invalid value in counter_id")
 		return
 
 	}
+	if metadataErr != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve counter metadata", metadataErr.Error())
+		return
+	}
+
+	sendCounterValue(w, r, deps, record)
+}
+
+// GetCounterByNameHandler resolves a counter name to its ID and returns the counter's value.
+func GetCounterByNameHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+
+	// Retrieve `name` from query parameters.
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter name is required", "Missing query parameter: name")
+		return
+	}
+
+	record, metadataErr := countermetadata.GetCounterRecordByName(r.Context(), deps.EtcdManager, name)
+	if etcd.IsKeyNotFound(metadataErr) {
+		responsehandler.SendErrorResponse(w, http.StatusNotFound, "Counter name does not exist", "invalid value in name")
+		return
+	}
+	if metadataErr != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve counter metadata", metadataErr.Error())
+		return
+	}
+
+	sendCounterValue(w, r, deps, record)
+}
+
+// sendCounterValue aggregates the counter's value across its shards and
+// responds with it together with the counter record.
+func sendCounterValue(w http.ResponseWriter, r *http.Request, deps *middleware.Dependencies, record *countermetadata.CounterRecord) {
+	// With partial=true, shards that fail are reported instead of failing the read.
+	allowPartial := r.URL.Query().Get("partial") == "true"
 
 	// Aggregate sum of counter values by querying each shard.
-	totalVal, err := aggregateCounterSum(counterID, counterShards, etcdManager)
+	aggregate, err := aggregateCounterSum(r.Context(), record, deps.EtcdManager, deps.Config.ShardQueryTimeout, allowPartial)
+	if errors.Is(err, counter.ErrStaleEpoch) {
+		// The counter was reset after its record was cached; retry once with
+		// the record etcd has now.
+		record, err = rereadCounterRecord(r.Context(), deps, record.CounterID)
+		if etcd.IsKeyNotFound(err) {
+			responsehandler.SendErrorResponse(w, http.StatusNotFound, "Counter ID does not exist", "invalid value in counter_id")
+			return
+		}
+		if err != nil {
+			responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve counter metadata", err.Error())
+			return
+		}
+		aggregate, err = aggregateCounterSum(r.Context(), record, deps.EtcdManager, deps.Config.ShardQueryTimeout, allowPartial)
+	}
+	if errors.Is(err, counter.ErrStaleEpoch) {
+		responsehandler.SendErrorResponse(w, http.StatusConflict, "Counter has been reset", err.Error())
+		return
+	}
+	if errors.Is(err, errShardUnavailable) {
+		responsehandler.SendErrorResponse(w, http.StatusServiceUnavailable, "Counter shards are unavailable", err.Error()+"; pass partial=true to read the shards that answer")
+		return
+	}
 	if err != nil {
 		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to aggregate sum", err.Error())
 		return
 	}
-	resp := ShardCounterResponse{
-		CounterID: counterID,
-		Value:     totalVal,
+	resp := CounterValueResponse{
+		CounterResponse: newCounterResponse(record),
+		Value:           aggregate.Total,
+		Contributors:    aggregate.Contributed,
+		Complete:        len(aggregate.Missing) == 0,
+		MissingShards:   aggregate.Missing,
 	}
 
-	responsehandler.SendSuccessResponse(w, "Counter aggregated successfully", resp)
+	message := "Counter aggregated successfully"
+	if !resp.Complete {
+		message = "Counter partially aggregated"
+	}
+	responsehandler.SendSuccessResponse(w, message, resp)
+}
+
+// errShardNotWritable is returned for writes to a shard whose health refuses
+// them. App servers route by a cached view of shard health, so the shard has
+// the final say: a draining shard's values are being handed over, and a
+// read-only shard cannot log the write.
+var errShardNotWritable = errors.New("shard takes no writes")
+
+// checkShardWritable returns errShardNotWritable, with the shard's health,
+// unless the local shard takes writes.
+func checkShardWritable() error {
+	if health := shardmetadata.CurrentHealth(); !shardmetadata.AcceptsWrites(health) {
+		return fmt.Errorf("%w while %s", errShardNotWritable, health)
+	}
+	return nil
+}
+
+// applyShardDelta adds delta to the shard's partial value of the request's
+// counter, in the request's epoch when it carries one and only once per
+// operation ID when it carries that too.
+func applyShardDelta(cm *counter.CounterManager, req *IncrementCounterReq, delta int64) (int64, error) {
+	if err := checkShardWritable(); err != nil {
+		return 0, err
+	}
+	switch {
+	case req.Epoch == nil:
+		return cm.Add(req.CounterID, delta)
+	case req.OperationID != "":
+		return cm.AddOnceAtEpoch(req.CounterID, req.OperationID, *req.Epoch, delta)
+	}
+	return cm.AddAtEpoch(req.CounterID, *req.Epoch, delta)
 }
 
 func GetShardCounterHandler(w http.ResponseWriter, r *http.Request) {
@@ -293,6 +569,18 @@ func GetShardCounterHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// call shard store to get in memory  counter value.
 	newValue := deps.CounterManager.Get(counterID)
+	if epochParam := r.URL.Query().Get("epoch"); epochParam != "" {
+		epoch, err := strconv.ParseInt(epochParam, 10, 64)
+		if err != nil {
+			responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid epoch", err.Error())
+			return
+		}
+		newValue, err = deps.CounterManager.GetAtEpoch(counterID, epoch)
+		if err != nil {
+			responsehandler.SendErrorResponse(w, http.StatusConflict, "Counter has been reset", err.Error())
+			return
+		}
+	}
 	resp := ShardCounterResponse{
 		CounterID: counterID,
 		Value:     newValue,
@@ -301,47 +589,40 @@ func GetShardCounterHandler(w http.ResponseWriter, r *http.Request) {
 
 }
 
-func aggregateCounterSum(counterID string, counterShards []*shardmetadata.Shard, etcdManager *etcd.EtcdManager) (int64, error) {
-	lb := loadbalancer.NewLoadBalancer(counterShards, nil, etcdManager)
-	lb.FilterHealthyShards()
-	var total int64
-
-	for _, shardData := range lb.GetShards() {
-		// Send api request to each shard
-		qyeryParams := map[string]string{"counter_id": counterID}
-		respBody, statusCode, err := lb.ForwardRequestToShard("GET", shardData, "counter/shard", nil, qyeryParams)
-		// read the response body {"success":true,"message":"","data":{"counter_id":"12345abcdef6ii978","value":1}}
-		// Extract value and add it to total.
-		if err != nil {
-			return 0, fmt.Errorf("failed to query shard %s: %v (status Code: %d)", shardData.ShardID, err, statusCode)
+// sendShardMutationError maps a CounterManager mutation error to a response.
+func sendShardMutationError(w http.ResponseWriter, message string, err error) {
+	if errors.Is(err, counter.ErrOverflow) {
+		responsehandler.SendErrorResponse(w, http.StatusConflict, "Counter value would overflow", err.Error())
+		return
+	}
+	if errors.Is(err, counter.ErrCounterDeleted) {
+		responsehandler.SendErrorResponse(w, http.StatusGone, "Counter has been deleted", err.Error())
+		return
+	}
+	if errors.Is(err, counter.ErrStaleEpoch) {
+		responsehandler.SendErrorResponse(w, http.StatusConflict, "Counter has been reset", err.Error())
+		return
+	}
+	if errors.Is(err, counter.ErrInvalidOperationID) {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid operation ID", err.Error())
+		return
+	}
+	if errors.Is(err, errShardNotWritable) {
+		responsehandler.SendErrorResponse(w, http.StatusServiceUnavailable, "Shard is not accepting writes", err.Error())
+		return
+	}
+	responsehandler.SendErrorResponse(w, http.StatusInternalServerError, message, err.Error())
+}
 
-		}
+// sendForwardError relays client errors reported by a shard (such as an
+// overflow) with their original status and maps everything else to a 500.
+func sendForwardError(w http.ResponseWriter, message string, respBody string, statusCode int, err error) {
+	if statusCode >= 400 && statusCode < 500 {
 		response := &responsehandler.Response{}
-		if err := json.Unmarshal([]byte(respBody), response); err != nil {
-			return 0, fmt.Errorf("failed to parse response from shard %s: %v", shardData.ShardID, err)
-		}
-		// Check for API-level success.
-		if !response.Success {
-			return 0, fmt.Errorf("shard %s returned unsuccessful response for counter id %s", shardData.ShardID, counterID)
-		}
-
-		// Add the shard's counter value to the total.
-		// Cast response.Data to the expected structure.
-		dataMap, ok := response.Data.(map[string]interface{})
-		if !ok {
-			return 0, fmt.Errorf("invalid data format from shard %s", shardData.ShardID)
+		if json.Unmarshal([]byte(respBody), response) == nil && response.Error != nil {
+			responsehandler.SendErrorResponse(w, statusCode, response.Message, response.Error.Details)
+			return
 		}
-
-		// Extract the counter value.
-		value, ok := dataMap["value"].(float64) // JSON numbers are unmarshaled as float64.
-		if !ok {
-			return 0, fmt.Errorf("invalid data format from shard %s", shardData.ShardID)
-		}
-		// Extract the counter value.
-		total += int64(value)
-
 	}
-
-	return total, nil
-
+	responsehandler.SendErrorResponse(w, http.StatusInternalServerError, message, err.Error())
 }
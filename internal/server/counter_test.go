@@ -0,0 +1,305 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/etcd/etcdtest"
+	metadatacache "sharded-counters/internal/metadata_cache"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/rebalancer"
+	"sharded-counters/internal/responsehandler"
+	"sharded-counters/internal/server"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	counter "sharded-counters/internal/shard_store"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serve runs one request through handler with deps injected, and decodes the
+// response's data into data when it is not nil.
+func serve(t *testing.T, deps *middleware.Dependencies, handler http.HandlerFunc, method, target string, body any, data any) (int, *responsehandler.Response) {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatalf("Failed to encode request: %v", err)
+		}
+	}
+	rec := httptest.NewRecorder()
+	middleware.Middleware(deps, handler).ServeHTTP(rec, httptest.NewRequest(method, target, &payload))
+	response := &responsehandler.Response{Data: data}
+	if err := json.Unmarshal(rec.Body.Bytes(), response); err != nil {
+		t.Fatalf("Failed to decode response %q: %v", rec.Body.String(), err)
+	}
+	return rec.Code, response
+}
+
+func TestShardRefusesWritesWhileDraining(t *testing.T) {
+	deps := &middleware.Dependencies{CounterManager: counter.NewCounterManager()}
+	deps.CounterManager.Add("counter", 5)
+	shardmetadata.SetDraining(true)
+	defer shardmetadata.SetDraining(false)
+
+	delta := int64(1)
+	mutation := server.IncrementCounterReq{CounterID: "counter", Delta: &delta}
+
+	// Test Case 1: Increments, decrements and batches are refused
+	t.Run("Writes", func(t *testing.T) {
+		if code, _ := serve(t, deps, server.IncrementShardCounterHandler, http.MethodPut, "/counter/shard/increment", mutation, nil); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected increment to be refused with 503, got %d", code)
+		}
+		if code, _ := serve(t, deps, server.DecrementShardCounterHandler, http.MethodPut, "/counter/shard/decrement", mutation, nil); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected decrement to be refused with 503, got %d", code)
+		}
+		batch := server.BatchRequest{Operations: []server.IncrementCounterReq{mutation}}
+		if code, _ := serve(t, deps, server.BatchShardCounterHandler, http.MethodPost, "/counter/shard/batch", batch, nil); code != http.StatusServiceUnavailable {
+			t.Errorf("Expected batch to be refused with 503, got %d", code)
+		}
+		if value := deps.CounterManager.Get("counter"); value != 5 {
+			t.Errorf("Expected the value to stay 5, got %d", value)
+		}
+	})
+
+	// Test Case 2: Reads are still served
+	t.Run("Reads", func(t *testing.T) {
+		resp := &server.ShardCounterResponse{}
+		code, _ := serve(t, deps, server.GetShardCounterHandler, http.MethodGet, "/counter/shard?counter_id=counter", nil, resp)
+		if code != http.StatusOK || resp.Value != 5 {
+			t.Errorf("Expected to read 5, got %d (status %d)", resp.Value, code)
+		}
+	})
+
+	// Test Case 3: Hand-offs are still served
+	t.Run("Handoff", func(t *testing.T) {
+		handoff := rebalancer.HandoffRequest{CounterID: "empty", TargetShard: "shard2"}
+		if code, _ := serve(t, deps, server.HandoffShardCounterHandler, http.MethodPost, "/counter/shard/handoff", handoff, nil); code != http.StatusOK {
+			t.Errorf("Expected hand-off to be served, got %d", code)
+		}
+	})
+}
+
+func TestShardRefusesWritesWhileReadOnly(t *testing.T) {
+	deps := &middleware.Dependencies{CounterManager: counter.NewCounterManager()}
+	m := etcdtest.NewManager()
+	lease, err := m.GrantLease(context.Background(), 6*time.Second)
+	if err != nil {
+		t.Fatalf("GrantLease failed: %v", err)
+	}
+	publish := func(walErr error) {
+		shardmetadata.SetWALCheck(func() error { return walErr })
+		if err := shardmetadata.FetchAndStoreMetrics(context.Background(), lease, "shard1"); err != nil {
+			t.Fatalf("FetchAndStoreMetrics failed: %v", err)
+		}
+	}
+	defer publish(nil)
+
+	delta := int64(1)
+	mutation := server.IncrementCounterReq{CounterID: "counter", Delta: &delta}
+
+	// The shard refuses writes from its own self-check, whatever app servers think.
+	publish(errors.New("disk full"))
+	if code, _ := serve(t, deps, server.IncrementShardCounterHandler, http.MethodPut, "/counter/shard/increment", mutation, nil); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected increment to be refused with 503, got %d", code)
+	}
+
+	publish(nil)
+	if code, _ := serve(t, deps, server.IncrementShardCounterHandler, http.MethodPut, "/counter/shard/increment", mutation, nil); code != http.StatusOK {
+		t.Errorf("Expected increment to be accepted once the WAL recovers, got %d", code)
+	}
+}
+
+func TestReadRetriesAfterReset(t *testing.T) {
+	ctx := context.Background()
+	c := newTestCluster(t, "shard1", "shard2")
+	c.seedCounter(t, "reset-counter", map[string]int64{"shard1": 5, "shard2": 3})
+
+	// The app still has the record from before the reset, which shard1 has
+	// already seen.
+	stale := c.staleRecord(t, "reset-counter")
+	if _, err := countermetadata.ResetCounter(ctx, c.etcd, "reset-counter"); err != nil {
+		t.Fatalf("ResetCounter failed: %v", err)
+	}
+	c.shards["shard1"].counters.AddAtEpoch("reset-counter", 1, 2)
+	c.deps.EtcdManager = stale
+	c.deps.MetadataCache = metadatacache.New(c.etcd, 0)
+
+	// Test Case 1: A single read retries with the record from etcd
+	t.Run("Single Read", func(t *testing.T) {
+		resp := &server.CounterValueResponse{}
+		code, _ := serve(t, c.deps, server.GetCounterHandler, http.MethodGet, "/counter?counter_id=reset-counter", nil, resp)
+		if code != http.StatusOK {
+			t.Fatalf("Expected the read to succeed, got %d", code)
+		}
+		if resp.Value != 2 || resp.Epoch != 1 {
+			t.Errorf("Expected value 2 in epoch 1, got %d in epoch %d", resp.Value, resp.Epoch)
+		}
+	})
+
+	// Test Case 2: A bulk read retries the counters that were reset
+	t.Run("Bulk Read", func(t *testing.T) {
+		resp := &server.CounterValuesResponse{}
+		req := server.CounterValuesRequest{CounterIDs: []string{"reset-counter"}}
+		if code, _ := serve(t, c.deps, server.GetCounterValuesHandler, http.MethodPost, "/counter/values", req, resp); code != http.StatusOK {
+			t.Fatalf("Expected the read to succeed, got %d", code)
+		}
+		if resp.Failed != 0 || resp.Counters[0].Value != 2 {
+			t.Errorf("Expected value 2, got %+v", resp.Counters[0])
+		}
+	})
+
+	// Test Case 3: A record that stays stale is reported as a conflict
+	t.Run("Still Stale", func(t *testing.T) {
+		c.deps.MetadataCache = metadatacache.New(c.deps.EtcdManager, 0)
+		if code, _ := serve(t, c.deps, server.GetCounterHandler, http.MethodGet, "/counter?counter_id=reset-counter", nil, nil); code != http.StatusConflict {
+			t.Errorf("Expected 409, got %d", code)
+		}
+	})
+}
+
+func TestCounterRecordResponse(t *testing.T) {
+	c := newTestCluster(t, "shard1", "shard2")
+	shardCount := 2
+	created := &server.CounterResponse{}
+	req := server.CounterRequest{Name: "page-views", Description: "Views of the home page", ShardCount: &shardCount}
+	if code, _ := serve(t, c.deps, server.CreateCounterHandler, http.MethodPost, "/counter", req, created); code != http.StatusOK {
+		t.Fatalf("Expected the counter to be created, got %d", code)
+	}
+	if created.CounterName != "page-views" || created.Description != req.Description || len(created.Shards) != 2 || created.Version != 1 {
+		t.Errorf("Expected the created record, got %+v", created)
+	}
+
+	// Reads return the record together with the shards that contributed.
+	var data map[string]any
+	if code, _ := serve(t, c.deps, server.GetCounterHandler, http.MethodGet, "/counter?counter_id="+created.CounterID, nil, &data); code != http.StatusOK {
+		t.Fatalf("Expected the read to succeed, got %d", code)
+	}
+	for _, field := range []string{"counter_id", "counter_name", "description", "created_at", "shards", "version", "epoch", "value", "contributing_shards", "complete"} {
+		if _, ok := data[field]; !ok {
+			t.Errorf("Expected field %q in %v", field, data)
+		}
+	}
+}
+
+func TestCreateCounterByName(t *testing.T) {
+	const goroutines = 10
+
+	c := newTestCluster(t, "shard1", "shard2")
+	handler := middleware.Middleware(c.deps, http.HandlerFunc(server.CreateCounterHandler))
+
+	// Test Case 1: Concurrent creations of one name all get the same counter
+	ids := make([]string, goroutines)
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/counter", strings.NewReader(`{"name": "contested"}`)))
+			created := &server.CounterResponse{}
+			if rec.Code == http.StatusOK && json.Unmarshal(rec.Body.Bytes(), &responsehandler.Response{Data: created}) == nil {
+				ids[i] = created.CounterID
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 1; i < goroutines; i++ {
+		if ids[i] == "" || ids[i] != ids[0] {
+			t.Fatalf("Expected every creation to return the same counter, got %v", ids)
+		}
+	}
+
+	// Test Case 2: The name resolves to that counter
+	resp := &server.CounterValueResponse{}
+	if code, _ := serve(t, c.deps, server.GetCounterByNameHandler, http.MethodGet, "/counter/by-name?name=contested", nil, resp); code != http.StatusOK || resp.CounterID != ids[0] {
+		t.Errorf("Expected the name to resolve to %s, got %q (status %d)", ids[0], resp.CounterID, code)
+	}
+
+	// Test Case 3: Unknown names are not found
+	if code, _ := serve(t, c.deps, server.GetCounterByNameHandler, http.MethodGet, "/counter/by-name?name=unknown", nil, nil); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for an unknown name, got %d", code)
+	}
+}
+
+func TestResetEpochConflicts(t *testing.T) {
+	c := newTestCluster(t, "shard1")
+	c.seedCounter(t, "reset-me", map[string]int64{"shard1": 5})
+	before := c.staleRecord(t, "reset-me")
+
+	reset := &server.CounterResponse{}
+	if code, _ := serve(t, c.deps, server.ResetCounterHandler, http.MethodPost, "/counter/reset", server.ResetCounterReq{CounterID: "reset-me"}, reset); code != http.StatusOK || reset.Epoch != 1 {
+		t.Fatalf("Expected the reset to start epoch 1, got %d (status %d)", reset.Epoch, code)
+	}
+
+	// Test Case 1: Writes in the new epoch start from zero
+	t.Run("New Epoch", func(t *testing.T) {
+		req := server.IncrementCounterReq{CounterID: "reset-me"}
+		if code, _ := serve(t, c.deps, server.IncrementCounterHandler, http.MethodPut, "/counter/increment", req, nil); code != http.StatusOK {
+			t.Fatalf("Expected the increment to succeed, got %d", code)
+		}
+		resp := &server.CounterValueResponse{}
+		if code, _ := serve(t, c.deps, server.GetCounterHandler, http.MethodGet, "/counter?counter_id=reset-me", nil, resp); code != http.StatusOK || resp.Value != 1 {
+			t.Errorf("Expected 1 after the reset, got %d (status %d)", resp.Value, code)
+		}
+	})
+
+	// Test Case 2: The app replaces the epoch a client sends
+	t.Run("Client Epoch", func(t *testing.T) {
+		epoch := int64(0)
+		req := server.IncrementCounterReq{CounterID: "reset-me", Epoch: &epoch}
+		if code, _ := serve(t, c.deps, server.IncrementCounterHandler, http.MethodPut, "/counter/increment", req, nil); code != http.StatusOK {
+			t.Errorf("Expected the app to replace the client's epoch, got %d", code)
+		}
+		if value := c.shards["shard1"].counters.Get("reset-me"); value != 2 {
+			t.Errorf("Expected the shard to hold 2, got %d", value)
+		}
+	})
+
+	// The app still has the record from before the reset.
+	stale := &middleware.Dependencies{
+		EtcdManager:   before,
+		MetadataCache: metadatacache.New(c.etcd, 0),
+		Config:        c.deps.Config,
+		Selection:     c.deps.Selection,
+	}
+
+	// Test Case 3: Writes with a stale record retry with the record from etcd
+	t.Run("Stale Record", func(t *testing.T) {
+		req := server.IncrementCounterReq{CounterID: "reset-me"}
+		if code, resp := serve(t, stale, server.IncrementCounterHandler, http.MethodPut, "/counter/increment", req, nil); code != http.StatusOK {
+			t.Errorf("Expected the increment to succeed after rereading the record, got %d: %+v", code, resp)
+		}
+		delta := int64(-2)
+		batch := server.BatchRequest{Operations: []server.IncrementCounterReq{{CounterID: "reset-me", Delta: &delta}}}
+		resp := &server.BatchResponse{}
+		if code, _ := serve(t, stale, server.BatchCounterHandler, http.MethodPost, "/counter/batch", batch, resp); code != http.StatusOK || resp.Failed != 0 {
+			t.Errorf("Expected the batch to succeed after rereading the record, got %d: %+v", code, resp)
+		}
+		if value, err := c.shards["shard1"].counters.GetAtEpoch("reset-me", 1); err != nil || value != 1 {
+			t.Errorf("Expected the shard to hold 1 in epoch 1, got %d (%v)", value, err)
+		}
+	})
+
+	// Test Case 4: A record that stays stale is reported as a conflict
+	t.Run("Still Stale", func(t *testing.T) {
+		stale := *stale
+		stale.MetadataCache = nil
+		code, resp := serve(t, &stale, server.DecrementCounterHandler, http.MethodPut, "/counter/decrement", server.IncrementCounterReq{CounterID: "reset-me"}, nil)
+		if code != http.StatusConflict || resp.Message != "Counter has been reset" {
+			t.Errorf("Expected 409, got %d: %+v", code, resp)
+		}
+	})
+
+	// Test Case 5: Unknown counters cannot be reset
+	t.Run("Unknown", func(t *testing.T) {
+		if code, _ := serve(t, c.deps, server.ResetCounterHandler, http.MethodPost, "/counter/reset", server.ResetCounterReq{CounterID: "unknown"}, nil); code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", code)
+		}
+	})
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/loadbalancer"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/responsehandler"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+)
+
+const shardDeleteUrl = "counter/shard"
+
+// FailedShard reports a shard that could not be cleaned up.
+type FailedShard struct {
+	ShardID string `json:"shard_id"`
+	Error   string `json:"error"`
+}
+
+// DeleteCounterResponse represents the response payload of the delete API.
+type DeleteCounterResponse struct {
+	CounterID     string        `json:"counter_id"`
+	DeletedShards []string      `json:"deleted_shards"`
+	FailedShards  []FailedShard `json:"failed_shards,omitempty"`
+}
+
+// DeleteCounterHandler deletes a counter's metadata and its partial values on
+// every assigned shard. The counter ID stays tombstoned, so late increments
+// are rejected instead of recreating it. Deleting an already deleted counter
+// retries the cleanup of its shards.
+func DeleteCounterHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+
+	etcdManager := deps.EtcdManager
+
+	// Retrieve `counter_id` from query parameters.
+	counterID := r.URL.Query().Get("counter_id")
+	if counterID == "" {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing query parameter: counter_id")
+		return
+	}
+
+	tombstone, err := countermetadata.DeleteCounter(r.Context(), etcdManager, counterID)
+	if etcd.IsKeyNotFound(err) {
+		// Already deleted; retry the cleanup of its shards.
+		tombstone, err = countermetadata.GetCounterTombstone(r.Context(), etcdManager, counterID)
+		if etcd.IsKeyNotFound(err) {
+			responsehandler.SendErrorResponse(w, http.StatusNotFound, "Counter ID does not exist", "invalid value in counter_id")
+			return
+		}
+		if err != nil {
+			responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve counter tombstone", err.Error())
+			return
+		}
+	} else if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to delete counter metadata", err.Error())
+		return
+	}
+	lastKnownContributions.forget(counterID)
+
+	// Broadcast the delete to every assigned shard, healthy or not, so that
+	// unreachable shards are reported rather than silently skipped.
+	shards := countermetadata.GetShardObjList(tombstone.Shards)
+	lb := loadbalancer.NewLoadBalancer(shards, nil, etcdManager)
+	calls := fanOutToShards(r.Context(), deps.Config.ShardQueryTimeout, shards, func(ctx context.Context, shard *shardmetadata.Shard) (struct{}, error) {
+		return struct{}{}, deleteShardCounter(ctx, lb, shard, counterID)
+	})
+
+	resp := DeleteCounterResponse{CounterID: counterID, DeletedShards: []string{}}
+	for _, call := range calls {
+		if call.Err != nil {
+			resp.FailedShards = append(resp.FailedShards, FailedShard{ShardID: call.Shard.ShardID, Error: call.Err.Error()})
+			continue
+		}
+		resp.DeletedShards = append(resp.DeletedShards, call.Shard.ShardID)
+	}
+
+	message := "Counter deleted successfully"
+	if len(resp.FailedShards) > 0 {
+		message = "Counter deleted, but some shards could not be cleaned up"
+	}
+	responsehandler.SendSuccessResponse(w, message, resp)
+}
+
+// deleteShardCounter deletes the shard's partial value of a counter.
+func deleteShardCounter(ctx context.Context, lb *loadbalancer.LoadBalancer, shard *shardmetadata.Shard, counterID string) error {
+	params := map[string]string{"counter_id": counterID}
+	_, statusCode, err := lb.ForwardRequestToShard(ctx, http.MethodDelete, shard, shardDeleteUrl, nil, params)
+	if err != nil {
+		return fmt.Errorf("failed to delete counter on shard %s: %v (status Code: %d)", shard.ShardID, err, statusCode)
+	}
+	return nil
+}
+
+// DeleteShardCounterHandler deletes and tombstones the shard's partial value of a counter.
+func DeleteShardCounterHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	// Retrieve `counter_id` from query parameters.
+	counterID := r.URL.Query().Get("counter_id")
+	if counterID == "" {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing query parameter: counter_id")
+		return
+	}
+	if err := deps.CounterManager.Delete(counterID); err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to delete shard counter", err.Error())
+		return
+	}
+	responsehandler.SendSuccessResponse(w, "Counter deleted successfully", nil)
+}
@@ -0,0 +1,68 @@
+package server_test
+
+import (
+	"fmt"
+	"net/http"
+	"sharded-counters/internal/config"
+	"sharded-counters/internal/server"
+	"testing"
+)
+
+func TestDeleteCounterTombstone(t *testing.T) {
+	c := newTestCluster(t, "shard1", "shard2")
+	c.deps.Config.AutoCreate = config.AutoCreatePolicy{Enabled: true}
+	c.seedCounter(t, "doomed", map[string]int64{"shard1": 1, "shard2": 2})
+
+	remove := func(t *testing.T, counterID string) (int, *server.DeleteCounterResponse) {
+		t.Helper()
+		resp := &server.DeleteCounterResponse{}
+		code, _ := serve(t, c.deps, server.DeleteCounterHandler, http.MethodDelete, "/counter?counter_id="+counterID, nil, resp)
+		return code, resp
+	}
+
+	// Test Case 1: Shards that cannot be cleaned up are reported
+	t.Run("Failed Shard", func(t *testing.T) {
+		c.shards["shard2"].fail()
+		defer c.shards["shard2"].setIntercept(nil)
+
+		code, resp := remove(t, "doomed")
+		if code != http.StatusOK {
+			t.Fatalf("Expected the counter to be deleted, got %d", code)
+		}
+		if fmt.Sprint(resp.DeletedShards) != "[shard1]" || len(resp.FailedShards) != 1 || resp.FailedShards[0].ShardID != "shard2" {
+			t.Errorf("Expected shard1 to be cleaned up and shard2 to fail, got %+v", resp)
+		}
+		if value := c.shards["shard1"].counters.Get("doomed"); value != 0 {
+			t.Errorf("Expected shard1's value to be deleted, got %d", value)
+		}
+	})
+
+	// Test Case 2: The tombstone keeps late increments from recreating the counter
+	t.Run("Late Increment", func(t *testing.T) {
+		req := server.IncrementCounterReq{CounterID: "doomed"}
+		if code, _ := serve(t, c.deps, server.IncrementCounterHandler, http.MethodPut, "/counter/increment", req, nil); code != http.StatusGone {
+			t.Errorf("Expected 410, got %d", code)
+		}
+		if code, _ := serve(t, c.deps, server.GetCounterHandler, http.MethodGet, "/counter?counter_id=doomed", nil, nil); code == http.StatusOK {
+			t.Errorf("Expected the counter to stay deleted")
+		}
+	})
+
+	// Test Case 3: Deleting again retries every shard of the tombstone
+	t.Run("Retry", func(t *testing.T) {
+		code, resp := remove(t, "doomed")
+		if code != http.StatusOK || fmt.Sprint(resp.DeletedShards) != "[shard1 shard2]" || len(resp.FailedShards) != 0 {
+			t.Errorf("Expected both shards to be cleaned up, got %d: %+v", code, resp)
+		}
+		if value := c.shards["shard2"].counters.Get("doomed"); value != 0 {
+			t.Errorf("Expected shard2's value to be deleted, got %d", value)
+		}
+	})
+
+	// Test Case 4: Counters that never existed are not found
+	t.Run("Unknown", func(t *testing.T) {
+		if code, _ := remove(t, "never-created"); code != http.StatusNotFound {
+			t.Errorf("Expected 404, got %d", code)
+		}
+	})
+}
@@ -0,0 +1,9 @@
+package server
+
+// SetMaxTrackedCounters replaces the last-known shard contributions with an
+// empty cache of the given capacity until the returned restore is called.
+func SetMaxTrackedCounters(capacity int) (restore func()) {
+	original := lastKnownContributions
+	lastKnownContributions = newContributionCache(capacity)
+	return func() { lastKnownContributions = original }
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"context"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"time"
+)
+
+// shardCallResult holds the outcome of one call in a shard fan-out.
+type shardCallResult[T any] struct {
+	Shard *shardmetadata.Shard
+	Value T
+	Err   error
+}
+
+// fanOutToShards calls fn for every shard concurrently under one deadline
+// derived from ctx and returns the results in shard order. Calls still running
+// when the deadline passes are cancelled and report the context error.
+func fanOutToShards[T any](ctx context.Context, timeout time.Duration, shards []*shardmetadata.Shard, fn func(context.Context, *shardmetadata.Shard) (T, error)) []shardCallResult[T] {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results := make([]shardCallResult[T], len(shards))
+	done := make(chan int, len(shards))
+	for i, shard := range shards {
+		go func(i int, shard *shardmetadata.Shard) {
+			value, err := fn(ctx, shard)
+			results[i] = shardCallResult[T]{Shard: shard, Value: value, Err: err}
+			done <- i
+		}(i, shard)
+	}
+	for range shards {
+		<-done
+	}
+	return results
+}
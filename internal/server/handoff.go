@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sharded-counters/internal/loadbalancer"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/rebalancer"
+	"sharded-counters/internal/responsehandler"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	counter "sharded-counters/internal/shard_store"
+	"syscall"
+)
+
+// HandoffShardCounterHandler moves the shard's partial value of a counter to
+// another shard. The value is taken out of the local counter into a pending
+// hand-off and sent with the hand-off's ID, which the target applies only
+// once. It is put back only when the target definitely did not apply it;
+// otherwise it stays pending, and later requests resend the same hand-off
+// until the target confirms it, so it is never counted twice.
+func HandoffShardCounterHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+	// Parse the request body.
+	var req rebalancer.HandoffRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+
+	// Validate input.
+	if req.CounterID == "" {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Counter ID is required", "Missing field: counter_id")
+		return
+	}
+	if req.TargetShard == "" {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Target shard is required", "Missing field: target_shard")
+		return
+	}
+
+	cm := deps.CounterManager
+	handoff, err := cm.StartHandoff(req.CounterID, req.TargetShard)
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to take shard counter", err.Error())
+		return
+	}
+	resp := rebalancer.HandoffResponse{CounterID: req.CounterID, Moved: handoff.Value}
+	if handoff.Value == 0 {
+		responsehandler.SendSuccessResponse(w, "Nothing to hand off", resp)
+		return
+	}
+	if handoff.Target != req.TargetShard {
+		log.Printf("Resending pending hand-off %s of counter %s to shard %s instead of %s", handoff.ID, req.CounterID, handoff.Target, req.TargetShard)
+	}
+
+	payload, err := json.Marshal(IncrementCounterReq{CounterID: req.CounterID, Delta: &handoff.Value, Epoch: &handoff.Epoch, OperationID: handoff.ID})
+	if err != nil {
+		endHandoff(cm.AbortHandoff, req.CounterID, handoff.ID)
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to marshal request payload", err.Error())
+		return
+	}
+	lb := loadbalancer.NewLoadBalancer(nil, nil, deps.EtcdManager)
+	target := &shardmetadata.Shard{ShardID: handoff.Target}
+	respBody, statusCode, err := lb.ForwardRequestToShard(r.Context(), http.MethodPut, target, shardIncrementUrl, payload, nil)
+	switch {
+	case err == nil:
+		endHandoff(cm.CompleteHandoff, req.CounterID, handoff.ID)
+		responsehandler.SendSuccessResponse(w, "Counter handed off successfully", resp)
+	case isStaleEpochResponse(respBody, statusCode):
+		// The counter was reset since the value was written; it no longer counts.
+		endHandoff(cm.CompleteHandoff, req.CounterID, handoff.ID)
+		resp.Moved = 0
+		responsehandler.SendSuccessResponse(w, "Discarded value from an older epoch", resp)
+	case notApplied(statusCode, err):
+		endHandoff(cm.AbortHandoff, req.CounterID, handoff.ID)
+		sendForwardError(w, "Failed to hand off to target shard", respBody, statusCode, err)
+	default:
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Hand-off to target shard is unconfirmed", fmt.Sprintf("%v; hand-off %s stays pending until it is retried", err, handoff.ID))
+	}
+}
+
+// notApplied reports whether a failed request to a shard definitely did not
+// change it: the shard rejected it, or it was never sent because the
+// connection was refused. Any other failure may have happened after the shard
+// applied it.
+func notApplied(statusCode int, err error) bool {
+	if statusCode >= 400 && statusCode < 500 {
+		return true
+	}
+	return statusCode == 0 && errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// endHandoff ends a hand-off with end, logging failures: a hand-off that
+// could not be ended stays pending and is resolved by the next request.
+func endHandoff(end func(counterID, id string) error, counterID, id string) {
+	if err := end(counterID, id); err != nil {
+		log.Printf("Failed to end hand-off %s of counter %s: %v", id, counterID, err)
+	}
+}
+
+// isStaleEpochResponse reports whether a shard rejected a mutation because the
+// counter has been reset since.
+func isStaleEpochResponse(respBody string, statusCode int) bool {
+	if statusCode != http.StatusConflict {
+		return false
+	}
+	response := &responsehandler.Response{}
+	return json.Unmarshal([]byte(respBody), response) == nil && response.Error != nil && response.Error.Details == counter.ErrStaleEpoch.Error()
+}
@@ -0,0 +1,83 @@
+package server_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sharded-counters/internal/rebalancer"
+	"sharded-counters/internal/server"
+	"testing"
+)
+
+func TestHandoffIsIdempotent(t *testing.T) {
+	c := newTestCluster(t, "shard1", "shard2")
+	source, target := c.shards["shard1"], c.shards["shard2"]
+	source.counters.Add("moving", 5)
+
+	handoff := func(t *testing.T, counterID string) (int, *rebalancer.HandoffResponse) {
+		t.Helper()
+		resp := &rebalancer.HandoffResponse{}
+		req := rebalancer.HandoffRequest{CounterID: counterID, TargetShard: "shard2"}
+		deps := *c.deps
+		deps.CounterManager = source.counters
+		code, _ := serve(t, &deps, server.HandoffShardCounterHandler, http.MethodPost, "/counter/shard/handoff", req, resp)
+		return code, resp
+	}
+
+	// Test Case 1: A value the target applied before its response was lost stays pending
+	t.Run("Lost Response", func(t *testing.T) {
+		target.setIntercept(func(w http.ResponseWriter, r *http.Request) {
+			target.router.ServeHTTP(httptest.NewRecorder(), r)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				t.Errorf("Hijack failed: %v", err)
+				return
+			}
+			conn.Close()
+		})
+		defer target.setIntercept(nil)
+
+		if code, _ := handoff(t, "moving"); code != http.StatusInternalServerError {
+			t.Errorf("Expected the unconfirmed hand-off to fail, got %d", code)
+		}
+		if value := source.counters.Get("moving"); value != 0 {
+			t.Errorf("Expected the source to keep the value pending, got %d", value)
+		}
+		if value := target.counters.Get("moving"); value != 5 {
+			t.Errorf("Expected the target to have applied 5, got %d", value)
+		}
+	})
+
+	// Test Case 2: The retry resends the pending hand-off, which the target applies only once
+	t.Run("Retry", func(t *testing.T) {
+		source.counters.Add("moving", 2)
+		code, resp := handoff(t, "moving")
+		if code != http.StatusOK || resp.Moved != 5 {
+			t.Fatalf("Expected the pending 5 to be confirmed, got %d: %+v", code, resp)
+		}
+		if value := target.counters.Get("moving"); value != 5 {
+			t.Errorf("Expected the target to stay at 5, got %d", value)
+		}
+		code, resp = handoff(t, "moving")
+		if code != http.StatusOK || resp.Moved != 2 {
+			t.Fatalf("Expected the next hand-off to move 2, got %d: %+v", code, resp)
+		}
+		if value := target.counters.Get("moving"); value != 7 {
+			t.Errorf("Expected the target to hold 7, got %d", value)
+		}
+	})
+
+	// Test Case 3: A value the target rejects is put back on the source
+	t.Run("Rejected", func(t *testing.T) {
+		source.counters.Add("deleted", 3)
+		target.counters.Delete("deleted")
+		if code, _ := handoff(t, "deleted"); code != http.StatusGone {
+			t.Errorf("Expected the target's 410 to be relayed, got %d", code)
+		}
+		if value := source.counters.Get("deleted"); value != 3 {
+			t.Errorf("Expected the source to get 3 back, got %d", value)
+		}
+		if code, _ := handoff(t, "deleted"); code != http.StatusGone {
+			t.Errorf("Expected a new hand-off to be rejected again, got %d", code)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	countermetadata "sharded-counters/internal/counter_metadata"
+	"sharded-counters/internal/middleware"
+	"sharded-counters/internal/responsehandler"
+	"strconv"
+)
+
+const (
+	defaultListLimit = 50
+	maxListLimit     = 500
+)
+
+// CounterListItem is a counter in a listing, optionally with its current value.
+type CounterListItem struct {
+	CounterResponse
+	Value      *int64 `json:"value,omitempty"`
+	ValueError string `json:"value_error,omitempty"`
+}
+
+// CounterListResponse represents a page of counters.
+type CounterListResponse struct {
+	Counters   []CounterListItem `json:"counters"`
+	NextCursor string            `json:"next_cursor,omitempty"`
+}
+
+// ListCountersHandler returns a page of counters. Pages are requested with the
+// `cursor` returned by the previous page; `name_prefix` restricts the listing
+// to named counters and `include_values=true` adds every counter's total.
+func ListCountersHandler(w http.ResponseWriter, r *http.Request) {
+	// Retrieve dependencies from context.
+	deps, err := middleware.GetDependenciesFromContext(r.Context())
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to retrieve dependencies", err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if rawLimit := query.Get("limit"); rawLimit != "" {
+		limit, err = strconv.Atoi(rawLimit)
+		if err != nil || limit < 1 || limit > maxListLimit {
+			responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid limit", "limit must be between 1 and "+strconv.Itoa(maxListLimit))
+			return
+		}
+	}
+
+	page, err := countermetadata.ListCounters(r.Context(), deps.EtcdManager, countermetadata.ListOptions{
+		NamePrefix: query.Get("name_prefix"),
+		Cursor:     query.Get("cursor"),
+		Limit:      limit,
+	})
+	if errors.Is(err, countermetadata.ErrInvalidCursor) {
+		responsehandler.SendErrorResponse(w, http.StatusBadRequest, "Invalid cursor", err.Error())
+		return
+	}
+	if err != nil {
+		responsehandler.SendErrorResponse(w, http.StatusInternalServerError, "Failed to list counters", err.Error())
+		return
+	}
+
+	resp := CounterListResponse{Counters: make([]CounterListItem, len(page.Records)), NextCursor: page.NextCursor}
+	for i, record := range page.Records {
+		resp.Counters[i] = CounterListItem{CounterResponse: newCounterResponse(record)}
+	}
+
+	if query.Get("include_values") == "true" {
+		records := make(map[string]*countermetadata.CounterRecord, len(page.Records))
+		for _, record := range page.Records {
+			records[record.CounterID] = record
+		}
+		totals := sumCounterValues(r.Context(), deps, records)
+		for i := range resp.Counters {
+			total := totals[resp.Counters[i].CounterID]
+			if total.Error != "" {
+				resp.Counters[i].ValueError = total.Error
+				continue
+			}
+			value := total.Value
+			resp.Counters[i].Value = &value
+		}
+	}
+
+	responsehandler.SendSuccessResponse(w, "Counters listed successfully", resp)
+}
@@ -0,0 +1,70 @@
+package server_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sharded-counters/internal/server"
+	"testing"
+)
+
+func TestListCountersCursor(t *testing.T) {
+	c := newTestCluster(t, "shard1")
+	for i := 0; i < 5; i++ {
+		c.createCounter(t, fmt.Sprintf("counter-%d", i), "shard1")
+	}
+	c.shards["shard1"].counters.Add("counter-3", 9)
+
+	list := func(t *testing.T, query url.Values) (int, *server.CounterListResponse) {
+		t.Helper()
+		resp := &server.CounterListResponse{}
+		code, _ := serve(t, c.deps, server.ListCountersHandler, http.MethodGet, "/counters?"+query.Encode(), nil, resp)
+		return code, resp
+	}
+
+	// Test Case 1: Following the cursors lists every counter once, in order
+	t.Run("Pages", func(t *testing.T) {
+		var listed []string
+		query := url.Values{"limit": {"2"}}
+		for pages := 1; ; pages++ {
+			code, resp := list(t, query)
+			if code != http.StatusOK {
+				t.Fatalf("Expected page %d to be listed, got %d", pages, code)
+			}
+			for _, item := range resp.Counters {
+				listed = append(listed, item.CounterID)
+			}
+			if resp.NextCursor == "" {
+				if pages != 3 {
+					t.Errorf("Expected 3 pages, got %d", pages)
+				}
+				break
+			}
+			query.Set("cursor", resp.NextCursor)
+		}
+		if fmt.Sprint(listed) != "[counter-0 counter-1 counter-2 counter-3 counter-4]" {
+			t.Errorf("Expected every counter once, got %v", listed)
+		}
+	})
+
+	// Test Case 2: Values are only added on request
+	t.Run("Values", func(t *testing.T) {
+		_, resp := list(t, url.Values{"limit": {"5"}, "include_values": {"true"}})
+		if value := resp.Counters[3].Value; value == nil || *value != 9 {
+			t.Errorf("Expected counter-3 to be 9, got %v", value)
+		}
+		_, resp = list(t, url.Values{"limit": {"5"}})
+		if resp.Counters[3].Value != nil {
+			t.Errorf("Expected no values, got %d", *resp.Counters[3].Value)
+		}
+	})
+
+	// Test Case 3: Malformed cursors and limits are rejected
+	t.Run("Invalid", func(t *testing.T) {
+		for _, query := range []url.Values{{"cursor": {"not-a-cursor!"}}, {"limit": {"0"}}, {"limit": {"501"}}} {
+			if code, _ := list(t, query); code != http.StatusBadRequest {
+				t.Errorf("Expected 400 for %v, got %d", query, code)
+			}
+		}
+	})
+}
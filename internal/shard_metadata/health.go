@@ -0,0 +1,128 @@
+package shardmetadata
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// Health values reported by shards.
+const (
+	HealthOK       = "ok"        // Serving reads and writes.
+	HealthDegraded = "degraded"  // Serving reads and writes, but struggling: writes go elsewhere when possible.
+	HealthDraining = "draining"  // Shutting down: still serves reads and hand-offs, but takes no new writes.
+	HealthReadOnly = "read-only" // Cannot take writes safely, but still serves reads.
+	HealthDown     = "down"      // Failing most requests: takes no traffic.
+)
+
+// Thresholds of the self-checks.
+const (
+	memoryDegradedPercent = 85.0
+	memoryReadOnlyPercent = 95.0
+	errorRateDegraded     = 0.05
+	errorRateDown         = 0.5
+	// minRequestsForErrorRate keeps a handful of failures on an idle shard
+	// from changing its health.
+	minRequestsForErrorRate = 20
+)
+
+// AcceptsWrites reports whether a shard in the given health takes new writes.
+func AcceptsWrites(health string) bool {
+	return health == HealthOK || health == HealthDegraded
+}
+
+// AcceptsReads reports whether a shard in the given health serves reads.
+func AcceptsReads(health string) bool {
+	return AcceptsWrites(health) || health == HealthDraining || health == HealthReadOnly
+}
+
+// draining is set once the local shard starts shutting down.
+var draining atomic.Bool
+
+// healthChanged wakes StoreMetrics to publish a health change right away.
+var healthChanged = make(chan struct{}, 1)
+
+// SetDraining marks the local shard as draining in the metrics it publishes.
+// The change is published immediately rather than on the next interval.
+func SetDraining(value bool) {
+	if draining.Swap(value) == value {
+		return
+	}
+	select {
+	case healthChanged <- struct{}{}:
+	default:
+	}
+}
+
+// IsDraining reports whether the local shard is draining.
+func IsDraining() bool {
+	return draining.Load()
+}
+
+// evaluatedHealth is the health of the local shard's last self-check.
+var evaluatedHealth atomic.Pointer[string]
+
+// CurrentHealth returns the local shard's health: draining as soon as it
+// starts shutting down, and otherwise the health of its last self-check. A
+// shard that has not checked itself yet is ok.
+func CurrentHealth() string {
+	if IsDraining() {
+		return HealthDraining
+	}
+	if health := evaluatedHealth.Load(); health != nil {
+		return *health
+	}
+	return HealthOK
+}
+
+// walCheck reports whether the local shard can still log mutations.
+var walCheck atomic.Pointer[func() error]
+
+// SetWALCheck registers the check of the local shard's write-ahead log.
+func SetWALCheck(check func() error) {
+	walCheck.Store(&check)
+}
+
+// HealthChecks are the results of a shard's self-checks.
+type HealthChecks struct {
+	Draining       bool
+	WALErr         error   // Why mutations cannot be logged, if they cannot.
+	MemoryPercent  float64 // Memory in use, as a percentage of what is available.
+	Requests       int64   // Requests served since the last check.
+	FailedRequests int64   // Requests among them that failed.
+}
+
+// EvaluateHealth derives a shard's health from its self-checks, along with the
+// reasons it is not ok.
+func EvaluateHealth(checks HealthChecks) (string, []string) {
+	if checks.Draining {
+		return HealthDraining, []string{"shutting down"}
+	}
+	errorRate := 0.0
+	if checks.Requests >= minRequestsForErrorRate {
+		errorRate = float64(checks.FailedRequests) / float64(checks.Requests)
+	}
+	if errorRate >= errorRateDown {
+		return HealthDown, []string{fmt.Sprintf("%.0f%% of requests failed", errorRate*100)}
+	}
+
+	var readOnly, degraded []string
+	if checks.WALErr != nil {
+		readOnly = append(readOnly, fmt.Sprintf("WAL is not writable: %v", checks.WALErr))
+	}
+	switch {
+	case checks.MemoryPercent >= memoryReadOnlyPercent:
+		readOnly = append(readOnly, fmt.Sprintf("memory %.0f%% used", checks.MemoryPercent))
+	case checks.MemoryPercent >= memoryDegradedPercent:
+		degraded = append(degraded, fmt.Sprintf("memory %.0f%% used", checks.MemoryPercent))
+	}
+	if errorRate >= errorRateDegraded {
+		degraded = append(degraded, fmt.Sprintf("%.0f%% of requests failed", errorRate*100))
+	}
+	if len(readOnly) > 0 {
+		return HealthReadOnly, append(readOnly, degraded...)
+	}
+	if len(degraded) > 0 {
+		return HealthDegraded, degraded
+	}
+	return HealthOK, nil
+}
@@ -0,0 +1,35 @@
+package shardmetadata_test
+
+import (
+	"errors"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"testing"
+)
+
+func TestEvaluateHealth(t *testing.T) {
+	tests := []struct {
+		name   string
+		checks shardmetadata.HealthChecks
+		want   string
+	}{
+		{"Healthy", shardmetadata.HealthChecks{MemoryPercent: 40, Requests: 100, FailedRequests: 1}, shardmetadata.HealthOK},
+		{"Few Requests", shardmetadata.HealthChecks{Requests: 3, FailedRequests: 3}, shardmetadata.HealthOK},
+		{"Memory Pressure", shardmetadata.HealthChecks{MemoryPercent: 90}, shardmetadata.HealthDegraded},
+		{"Errors", shardmetadata.HealthChecks{Requests: 100, FailedRequests: 10}, shardmetadata.HealthDegraded},
+		{"Memory Exhausted", shardmetadata.HealthChecks{MemoryPercent: 97}, shardmetadata.HealthReadOnly},
+		{"WAL Failing", shardmetadata.HealthChecks{WALErr: errors.New("disk full"), Requests: 100, FailedRequests: 10}, shardmetadata.HealthReadOnly},
+		{"Mostly Failing", shardmetadata.HealthChecks{WALErr: errors.New("disk full"), Requests: 100, FailedRequests: 60}, shardmetadata.HealthDown},
+		{"Draining", shardmetadata.HealthChecks{Draining: true, MemoryPercent: 97}, shardmetadata.HealthDraining},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			health, reasons := shardmetadata.EvaluateHealth(tc.checks)
+			if health != tc.want {
+				t.Errorf("Expected %s, got %s (%v)", tc.want, health, reasons)
+			}
+			if (health == shardmetadata.HealthOK) != (len(reasons) == 0) {
+				t.Errorf("Expected reasons only when not ok, got %v", reasons)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package shardmetadata
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/shirou/gopsutil/mem"
+)
+
+// maxLatencySamples bounds the request latencies kept between two
+// publications of the shard's metrics to estimate their p99.
+const maxLatencySamples = 1024
+
+// counterCount returns the number of counters the local shard holds.
+var counterCount atomic.Pointer[func() int]
+
+// SetCounterCount registers the function that counts the local shard's counters.
+func SetCounterCount(count func() int) {
+	counterCount.Store(&count)
+}
+
+// inFlight is the number of requests the local shard is serving.
+var inFlight atomic.Int64
+
+// window accumulates the requests the local shard served since its metrics
+// were last published.
+var window = &requestWindow{start: time.Now()}
+
+type requestWindow struct {
+	mu        sync.Mutex
+	start     time.Time
+	requests  int64
+	failed    int64
+	latencies []time.Duration // A uniform sample of the window's latencies.
+}
+
+// requestStats summarises the requests of a window.
+type requestStats struct {
+	requests int64
+	failed   int64
+	rate     float64 // Requests per second.
+	p99      time.Duration
+}
+
+// TrackRequest counts a request served by the local shard as in flight. The
+// returned function ends the request, counting it towards the shard's request
+// rate, latency and error rate. Server errors count as failures, except 503s:
+// those are requests the shard refused because of its health, and counting
+// them would keep it from ever recovering.
+func TrackRequest() func(statusCode int) {
+	start := time.Now()
+	inFlight.Add(1)
+	return func(statusCode int) {
+		inFlight.Add(-1)
+		window.record(time.Since(start), statusCode >= 500 && statusCode != http.StatusServiceUnavailable)
+	}
+}
+
+func (w *requestWindow) record(latency time.Duration, failed bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.requests++
+	if failed {
+		w.failed++
+	}
+	if len(w.latencies) < maxLatencySamples {
+		w.latencies = append(w.latencies, latency)
+	} else if i := rand.Int63n(w.requests); i < maxLatencySamples {
+		w.latencies[i] = latency
+	}
+}
+
+// reset summarises the window and starts a new one.
+func (w *requestWindow) reset(now time.Time) requestStats {
+	w.mu.Lock()
+	stats := requestStats{requests: w.requests, failed: w.failed}
+	latencies := w.latencies
+	elapsed := now.Sub(w.start)
+	w.start, w.requests, w.failed, w.latencies = now, 0, 0, nil
+	w.mu.Unlock()
+
+	if elapsed > 0 {
+		stats.rate = float64(stats.requests) / elapsed.Seconds()
+	}
+	if len(latencies) > 0 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		stats.p99 = latencies[int(math.Ceil(0.99*float64(len(latencies))))-1]
+	}
+	return stats
+}
+
+// memoryPercent returns the memory in use as a percentage of the Go memory
+// limit when one is set (GOMEMLIMIT), or of the system's memory otherwise.
+func memoryPercent() (float64, error) {
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		return float64(stats.Sys-stats.HeapReleased) / float64(limit) * 100, nil
+	}
+	vm, err := mem.VirtualMemory()
+	if err != nil {
+		return 0, err
+	}
+	return vm.UsedPercent, nil
+}
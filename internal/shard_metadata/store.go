@@ -1,6 +1,7 @@
 package shardmetadata
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -13,14 +14,84 @@ import (
 
 const shardPrefix = "shards"
 
+// ShardKeyPrefix is the etcd prefix under which shards register themselves.
+const ShardKeyPrefix = shardPrefix + "/"
+
 type Shard struct {
-	ShardID        string  `json:"shard_id"`
-	CPUUtilization float64 `json:"cpu_utilization"`
-	Health         string  `json:"health"`
-	UpdatedTime    string  `json:"updated_time"`
+	ShardID        string   `json:"shard_id"`
+	CPUUtilization float64  `json:"cpu_utilization"`
+	MemoryPercent  float64  `json:"memory_percent"`
+	Counters       int      `json:"counters"`           // Counters held by the shard.
+	RequestRate    float64  `json:"request_rate"`       // Requests per second since the previous publication.
+	P99LatencyMs   float64  `json:"p99_latency_ms"`     // Of the requests since the previous publication.
+	InFlight       int64    `json:"in_flight_requests"` // Requests being served when the metrics were published.
+	Health         string   `json:"health"`
+	HealthReasons  []string `json:"health_reasons,omitempty"` // Why the shard is not ok.
+	UpdatedTime    string   `json:"updated_time"`
+}
+
+// Load signals a shard publishes, by which writes can be routed.
+const (
+	SignalCPU         = "cpu"
+	SignalMemory      = "memory"
+	SignalCounters    = "counters"
+	SignalRequestRate = "request_rate"
+	SignalLatency     = "latency"
+	SignalInFlight    = "in_flight"
+)
+
+// Signals lists every load signal a shard publishes.
+var Signals = []string{SignalCPU, SignalMemory, SignalCounters, SignalRequestRate, SignalLatency, SignalInFlight}
+
+// Signal returns the value of a load signal, and false if the signal is unknown.
+func (s *Shard) Signal(name string) (float64, bool) {
+	switch name {
+	case SignalCPU:
+		return s.CPUUtilization, true
+	case SignalMemory:
+		return s.MemoryPercent, true
+	case SignalCounters:
+		return float64(s.Counters), true
+	case SignalRequestRate:
+		return s.RequestRate, true
+	case SignalLatency:
+		return s.P99LatencyMs, true
+	case SignalInFlight:
+		return float64(s.InFlight), true
+	}
+	return 0, false
 }
 
-func FetchAndStoreMetrics(manager etcd.Manager, shardID string) error {
+// MetricsAge returns how long before now the shard published its metrics,
+// and false if the metrics carry no valid timestamp.
+func (s *Shard) MetricsAge(now time.Time) (time.Duration, bool) {
+	updated, err := time.Parse(time.RFC3339Nano, s.UpdatedTime)
+	if err != nil {
+		return 0, false
+	}
+	return now.Sub(updated), true
+}
+
+// IsStale reports whether the shard's metrics are older than maxAge, or of
+// unknown age. A maxAge of zero trusts metrics of any age.
+func (s *Shard) IsStale(now time.Time, maxAge time.Duration) bool {
+	if maxAge <= 0 {
+		return false
+	}
+	age, ok := s.MetricsAge(now)
+	return !ok || age > maxAge
+}
+
+// leaseTTL is how long a shard stays registered once its lease can no longer
+// be kept alive.
+const leaseTTL = 6 * time.Second
+
+// reregisterDelay is the pause before a shard that lost its lease registers
+// again.
+const reregisterDelay = time.Second
+
+// FetchAndStoreMetrics publishes the shard's current metrics under lease.
+func FetchAndStoreMetrics(ctx context.Context, lease etcd.Lease, shardID string) error {
 	utilizations, err := cpu.Percent(0, false)
 	if err != nil {
 		return fmt.Errorf("error fetching CPU utilization: %w", err)
@@ -31,11 +102,40 @@ func FetchAndStoreMetrics(manager etcd.Manager, shardID string) error {
 		utilization = utilizations[0]
 	}
 
+	memory, err := memoryPercent()
+	if err != nil {
+		log.Printf("Error fetching memory usage: %v", err)
+	}
+	counters := 0
+	if count := counterCount.Load(); count != nil {
+		counters = (*count)()
+	}
+	now := time.Now()
+	requests := window.reset(now)
+
+	checks := HealthChecks{
+		Draining:       IsDraining(),
+		MemoryPercent:  memory,
+		Requests:       requests.requests,
+		FailedRequests: requests.failed,
+	}
+	if check := walCheck.Load(); check != nil {
+		checks.WALErr = (*check)()
+	}
+	health, reasons := EvaluateHealth(checks)
+	evaluatedHealth.Store(&health)
+
 	metrics := Shard{
 		ShardID:        shardID,
 		CPUUtilization: utilization,
-		Health:         "ok",
-		UpdatedTime:    time.Now().Format(time.RFC3339),
+		MemoryPercent:  memory,
+		Counters:       counters,
+		RequestRate:    requests.rate,
+		P99LatencyMs:   float64(requests.p99) / float64(time.Millisecond),
+		InFlight:       inFlight.Load(),
+		Health:         health,
+		HealthReasons:  reasons,
+		UpdatedTime:    now.Format(time.RFC3339Nano),
 	}
 
 	key := fmt.Sprintf("%s/%s", shardPrefix, shardID) // Overwrite previous value for the shard
@@ -44,33 +144,78 @@ func FetchAndStoreMetrics(manager etcd.Manager, shardID string) error {
 		return fmt.Errorf("error marshaling metrics: %w", err)
 	}
 
-	err = manager.SaveMetadataWithLease(key, string(value), 6*time.Second)
+	err = lease.Put(ctx, key, string(value))
 	if err != nil {
 		return fmt.Errorf("error storing metrics in etcd: %w", err)
 	}
 
-	log.Printf("Stored metrics in etcd with TTL: %s = %s", key, value)
+	log.Printf("Stored metrics in etcd: %s = %s", key, value)
 	return nil
 }
 
-func StoreMetrics(manager etcd.Manager, shardID string, interval time.Duration) {
+// StoreMetrics registers the shard under one lease, kept alive for as long as
+// the shard runs, and publishes its metrics under that lease every interval.
+// If the lease is lost, for example because etcd could not be reached for
+// longer than its TTL, the shard registers again under a new lease. When ctx
+// is done the lease is revoked, which removes the shard from the registry.
+// Health changes made with SetDraining are published without waiting for the
+// next interval.
+func StoreMetrics(ctx context.Context, manager etcd.Manager, shardID string, interval time.Duration) {
+	for {
+		err := register(ctx, manager, shardID, interval)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Shard registration lost, registering again: %v", err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reregisterDelay):
+		}
+	}
+}
+
+// register publishes the shard's metrics under a new lease until the lease is
+// lost or ctx is done.
+func register(ctx context.Context, manager etcd.Manager, shardID string, interval time.Duration) error {
+	lease, err := manager.GrantLease(ctx, leaseTTL)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if ctx.Err() == nil {
+			return // The lease is already lost.
+		}
+		if err := lease.Revoke(context.WithoutCancel(ctx)); err != nil {
+			log.Printf("Error revoking shard lease: %v", err)
+		}
+	}()
+
+	if err := FetchAndStoreMetrics(ctx, lease, shardID); err != nil {
+		log.Printf("Error during metrics storage: %v", err)
+	}
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-lease.Done():
+			return fmt.Errorf("lease expired")
 		case <-ticker.C:
-			if err := FetchAndStoreMetrics(manager, shardID); err != nil {
-				log.Printf("Error during metrics storage: %v", err)
-			}
+		case <-healthChanged:
+		}
+		if err := FetchAndStoreMetrics(ctx, lease, shardID); err != nil {
+			log.Printf("Error during metrics storage: %v", err)
 		}
 	}
 }
 
 // GetAliveShards retrieves all shard keys from etcd and returns list of shard objects.
-func GetAliveShards(manager etcd.Manager) ([]*Shard, error) {
+func GetAliveShards(ctx context.Context, manager etcd.Manager) ([]*Shard, error) {
 	// Retrieve key values with the specified prefix from etcd
-	keys, err := manager.GetKeysWithPrefix(shardPrefix)
+	keys, err := manager.GetKeysWithPrefix(ctx, shardPrefix)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching shard keys from etcd: %w", err)
 	}
@@ -90,11 +235,11 @@ func GetAliveShards(manager etcd.Manager) ([]*Shard, error) {
 	return healthyShards, nil
 }
 
-func GetShardMetrics(manager etcd.Manager, shardID string) (*Shard, error) {
+func GetShardMetrics(ctx context.Context, manager etcd.Manager, shardID string) (*Shard, error) {
 	// Construct the key for the shard in etcd.
 	key := fmt.Sprintf("%s/%s", shardPrefix, shardID)
 	// Retrieve shard metadata from etcd.
-	value, err := manager.Get(key)
+	value, err := manager.Get(ctx, key)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,128 @@
+package shardmetadata_test
+
+import (
+	"context"
+	"sharded-counters/internal/etcd"
+	"sharded-counters/internal/etcd/etcdtest"
+	shardmetadata "sharded-counters/internal/shard_metadata"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for condition")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func registered(m *etcdtest.Manager, shardID string) bool {
+	_, err := m.Get(context.Background(), shardmetadata.ShardKeyPrefix+shardID)
+	return !etcd.IsKeyNotFound(err)
+}
+
+func TestStoreMetrics(t *testing.T) {
+	m := etcdtest.NewManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		shardmetadata.StoreMetrics(ctx, m, "shard1", 50*time.Millisecond)
+	}()
+
+	// Test Case 1: The shard registers immediately
+	waitFor(t, func() bool { return registered(m, "shard1") })
+
+	// Test Case 2: Metrics are republished every interval
+	t.Run("Updates", func(t *testing.T) {
+		before := m.Revision()
+		waitFor(t, func() bool { return m.Revision() >= before+2 })
+		shards, err := shardmetadata.GetAliveShards(ctx, m)
+		if err != nil || len(shards) != 1 {
+			t.Fatalf("Expected one alive shard, got %v (%v)", shards, err)
+		}
+	})
+
+	// Test Case 3: The shard registers again after losing its lease
+	t.Run("Lease Lost", func(t *testing.T) {
+		m.Expire(shardmetadata.ShardKeyPrefix + "shard1")
+		if registered(m, "shard1") {
+			t.Fatal("Expected the shard to vanish with its lease")
+		}
+		waitFor(t, func() bool { return registered(m, "shard1") })
+	})
+
+	// Test Case 4: Stopping revokes the lease
+	t.Run("Stop", func(t *testing.T) {
+		cancel()
+		<-done
+		if registered(m, "shard1") {
+			t.Error("Expected the shard to be deregistered on stop")
+		}
+	})
+}
+
+func TestStoreMetricsPublishesDraining(t *testing.T) {
+	m := etcdtest.NewManager()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	defer shardmetadata.SetDraining(false)
+	go shardmetadata.StoreMetrics(ctx, m, "shard1", time.Hour)
+	waitFor(t, func() bool { return registered(m, "shard1") })
+
+	// The next interval is an hour away, so the change must be pushed.
+	shardmetadata.SetDraining(true)
+	waitFor(t, func() bool {
+		shard, err := shardmetadata.GetShardMetrics(ctx, m, "shard1")
+		return err == nil && shard.Health == shardmetadata.HealthDraining
+	})
+}
+
+func TestFetchAndStoreMetricsPublishesLoad(t *testing.T) {
+	m := etcdtest.NewManager()
+	ctx := context.Background()
+	lease, err := m.GrantLease(ctx, 6*time.Second)
+	if err != nil {
+		t.Fatalf("GrantLease failed: %v", err)
+	}
+	shardmetadata.SetCounterCount(func() int { return 7 })
+	defer shardmetadata.SetCounterCount(func() int { return 0 })
+
+	// Start a window of its own, then serve three requests, one still running.
+	if err := shardmetadata.FetchAndStoreMetrics(ctx, lease, "shard1"); err != nil {
+		t.Fatalf("FetchAndStoreMetrics failed: %v", err)
+	}
+	shardmetadata.TrackRequest()(200)
+	shardmetadata.TrackRequest()(500)
+	finish := shardmetadata.TrackRequest()
+	defer finish(200)
+
+	if err := shardmetadata.FetchAndStoreMetrics(ctx, lease, "shard1"); err != nil {
+		t.Fatalf("FetchAndStoreMetrics failed: %v", err)
+	}
+	shard, err := shardmetadata.GetShardMetrics(ctx, m, "shard1")
+	if err != nil {
+		t.Fatalf("GetShardMetrics failed: %v", err)
+	}
+	if shard.Counters != 7 {
+		t.Errorf("Expected 7 counters, got %d", shard.Counters)
+	}
+	if shard.InFlight != 1 {
+		t.Errorf("Expected 1 request in flight, got %d", shard.InFlight)
+	}
+	if shard.RequestRate <= 0 {
+		t.Errorf("Expected a positive request rate, got %v", shard.RequestRate)
+	}
+	if shard.MemoryPercent <= 0 {
+		t.Errorf("Expected memory usage to be published, got %v", shard.MemoryPercent)
+	}
+	for _, signal := range shardmetadata.Signals {
+		if _, ok := shard.Signal(signal); !ok {
+			t.Errorf("Expected signal %s to be known", signal)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+package counter
+
+// LogAdd appends an add of delta to the WAL without applying it, as an add
+// that raced a Delete of the counter would.
+func (cm *CounterManager) LogAdd(counterID string, delta int64) error {
+	return cm.wal.Append(walRecord{Op: opAdd, CounterID: counterID, Delta: delta})
+}
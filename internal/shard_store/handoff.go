@@ -0,0 +1,199 @@
+package counter
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"sharded-counters/internal/utils"
+)
+
+// maxAppliedOperations bounds the operation IDs remembered by AddOnceAtEpoch.
+// Hand-offs are retried within a few rebalance passes, long before this many
+// newer ones evict their ID.
+const maxAppliedOperations = 10000
+
+// maxOperationIDLength bounds operation IDs, which are logged with each add.
+const maxOperationIDLength = 64
+
+// ErrInvalidOperationID is returned for an empty or overlong operation ID.
+var ErrInvalidOperationID = errors.New("operation ID must be 1 to 64 bytes")
+
+// Handoff is a counter's partial value on its way to another shard. The value
+// is taken out of the counter when the hand-off starts and stays pending
+// until the target confirms it or definitely did not apply it.
+type Handoff struct {
+	ID     string // Operation ID the target deduplicates the value by.
+	Target string // Shard the value is handed to.
+	Value  int64
+	Epoch  int64 // Reset epoch that Value belongs to.
+}
+
+// StartHandoff takes the counter's value out of the manager into a pending
+// hand-off to target. While a hand-off is pending it is returned again, with
+// its original ID and target, so that retries cannot apply the value twice.
+// A zero Value means there is nothing to hand off.
+func (cm *CounterManager) StartHandoff(counterID, target string) (Handoff, error) {
+	if len(target) > math.MaxUint16 {
+		return Handoff{}, fmt.Errorf("target shard ID is too long")
+	}
+	cm.mutations.RLock()
+	defer cm.mutations.RUnlock()
+
+	counter, ok := cm.counters.Load(counterID)
+	if !ok {
+		return Handoff{}, nil
+	}
+	c := counter.(*Counter)
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	if c.deleted {
+		return Handoff{}, nil
+	}
+	if c.handoff != nil {
+		return *c.handoff, nil
+	}
+	if c.Value == 0 {
+		return Handoff{Epoch: c.Epoch}, nil
+	}
+	if c.Value == math.MinInt64 {
+		return Handoff{Epoch: c.Epoch}, ErrOverflow // Cannot be restored as a negated delta.
+	}
+	id, err := newOperationID()
+	if err != nil {
+		return Handoff{}, err
+	}
+	handoff := Handoff{ID: id, Target: target, Value: c.Value, Epoch: c.Epoch}
+	if cm.wal != nil {
+		if err := cm.wal.Append(walRecord{Op: opHandoffStart, CounterID: counterID, Delta: handoff.Value, Epoch: handoff.Epoch, ID: id, Target: target}); err != nil {
+			return Handoff{}, err
+		}
+	}
+	c.Value = 0
+	c.handoff = &handoff
+	return handoff, nil
+}
+
+// CompleteHandoff ends the pending hand-off id once the target has the value,
+// or the value no longer counts.
+func (cm *CounterManager) CompleteHandoff(counterID, id string) error {
+	return cm.endHandoff(counterID, id, false)
+}
+
+// AbortHandoff ends the pending hand-off id when the target definitely did
+// not apply it, putting the value back. A value from an epoch the counter
+// has since moved past is dropped, as it no longer counts.
+func (cm *CounterManager) AbortHandoff(counterID, id string) error {
+	return cm.endHandoff(counterID, id, true)
+}
+
+// endHandoff ends the pending hand-off id, restoring its value if asked to.
+// Hand-offs that are no longer pending are ignored.
+func (cm *CounterManager) endHandoff(counterID, id string, restore bool) error {
+	cm.mutations.RLock()
+	defer cm.mutations.RUnlock()
+
+	counter, ok := cm.counters.Load(counterID)
+	if !ok {
+		return nil
+	}
+	c := counter.(*Counter)
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	if c.deleted || c.handoff == nil || c.handoff.ID != id {
+		return nil
+	}
+	rec := walRecord{Op: opHandoffEnd, CounterID: counterID, Epoch: c.handoff.Epoch, ID: id}
+	newValue := c.Value
+	if restore {
+		var ok bool
+		if newValue, ok = utils.CheckedAdd(c.Value, c.handoff.Value); !ok {
+			return ErrOverflow
+		}
+		rec.Delta = c.handoff.Value
+	}
+	if cm.wal != nil {
+		if err := cm.wal.Append(rec); err != nil {
+			return err
+		}
+	}
+	c.Value = newValue
+	c.handoff = nil
+	return nil
+}
+
+// AddOnceAtEpoch is like AddAtEpoch, but applies the delta only once per
+// operation ID, so that a hand-off retried after a lost response is not
+// counted twice. A repeated operation returns the current value.
+func (cm *CounterManager) AddOnceAtEpoch(counterID, operationID string, epoch, delta int64) (int64, error) {
+	if operationID == "" || len(operationID) > maxOperationIDLength {
+		return 0, ErrInvalidOperationID
+	}
+	if delta == 0 {
+		return cm.AddAtEpoch(counterID, epoch, 0) // Nothing to apply twice.
+	}
+	return cm.add(counterID, &epoch, delta, operationID)
+}
+
+// isApplied reports whether the operation ID has been applied.
+func (cm *CounterManager) isApplied(operationID string) bool {
+	cm.appliedMu.Lock()
+	defer cm.appliedMu.Unlock()
+	_, ok := cm.applied[operationID]
+	return ok
+}
+
+// markApplied remembers the operation ID, forgetting the oldest one once
+// maxAppliedOperations are remembered.
+func (cm *CounterManager) markApplied(operationID string) {
+	cm.appliedMu.Lock()
+	defer cm.appliedMu.Unlock()
+	if _, ok := cm.applied[operationID]; ok {
+		return
+	}
+	if cm.applied == nil {
+		cm.applied = make(map[string]struct{})
+	}
+	if len(cm.appliedOrder) >= maxAppliedOperations {
+		delete(cm.applied, cm.appliedOrder[0])
+		cm.appliedOrder = cm.appliedOrder[1:]
+	}
+	cm.applied[operationID] = struct{}{}
+	cm.appliedOrder = append(cm.appliedOrder, operationID)
+}
+
+// newOperationID returns a random hand-off ID.
+func newOperationID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("failed to generate operation ID: %w", err)
+	}
+	return hex.EncodeToString(id[:]), nil
+}
+
+// carryForward logs the pending hand-offs and applied operation IDs again, so
+// that they outlive the segments a snapshot compacts. It must be called with
+// mutations blocked, right after the WAL is rotated.
+func (cm *CounterManager) carryForward() error {
+	var records []walRecord
+	cm.counters.Range(func(key, value any) bool {
+		if h := value.(*Counter).handoff; h != nil {
+			records = append(records, walRecord{Op: opHandoffPending, CounterID: key.(string), Delta: h.Value, Epoch: h.Epoch, ID: h.ID, Target: h.Target})
+		}
+		return true
+	})
+	cm.appliedMu.Lock()
+	for _, id := range cm.appliedOrder {
+		records = append(records, walRecord{Op: opAddOnce, ID: id})
+	}
+	cm.appliedMu.Unlock()
+	for _, rec := range records {
+		if err := cm.wal.Append(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
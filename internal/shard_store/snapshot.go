@@ -0,0 +1,360 @@
+package counter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Snapshot files are laid out as
+//
+//	[magic "SCSNAP"][version uint16][seq uint64][created unix nanos int64][count uint64]
+//	count x [id length uint16][id bytes][value int64][epoch int64]
+//	[tombstone count uint64] tombstone count x [id length uint16][id bytes]
+//	[crc32 uint32 of everything before it]
+//
+// A snapshot with sequence number N holds the state after every record in WAL
+// segments up to and including N.
+const (
+	snapshotMagic   = "SCSNAP"
+	snapshotVersion = 3
+	snapshotPrefix  = "snapshot-"
+	snapshotSuffix  = ".snap"
+)
+
+var errCorruptSnapshot = errors.New("corrupt snapshot")
+
+// SnapshotOptions configures periodic snapshotting of a CounterManager.
+type SnapshotOptions struct {
+	Interval    time.Duration // Take a snapshot at least this often; 0 disables the timer.
+	MaxWALBytes int64         // Take a snapshot once live WAL segments exceed this size; 0 disables.
+}
+
+// SnapshotStats describes the latest snapshot and the WAL written since.
+type SnapshotStats struct {
+	LastSnapshotAt time.Time `json:"last_snapshot_at,omitempty"`
+	AgeSeconds     float64   `json:"age_seconds"`
+	SizeBytes      int64     `json:"size_bytes"`
+	Counters       int       `json:"counters"`
+	WALSegments    int       `json:"wal_segments"`
+	WALBytes       int64     `json:"wal_bytes"`
+}
+
+// snapshot is the decoded content of a snapshot file.
+type snapshot struct {
+	Seq        uint64
+	CreatedAt  time.Time
+	Values     map[string]int64
+	Epochs     map[string]int64 // Reset epochs of counters; missing means 0.
+	Tombstones []string
+	Size       int64
+}
+
+func snapshotName(seq uint64) string {
+	return fmt.Sprintf("%s%016d%s", snapshotPrefix, seq, snapshotSuffix)
+}
+
+// listSnapshots returns the sequence numbers of all snapshots in dir, ascending.
+func listSnapshots(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list snapshot directory: %w", err)
+	}
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, snapshotPrefix) || !strings.HasSuffix(name, snapshotSuffix) {
+			continue
+		}
+		var seq uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, snapshotPrefix), snapshotSuffix), "%d", &seq); err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// loadLatestSnapshot reads the newest snapshot in dir. It returns nil when no
+// snapshot exists and an error when the newest one fails validation, since
+// the segments it covered have already been compacted away.
+func loadLatestSnapshot(dir string) (*snapshot, error) {
+	seqs, err := listSnapshots(dir)
+	if err != nil || len(seqs) == 0 {
+		return nil, err
+	}
+	path := filepath.Join(dir, snapshotName(seqs[len(seqs)-1]))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	snap, err := decodeSnapshot(data)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", path, err)
+	}
+	return snap, nil
+}
+
+func encodeSnapshot(seq uint64, createdAt time.Time, values, epochs map[string]int64, tombstones []string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(snapshotMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(snapshotVersion))
+	binary.Write(&buf, binary.BigEndian, seq)
+	binary.Write(&buf, binary.BigEndian, createdAt.UnixNano())
+	binary.Write(&buf, binary.BigEndian, uint64(len(values)))
+	for id, value := range values {
+		binary.Write(&buf, binary.BigEndian, uint16(len(id)))
+		buf.WriteString(id)
+		binary.Write(&buf, binary.BigEndian, value)
+		binary.Write(&buf, binary.BigEndian, epochs[id])
+	}
+	binary.Write(&buf, binary.BigEndian, uint64(len(tombstones)))
+	for _, id := range tombstones {
+		binary.Write(&buf, binary.BigEndian, uint16(len(id)))
+		buf.WriteString(id)
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func decodeSnapshot(data []byte) (*snapshot, error) {
+	if len(data) < len(snapshotMagic)+4 {
+		return nil, errCorruptSnapshot
+	}
+	body, trailer := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(trailer) {
+		return nil, errCorruptSnapshot
+	}
+	r := bytes.NewReader(body)
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != snapshotMagic {
+		return nil, errCorruptSnapshot
+	}
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, errCorruptSnapshot
+	}
+	if version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", version)
+	}
+
+	var header struct {
+		Seq       uint64
+		CreatedAt int64
+		Count     uint64
+	}
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, errCorruptSnapshot
+	}
+	values := make(map[string]int64)
+	epochs := make(map[string]int64)
+	for i := uint64(0); i < header.Count; i++ {
+		id, err := readSnapshotID(r)
+		if err != nil {
+			return nil, err
+		}
+		var value int64
+		if err := binary.Read(r, binary.BigEndian, &value); err != nil {
+			return nil, errCorruptSnapshot
+		}
+		var epoch int64
+		if err := binary.Read(r, binary.BigEndian, &epoch); err != nil {
+			return nil, errCorruptSnapshot
+		}
+		values[id] = value
+		epochs[id] = epoch
+	}
+	var count uint64
+	if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+		return nil, errCorruptSnapshot
+	}
+	var tombstones []string
+	for i := uint64(0); i < count; i++ {
+		id, err := readSnapshotID(r)
+		if err != nil {
+			return nil, err
+		}
+		tombstones = append(tombstones, id)
+	}
+	return &snapshot{
+		Seq:        header.Seq,
+		CreatedAt:  time.Unix(0, header.CreatedAt),
+		Values:     values,
+		Epochs:     epochs,
+		Tombstones: tombstones,
+		Size:       int64(len(data)),
+	}, nil
+}
+
+// readSnapshotID reads a length-prefixed counter ID.
+func readSnapshotID(r io.Reader) (string, error) {
+	var idLen uint16
+	if err := binary.Read(r, binary.BigEndian, &idLen); err != nil {
+		return "", errCorruptSnapshot
+	}
+	id := make([]byte, idLen)
+	if _, err := io.ReadFull(r, id); err != nil {
+		return "", errCorruptSnapshot
+	}
+	return string(id), nil
+}
+
+// writeSnapshot durably writes a snapshot file by writing to a temporary file
+// and renaming it into place. It returns the size of the file.
+func writeSnapshot(dir string, seq uint64, createdAt time.Time, values, epochs map[string]int64, tombstones []string) (int64, error) {
+	data := encodeSnapshot(seq, createdAt, values, epochs, tombstones)
+	tmp, err := os.CreateTemp(dir, snapshotPrefix+"*.tmp")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, snapshotName(seq))); err != nil {
+		return 0, fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	if err := syncDir(dir); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// removeSnapshotsBefore deletes every snapshot older than seq.
+func removeSnapshotsBefore(dir string, seq uint64) error {
+	seqs, err := listSnapshots(dir)
+	if err != nil {
+		return err
+	}
+	for _, old := range seqs {
+		if old >= seq {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, snapshotName(old))); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove old snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// Snapshot writes a point-in-time snapshot of all counters and compacts the
+// WAL segments it covers.
+func (cm *CounterManager) Snapshot() error {
+	if cm.wal == nil {
+		return fmt.Errorf("WAL is not enabled")
+	}
+	cm.snapshotRun.Lock()
+	defer cm.snapshotRun.Unlock()
+
+	// Block mutations only while sealing the active segment and copying
+	// values, so the copy reflects exactly the sealed segments.
+	cm.mutations.Lock()
+	seq, err := cm.wal.rotate()
+	if err == nil {
+		err = cm.carryForward()
+	}
+	if err != nil {
+		cm.mutations.Unlock()
+		return err
+	}
+	values := make(map[string]int64)
+	epochs := make(map[string]int64)
+	cm.counters.Range(func(key, value any) bool {
+		c := value.(*Counter)
+		values[key.(string)] = c.Value
+		if c.Epoch != 0 {
+			epochs[key.(string)] = c.Epoch
+		}
+		return true
+	})
+	var tombstones []string
+	cm.tombstones.Range(func(key, _ any) bool {
+		tombstones = append(tombstones, key.(string))
+		return true
+	})
+	cm.mutations.Unlock()
+
+	createdAt := time.Now()
+	size, err := writeSnapshot(cm.wal.dir, seq, createdAt, values, epochs, tombstones)
+	if err != nil {
+		return err
+	}
+
+	cm.statsMu.Lock()
+	cm.lastSnapshot = SnapshotStats{LastSnapshotAt: createdAt, SizeBytes: size, Counters: len(values)}
+	cm.statsMu.Unlock()
+
+	if err := cm.wal.compact(seq); err != nil {
+		return err
+	}
+	if err := removeSnapshotsBefore(cm.wal.dir, seq); err != nil {
+		return err
+	}
+	log.Printf("Stored snapshot %d with %d counters (%d bytes)", seq, len(values), size)
+	return nil
+}
+
+// SnapshotStats reports the age and size of the latest snapshot and the
+// amount of WAL that would be replayed on top of it.
+func (cm *CounterManager) SnapshotStats() SnapshotStats {
+	cm.statsMu.Lock()
+	stats := cm.lastSnapshot
+	cm.statsMu.Unlock()
+
+	if !stats.LastSnapshotAt.IsZero() {
+		stats.AgeSeconds = time.Since(stats.LastSnapshotAt).Seconds()
+	}
+	if cm.wal != nil {
+		stats.WALSegments, stats.WALBytes = cm.wal.stats()
+	}
+	return stats
+}
+
+// RunSnapshots takes snapshots whenever the interval elapses or the WAL grows
+// beyond the configured size, until stop is closed.
+func (cm *CounterManager) RunSnapshots(opts SnapshotOptions, stop <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			stats := cm.SnapshotStats()
+			if stats.WALBytes == 0 {
+				continue // Nothing logged since the last snapshot.
+			}
+			due := opts.Interval > 0 && (stats.LastSnapshotAt.IsZero() || time.Since(stats.LastSnapshotAt) >= opts.Interval)
+			oversized := opts.MaxWALBytes > 0 && stats.WALBytes >= opts.MaxWALBytes
+			if !due && !oversized {
+				continue
+			}
+			if err := cm.Snapshot(); err != nil {
+				log.Printf("Error taking snapshot: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
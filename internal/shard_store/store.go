@@ -1,18 +1,46 @@
 package counter
 
 import (
+	"errors"
+	"fmt"
+	"sharded-counters/internal/utils"
 	"sync"
 )
 
+// ErrOverflow is returned when a mutation would overflow a counter's int64 value.
+var ErrOverflow = errors.New("counter value would overflow int64")
+
+// ErrCounterDeleted is returned when mutating a counter that has been deleted.
+var ErrCounterDeleted = errors.New("counter has been deleted")
+
+// ErrStaleEpoch is returned when a request carries an older epoch than the
+// shard has already seen for the counter, i.e. the counter has been reset
+// since the request's metadata was read.
+var ErrStaleEpoch = errors.New("counter has been reset since the request's epoch")
+
 // Counter represents a single counter with its own lock.
 type Counter struct {
-	Value int64
-	Lock  sync.Mutex
+	Value   int64
+	Epoch   int64 // Reset epoch that Value belongs to.
+	Lock    sync.Mutex
+	deleted bool     // Set under Lock when the counter is removed from the manager.
+	handoff *Handoff // Pending hand-off of the counter's value, guarded by Lock.
 }
 
 // CounterManager manages in-memory counters with granular locking.
 type CounterManager struct {
-	counters sync.Map // Thread-safe storage for counters.
+	counters   sync.Map // Thread-safe storage for counters.
+	tombstones sync.Map // IDs of deleted counters, which must not be recreated.
+	wal        *WAL     // Optional write-ahead log; nil keeps counters memory-only.
+
+	appliedMu    sync.Mutex
+	applied      map[string]struct{} // Operation IDs applied by AddOnceAtEpoch.
+	appliedOrder []string            // Applied operation IDs, oldest first.
+
+	mutations    sync.RWMutex // Held shared by mutations, exclusively while a snapshot seals the WAL.
+	snapshotRun  sync.Mutex   // Serializes snapshots.
+	statsMu      sync.Mutex
+	lastSnapshot SnapshotStats
 }
 
 var (
@@ -23,41 +51,254 @@ var (
 // GetCounterManager returns the singleton instance of CounterManager.
 func GetCounterManager() *CounterManager {
 	instanceOnce.Do(func() {
-		instance = &CounterManager{}
+		instance = NewCounterManager()
 	})
 	return instance
 }
 
-// Increment increments the counter for the given ID with a granular lock.
-func (cm *CounterManager) Increment(counterID string) int64 {
-	// Load or create the counter.
-	counter, _ := cm.counters.LoadOrStore(counterID, &Counter{})
+// NewCounterManager creates an empty, memory-only CounterManager.
+func NewCounterManager() *CounterManager {
+	return &CounterManager{}
+}
 
-	// Cast to the Counter type.
-	c := counter.(*Counter)
+// EnableWAL restores the latest snapshot in opts.Dir, replays the write-ahead
+// log written after it and then records every subsequent mutation in the log.
+// It must be called before the manager starts serving requests.
+func (cm *CounterManager) EnableWAL(opts WALOptions) error {
+	if cm.wal != nil {
+		return fmt.Errorf("WAL already enabled")
+	}
+	snap, err := loadLatestSnapshot(opts.Dir)
+	if err != nil {
+		return err
+	}
+	var snapshotSeq uint64
+	if snap != nil {
+		for id, value := range snap.Values {
+			cm.counters.Store(id, &Counter{Value: value, Epoch: snap.Epochs[id]})
+		}
+		for _, id := range snap.Tombstones {
+			cm.tombstones.Store(id, struct{}{})
+		}
+		snapshotSeq = snap.Seq
+		cm.lastSnapshot = SnapshotStats{LastSnapshotAt: snap.CreatedAt, SizeBytes: snap.Size, Counters: len(snap.Values)}
+	}
+	wal, err := openWAL(opts, snapshotSeq, cm.replay)
+	if err != nil {
+		return err
+	}
+	cm.wal = wal
+	return nil
+}
 
-	// Lock the specific counter and increment.
-	c.Lock.Lock()
-	defer c.Lock.Unlock()
+// Close flushes and closes the write-ahead log, if one is enabled.
+func (cm *CounterManager) Close() error {
+	if cm.wal == nil {
+		return nil
+	}
+	return cm.wal.Close()
+}
 
-	c.Value++
-	return c.Value
+// CheckWAL reports whether mutations can still be logged; it is nil when the
+// WAL is not enabled.
+func (cm *CounterManager) CheckWAL() error {
+	if cm.wal == nil {
+		return nil
+	}
+	return cm.wal.Check()
+}
+
+// replay applies a logged mutation without logging it again.
+func (cm *CounterManager) replay(rec walRecord) {
+	if rec.Op == opDelete {
+		cm.tombstones.Store(rec.CounterID, struct{}{})
+		cm.counters.Delete(rec.CounterID)
+		return
+	}
+	// An add racing a Delete can be logged after the delete; the tombstone
+	// still wins.
+	if cm.isDeleted(rec.CounterID) {
+		return
+	}
+	if rec.Op == opAddOnce {
+		if cm.isApplied(rec.ID) {
+			return
+		}
+		cm.markApplied(rec.ID)
+		if rec.Delta == 0 {
+			return // Carried forward past a snapshot only to remember the ID.
+		}
+	}
+	counter, _ := cm.counters.LoadOrStore(rec.CounterID, &Counter{})
+	c := counter.(*Counter)
+	switch rec.Op {
+	case opHandoffStart:
+		c.Value -= rec.Delta
+		fallthrough
+	case opHandoffPending:
+		c.handoff = &Handoff{ID: rec.ID, Target: rec.Target, Value: rec.Delta, Epoch: rec.Epoch}
+		return
+	case opHandoffEnd:
+		if c.handoff != nil && c.handoff.ID == rec.ID {
+			c.Value += rec.Delta
+			c.handoff = nil
+		}
+		return
+	}
+	if rec.Op != opAdd && rec.Epoch > c.Epoch {
+		c.Value, c.Epoch, c.handoff = 0, rec.Epoch, nil
+	}
+	c.Value += rec.Delta
+}
+
+// Increment increments the counter for the given ID with a granular lock.
+func (cm *CounterManager) Increment(counterID string) (int64, error) {
+	return cm.Add(counterID, 1)
 }
 
 // Decrement decrements the counter for the given ID with a granular lock.
-func (cm *CounterManager) Decrement(counterID string) int64 {
+func (cm *CounterManager) Decrement(counterID string) (int64, error) {
+	return cm.Add(counterID, -1)
+}
+
+// Add atomically adds a signed delta to the counter for the given ID in
+// whatever epoch the counter is in, logging the mutation first when a WAL is
+// enabled. It returns ErrOverflow without changing the counter if the result
+// does not fit in an int64.
+func (cm *CounterManager) Add(counterID string, delta int64) (int64, error) {
+	return cm.add(counterID, nil, delta, "")
+}
+
+// AddAtEpoch is like Add, but applies the delta in the given reset epoch. A
+// newer epoch than the counter's discards the value from the older epoch
+// before applying the delta; an older one is rejected with ErrStaleEpoch.
+func (cm *CounterManager) AddAtEpoch(counterID string, epoch, delta int64) (int64, error) {
+	return cm.add(counterID, &epoch, delta, "")
+}
+
+// add applies delta, in the given epoch when it is not nil, and only once
+// per operation ID when one is given.
+func (cm *CounterManager) add(counterID string, epoch *int64, delta int64, operationID string) (int64, error) {
+	cm.mutations.RLock()
+	defer cm.mutations.RUnlock()
+
+	if cm.isDeleted(counterID) {
+		return 0, ErrCounterDeleted
+	}
+
 	// Load or create the counter.
 	counter, _ := cm.counters.LoadOrStore(counterID, &Counter{})
 
 	// Cast to the Counter type.
 	c := counter.(*Counter)
 
-	// Lock the specific counter and increment.
+	// Lock the specific counter so the log order matches the apply order.
 	c.Lock.Lock()
 	defer c.Lock.Unlock()
 
-	c.Value--
-	return c.Value
+	// Re-check under the lock: a concurrent Delete may have removed this
+	// counter, or tombstoned the ID after this call created a fresh one.
+	if c.deleted || cm.isDeleted(counterID) {
+		cm.counters.CompareAndDelete(counterID, c)
+		return 0, ErrCounterDeleted
+	}
+
+	rec := walRecord{Op: opAdd, CounterID: counterID, Delta: delta}
+	current, currentEpoch := c.Value, c.Epoch
+	if epoch != nil {
+		if *epoch < c.Epoch {
+			return c.Value, ErrStaleEpoch
+		}
+		if *epoch > c.Epoch {
+			current, currentEpoch = 0, *epoch
+		}
+		rec.Op, rec.Epoch = opAddAtEpoch, *epoch
+	}
+	if operationID != "" {
+		if cm.isApplied(operationID) {
+			return c.Value, nil
+		}
+		rec.Op, rec.ID = opAddOnce, operationID
+	}
+
+	newValue, ok := utils.CheckedAdd(current, delta)
+	if !ok {
+		return c.Value, ErrOverflow
+	}
+
+	if cm.wal != nil {
+		if err := cm.wal.Append(rec); err != nil {
+			return c.Value, err
+		}
+	}
+
+	if operationID != "" {
+		cm.markApplied(operationID)
+	}
+	if currentEpoch != c.Epoch {
+		c.handoff = nil // A value from the older epoch no longer counts anywhere.
+	}
+	c.Value, c.Epoch = newValue, currentEpoch
+	return c.Value, nil
+}
+
+// Count returns the number of counters the shard holds.
+func (cm *CounterManager) Count() int {
+	n := 0
+	cm.counters.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// CountNonZero returns the number of counters holding a non-zero value,
+// including values in pending hand-offs.
+func (cm *CounterManager) CountNonZero() int {
+	n := 0
+	cm.counters.Range(func(_, value any) bool {
+		c := value.(*Counter)
+		c.Lock.Lock()
+		if c.Value != 0 || c.handoff != nil {
+			n++
+		}
+		c.Lock.Unlock()
+		return true
+	})
+	return n
+}
+
+// Delete removes a counter and tombstones its ID so that later mutations are
+// rejected with ErrCounterDeleted instead of recreating it. Deleting an
+// unknown counter still tombstones the ID.
+func (cm *CounterManager) Delete(counterID string) error {
+	cm.mutations.RLock()
+	defer cm.mutations.RUnlock()
+
+	if cm.isDeleted(counterID) {
+		return nil
+	}
+	if cm.wal != nil {
+		if err := cm.wal.Append(walRecord{Op: opDelete, CounterID: counterID}); err != nil {
+			return err
+		}
+	}
+	cm.tombstones.Store(counterID, struct{}{})
+
+	if counter, ok := cm.counters.Load(counterID); ok {
+		c := counter.(*Counter)
+		c.Lock.Lock()
+		c.deleted = true
+		cm.counters.CompareAndDelete(counterID, c)
+		c.Lock.Unlock()
+	}
+	return nil
+}
+
+// isDeleted reports whether the counter ID has been tombstoned.
+func (cm *CounterManager) isDeleted(counterID string) bool {
+	_, ok := cm.tombstones.Load(counterID)
+	return ok
 }
 
 // Get retrieves the current value of a counter.
@@ -68,3 +309,24 @@ func (cm *CounterManager) Get(counterID string) int64 {
 	}
 	return 0 // Default value if counter doesn't exist.
 }
+
+// GetAtEpoch retrieves the value of a counter in the given reset epoch. A
+// value from an older epoch counts as zero; ErrStaleEpoch is returned when
+// the counter is already in a newer epoch.
+func (cm *CounterManager) GetAtEpoch(counterID string, epoch int64) (int64, error) {
+	counter, ok := cm.counters.Load(counterID)
+	if !ok {
+		return 0, nil
+	}
+	c := counter.(*Counter)
+	c.Lock.Lock()
+	defer c.Lock.Unlock()
+
+	switch {
+	case c.Epoch < epoch:
+		return 0, nil
+	case c.Epoch > epoch:
+		return 0, ErrStaleEpoch
+	}
+	return c.Value, nil
+}
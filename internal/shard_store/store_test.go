@@ -1,6 +1,8 @@
 package counter_test
 
 import (
+	"errors"
+	"math"
 	"math/rand"
 	counter "sharded-counters/internal/shard_store"
 	"testing"
@@ -79,3 +81,161 @@ func TestConcurrentIncrementAndDecrement(t *testing.T) {
 		t.Errorf("Counter value mismatch: expected %d, got %d", expectedValue, actualValue)
 	}
 }
+
+func TestAddDelta(t *testing.T) {
+	manager := counter.NewCounterManager()
+
+	// Test Case 1: Signed deltas are applied
+	t.Run("SignedDelta", func(t *testing.T) {
+		if _, err := manager.Add("bytes", 1024); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		value, err := manager.Add("bytes", -24)
+		if err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		if value != 1000 {
+			t.Errorf("Expected 1000, got %d", value)
+		}
+	})
+
+	// Test Case 2: Overflow is rejected without changing the value
+	t.Run("Overflow", func(t *testing.T) {
+		if _, err := manager.Add("near-max", math.MaxInt64-1); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+		_, err := manager.Add("near-max", 2)
+		if !errors.Is(err, counter.ErrOverflow) {
+			t.Fatalf("Expected ErrOverflow, got %v", err)
+		}
+		if got := manager.Get("near-max"); got != math.MaxInt64-1 {
+			t.Errorf("Expected value to stay at %d, got %d", int64(math.MaxInt64-1), got)
+		}
+	})
+}
+
+func TestResetEpochs(t *testing.T) {
+	manager := counter.NewCounterManager()
+
+	if _, err := manager.AddAtEpoch("quota", 0, 7); err != nil {
+		t.Fatalf("AddAtEpoch failed: %v", err)
+	}
+
+	// Test Case 1: Reads in a newer epoch ignore the older value
+	t.Run("ReadNewerEpoch", func(t *testing.T) {
+		value, err := manager.GetAtEpoch("quota", 1)
+		if err != nil || value != 0 {
+			t.Errorf("Expected 0 in epoch 1, got %d (%v)", value, err)
+		}
+	})
+
+	// Test Case 2: The first mutation in a newer epoch discards the older value
+	t.Run("MutateNewerEpoch", func(t *testing.T) {
+		value, err := manager.AddAtEpoch("quota", 1, 2)
+		if err != nil || value != 2 {
+			t.Errorf("Expected 2 in epoch 1, got %d (%v)", value, err)
+		}
+	})
+
+	// Test Case 3: Requests from an older epoch are rejected
+	t.Run("StaleEpoch", func(t *testing.T) {
+		if _, err := manager.AddAtEpoch("quota", 0, 1); !errors.Is(err, counter.ErrStaleEpoch) {
+			t.Errorf("Expected ErrStaleEpoch for mutation, got %v", err)
+		}
+		if _, err := manager.GetAtEpoch("quota", 0); !errors.Is(err, counter.ErrStaleEpoch) {
+			t.Errorf("Expected ErrStaleEpoch for read, got %v", err)
+		}
+		if got := manager.Get("quota"); got != 2 {
+			t.Errorf("Expected value to stay at 2, got %d", got)
+		}
+	})
+}
+
+func TestHandoff(t *testing.T) {
+	manager := counter.NewCounterManager()
+	if _, err := manager.AddAtEpoch("moving", 2, 42); err != nil {
+		t.Fatalf("AddAtEpoch failed: %v", err)
+	}
+
+	// Test Case 1: The value is taken out of the counter while the hand-off is pending
+	handoff, err := manager.StartHandoff("moving", "shard2")
+	t.Run("Start", func(t *testing.T) {
+		if err != nil || handoff.ID == "" || handoff.Target != "shard2" || handoff.Value != 42 || handoff.Epoch != 2 {
+			t.Fatalf("Expected to hand off 42 in epoch 2 to shard2, got %+v (%v)", handoff, err)
+		}
+		if remaining := manager.Get("moving"); remaining != 0 {
+			t.Errorf("Expected 0 while the hand-off is pending, got %d", remaining)
+		}
+		if n := manager.CountNonZero(); n != 1 {
+			t.Errorf("Expected the pending value to be counted, got %d", n)
+		}
+	})
+
+	// Test Case 2: Starting again returns the pending hand-off, even for another target
+	t.Run("Retry", func(t *testing.T) {
+		manager.AddAtEpoch("moving", 2, 1)
+		again, err := manager.StartHandoff("moving", "shard3")
+		if err != nil || again != handoff {
+			t.Errorf("Expected the pending hand-off %+v, got %+v (%v)", handoff, again, err)
+		}
+	})
+
+	// Test Case 3: Aborting puts the value back
+	t.Run("Abort", func(t *testing.T) {
+		if err := manager.AbortHandoff("moving", handoff.ID); err != nil {
+			t.Fatalf("AbortHandoff failed: %v", err)
+		}
+		if got := manager.Get("moving"); got != 43 {
+			t.Errorf("Expected 43 after the abort, got %d", got)
+		}
+		if err := manager.AbortHandoff("moving", handoff.ID); err != nil || manager.Get("moving") != 43 {
+			t.Errorf("Expected a second abort to change nothing, got %d (%v)", manager.Get("moving"), err)
+		}
+	})
+
+	// Test Case 4: Completing drops the value, and the next hand-off gets a new ID
+	t.Run("Complete", func(t *testing.T) {
+		next, err := manager.StartHandoff("moving", "shard2")
+		if err != nil || next.ID == handoff.ID || next.Value != 43 {
+			t.Fatalf("Expected a new hand-off of 43, got %+v (%v)", next, err)
+		}
+		if err := manager.CompleteHandoff("moving", next.ID); err != nil {
+			t.Fatalf("CompleteHandoff failed: %v", err)
+		}
+		if got := manager.Get("moving"); got != 0 {
+			t.Errorf("Expected 0 after the hand-off, got %d", got)
+		}
+		if empty, err := manager.StartHandoff("moving", "shard2"); err != nil || empty.Value != 0 {
+			t.Errorf("Expected nothing left to hand off, got %+v (%v)", empty, err)
+		}
+	})
+
+	// Test Case 5: A reset drops the pending hand-off with the value of the older epoch
+	t.Run("Reset", func(t *testing.T) {
+		manager.AddAtEpoch("moving", 2, 5)
+		pending, _ := manager.StartHandoff("moving", "shard2")
+		manager.AddAtEpoch("moving", 3, 1)
+		if err := manager.AbortHandoff("moving", pending.ID); err != nil {
+			t.Fatalf("AbortHandoff failed: %v", err)
+		}
+		if got, err := manager.GetAtEpoch("moving", 3); err != nil || got != 1 {
+			t.Errorf("Expected 1 in epoch 3, got %d (%v)", got, err)
+		}
+	})
+}
+
+func TestAddOnceAtEpoch(t *testing.T) {
+	manager := counter.NewCounterManager()
+
+	for i := 0; i < 2; i++ {
+		if got, err := manager.AddOnceAtEpoch("target", "op-1", 1, 5); err != nil || got != 5 {
+			t.Errorf("Expected 5 after attempt %d, got %d (%v)", i+1, got, err)
+		}
+	}
+	if got, err := manager.AddOnceAtEpoch("target", "op-2", 1, 2); err != nil || got != 7 {
+		t.Errorf("Expected another operation to apply, got %d (%v)", got, err)
+	}
+	if _, err := manager.AddOnceAtEpoch("target", "", 1, 2); !errors.Is(err, counter.ErrInvalidOperationID) {
+		t.Errorf("Expected ErrInvalidOperationID, got %v", err)
+	}
+}
@@ -0,0 +1,511 @@
+package counter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncPolicy controls when appended WAL records are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs the log after every record.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs the log periodically from a background goroutine.
+	SyncInterval
+	// SyncNone never fsyncs explicitly and leaves flushing to the OS.
+	SyncNone
+)
+
+// ParseSyncPolicy converts a policy name (always, interval, none) to a SyncPolicy.
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch strings.ToLower(name) {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncInterval, nil
+	case "none":
+		return SyncNone, nil
+	}
+	return SyncAlways, fmt.Errorf("unknown WAL sync policy %q", name)
+}
+
+// WALOptions configures the write-ahead log of a CounterManager.
+type WALOptions struct {
+	Dir          string        // Directory holding log segments and snapshots.
+	SyncPolicy   SyncPolicy    // When to fsync appended records.
+	SyncInterval time.Duration // Flush period for SyncInterval.
+}
+
+const (
+	segmentPrefix = "wal-"
+	segmentSuffix = ".log"
+)
+
+// walOp identifies the mutation recorded in a WAL record.
+type walOp byte
+
+const (
+	// opAdd adds a signed delta to a counter.
+	opAdd walOp = iota + 1
+	// opDelete removes a counter and tombstones its ID.
+	opDelete
+	// opAddAtEpoch adds a signed delta to a counter in a reset epoch.
+	opAddAtEpoch
+	// opHandoffStart takes Delta out of a counter into the pending hand-off
+	// ID to Target.
+	opHandoffStart
+	// opHandoffPending restores a pending hand-off carried forward past a
+	// snapshot, which already excludes its value.
+	opHandoffPending
+	// opHandoffEnd ends the hand-off ID, adding Delta back to the counter:
+	// zero when the target has the value, the value when it was not applied.
+	opHandoffEnd
+	// opAddOnce adds a signed delta to a counter in a reset epoch unless the
+	// operation ID has already been applied. Snapshots carry the applied IDs
+	// forward as records with a zero delta.
+	opAddOnce
+)
+
+// walRecord is a single logged mutation.
+type walRecord struct {
+	Op        walOp
+	CounterID string
+	Delta     int64
+	Epoch     int64  // Set for every op but opAdd and opDelete.
+	ID        string // Hand-off ID of the hand-off ops, operation ID of opAddOnce.
+	Target    string // Target shard of opHandoffStart and opHandoffPending.
+}
+
+// Each record is framed as [crc32 uint32][payload length uint32][payload],
+// where payload is [op byte][delta int64][counter id bytes], and opAddAtEpoch
+// has [epoch int64] between delta and ID. The hand-off ops and opAddOnce
+// follow the epoch with [id length uint16][id][target length uint16][target].
+// The checksum covers the payload.
+const walHeaderSize = 8
+
+var errCorruptRecord = errors.New("corrupt WAL record")
+
+// WAL is an append-only log of counter mutations split into numbered segments.
+// A new segment is started on every snapshot so that segments fully covered
+// by the snapshot can be deleted.
+type WAL struct {
+	mu        sync.Mutex
+	dir       string
+	file      *os.File // Active segment.
+	seq       uint64   // Sequence number of the active segment.
+	size      int64    // Bytes in the active segment.
+	sealed    []uint64 // Older segments not yet covered by a snapshot.
+	sealedLen int64    // Bytes in sealed segments.
+	opts      WALOptions
+	dirty     bool  // Records written since the last fsync.
+	failed    error // Last failed write or fsync since the last Check.
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func segmentName(seq uint64) string {
+	return fmt.Sprintf("%s%016d%s", segmentPrefix, seq, segmentSuffix)
+}
+
+// listSegments returns the sequence numbers of all segments in dir, ascending.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list WAL directory: %w", err)
+	}
+	var seqs []uint64
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, segmentPrefix) || !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		var seq uint64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(strings.TrimPrefix(name, segmentPrefix), segmentSuffix), "%d", &seq); err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// openWAL replays every segment newer than snapshotSeq through apply and
+// positions the newest segment for appending. Segments already covered by the
+// snapshot are removed, and a torn or corrupt tail left by a crash in the
+// newest segment is truncated away.
+func openWAL(opts WALOptions, snapshotSeq uint64, apply func(walRecord)) (*WAL, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create WAL directory: %w", err)
+	}
+	seqs, err := listSegments(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{dir: opts.Dir, opts: opts, seq: snapshotSeq + 1}
+	var replayed int
+	for i, seq := range seqs {
+		path := filepath.Join(opts.Dir, segmentName(seq))
+		if seq <= snapshotSeq {
+			if err := os.Remove(path); err != nil {
+				return nil, fmt.Errorf("failed to remove compacted WAL segment: %w", err)
+			}
+			continue
+		}
+		last := i == len(seqs)-1
+		file, err := os.OpenFile(path, os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open WAL segment: %w", err)
+		}
+		validSize, count, err := replaySegment(file, apply)
+		replayed += count
+		if err != nil && !last {
+			file.Close()
+			return nil, fmt.Errorf("WAL segment %s is corrupt: %w", path, err)
+		}
+		if !last {
+			file.Close()
+			w.sealed = append(w.sealed, seq)
+			w.sealedLen += validSize
+			continue
+		}
+		if err != nil {
+			log.Printf("Discarding WAL tail of %s at offset %d: %v", path, validSize, err)
+		}
+		if err := file.Truncate(validSize); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to truncate WAL tail: %w", err)
+		}
+		if _, err := file.Seek(validSize, io.SeekStart); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to seek WAL: %w", err)
+		}
+		w.file, w.seq, w.size = file, seq, validSize
+	}
+
+	if w.file == nil {
+		if err := w.createSegment(w.seq); err != nil {
+			return nil, err
+		}
+	}
+	log.Printf("Replayed %d WAL records from %s", replayed, opts.Dir)
+
+	if opts.SyncPolicy == SyncInterval {
+		if opts.SyncInterval <= 0 {
+			w.opts.SyncInterval = time.Second
+		}
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncLoop()
+	}
+	return w, nil
+}
+
+// replaySegment applies every intact record and returns the offset just past
+// the last one, along with the error that stopped the replay, if any.
+func replaySegment(file *os.File, apply func(walRecord)) (int64, int, error) {
+	reader := bufio.NewReader(file)
+	var offset int64
+	var count int
+	for {
+		rec, size, err := readRecord(reader)
+		if err == io.EOF {
+			return offset, count, nil
+		}
+		if err != nil {
+			return offset, count, err
+		}
+		apply(rec)
+		offset += size
+		count++
+	}
+}
+
+func readRecord(r io.Reader) (walRecord, int64, error) {
+	var header [walHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF {
+			return walRecord{}, 0, io.EOF
+		}
+		return walRecord{}, 0, errCorruptRecord
+	}
+	checksum := binary.BigEndian.Uint32(header[0:4])
+	length := binary.BigEndian.Uint32(header[4:8])
+	if length < 1 || length > 1<<20 {
+		return walRecord{}, 0, errCorruptRecord
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return walRecord{}, 0, errCorruptRecord
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return walRecord{}, 0, errCorruptRecord
+	}
+	rec, err := decodePayload(payload)
+	if err != nil {
+		return walRecord{}, 0, err
+	}
+	return rec, int64(walHeaderSize + length), nil
+}
+
+func decodePayload(payload []byte) (walRecord, error) {
+	rec := walRecord{Op: walOp(payload[0])}
+	switch rec.Op {
+	case opAdd, opDelete:
+		if len(payload) < 9 {
+			return walRecord{}, errCorruptRecord
+		}
+		rec.Delta = int64(binary.BigEndian.Uint64(payload[1:9]))
+		rec.CounterID = string(payload[9:])
+	case opAddAtEpoch:
+		if len(payload) < 17 {
+			return walRecord{}, errCorruptRecord
+		}
+		rec.Delta = int64(binary.BigEndian.Uint64(payload[1:9]))
+		rec.Epoch = int64(binary.BigEndian.Uint64(payload[9:17]))
+		rec.CounterID = string(payload[17:])
+	case opHandoffStart, opHandoffPending, opHandoffEnd, opAddOnce:
+		if len(payload) < 17 {
+			return walRecord{}, errCorruptRecord
+		}
+		rec.Delta = int64(binary.BigEndian.Uint64(payload[1:9]))
+		rec.Epoch = int64(binary.BigEndian.Uint64(payload[9:17]))
+		rest := payload[17:]
+		var ok bool
+		if rec.ID, rest, ok = readPayloadString(rest); !ok {
+			return walRecord{}, errCorruptRecord
+		}
+		if rec.Target, rest, ok = readPayloadString(rest); !ok {
+			return walRecord{}, errCorruptRecord
+		}
+		rec.CounterID = string(rest)
+	default:
+		return walRecord{}, errCorruptRecord
+	}
+	return rec, nil
+}
+
+// readPayloadString reads a length-prefixed string and returns the bytes after it.
+func readPayloadString(data []byte) (string, []byte, bool) {
+	if len(data) < 2 {
+		return "", nil, false
+	}
+	n := int(binary.BigEndian.Uint16(data[:2]))
+	if len(data) < 2+n {
+		return "", nil, false
+	}
+	return string(data[2 : 2+n]), data[2+n:], true
+}
+
+func encodeRecord(rec walRecord) []byte {
+	payload := make([]byte, 9, 17+len(rec.CounterID))
+	payload[0] = byte(rec.Op)
+	binary.BigEndian.PutUint64(payload[1:9], uint64(rec.Delta))
+	if rec.Op != opAdd && rec.Op != opDelete {
+		payload = binary.BigEndian.AppendUint64(payload, uint64(rec.Epoch))
+	}
+	if rec.Op >= opHandoffStart {
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(rec.ID)))
+		payload = append(payload, rec.ID...)
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(rec.Target)))
+		payload = append(payload, rec.Target...)
+	}
+	payload = append(payload, rec.CounterID...)
+
+	buf := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], crc32.ChecksumIEEE(payload))
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(payload)))
+	copy(buf[walHeaderSize:], payload)
+	return buf
+}
+
+// createSegment opens a fresh active segment. Callers hold w.mu or own w exclusively.
+func (w *WAL) createSegment(seq uint64) error {
+	path := filepath.Join(w.dir, segmentName(seq))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create WAL segment: %w", err)
+	}
+	if err := syncDir(w.dir); err != nil {
+		file.Close()
+		return err
+	}
+	w.file, w.seq, w.size = file, seq, 0
+	return nil
+}
+
+// Append writes a record to the log, honouring the configured sync policy.
+func (w *WAL) Append(rec walRecord) error {
+	buf := encodeRecord(rec)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err := w.file.Write(buf)
+	w.size += int64(n)
+	if err != nil {
+		w.failed = fmt.Errorf("failed to append WAL record: %w", err)
+		return w.failed
+	}
+	if w.opts.SyncPolicy == SyncAlways {
+		if err := w.file.Sync(); err != nil {
+			w.failed = fmt.Errorf("failed to sync WAL: %w", err)
+			return w.failed
+		}
+		return nil
+	}
+	w.dirty = true
+	return nil
+}
+
+// rotate seals the active segment and starts a new one. It returns the
+// sequence number of the sealed segment.
+func (w *WAL) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	w.dirty = false
+	sealedSeq, sealedSize := w.seq, w.size
+	if err := w.file.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close WAL segment: %w", err)
+	}
+	if err := w.createSegment(sealedSeq + 1); err != nil {
+		return 0, err
+	}
+	w.sealed = append(w.sealed, sealedSeq)
+	w.sealedLen += sealedSize
+	return sealedSeq, nil
+}
+
+// compact deletes every sealed segment with a sequence number up to throughSeq.
+func (w *WAL) compact(throughSeq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var remaining []uint64
+	for _, seq := range w.sealed {
+		if seq > throughSeq {
+			remaining = append(remaining, seq)
+			continue
+		}
+		path := filepath.Join(w.dir, segmentName(seq))
+		info, err := os.Stat(path)
+		if err == nil {
+			w.sealedLen -= info.Size()
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove WAL segment: %w", err)
+		}
+	}
+	w.sealed = remaining
+	return nil
+}
+
+// stats reports the number of live segments and their total size in bytes.
+func (w *WAL) stats() (int, int64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.sealed) + 1, w.sealedLen + w.size
+}
+
+// syncLoop periodically flushes the log for the SyncInterval policy.
+func (w *WAL) syncLoop() {
+	ticker := time.NewTicker(w.opts.SyncInterval)
+	defer ticker.Stop()
+	defer close(w.done)
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Sync(); err != nil {
+				log.Printf("Error syncing WAL: %v", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+// Sync flushes any unsynced records to stable storage.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.dirty {
+		return nil
+	}
+	if err := w.file.Sync(); err != nil {
+		w.failed = err
+		return err
+	}
+	w.dirty = false
+	return nil
+}
+
+// Check reports whether the log can still be written. It returns the error of
+// a write or fsync that failed since the last check, or else the error of a
+// probe file written and synced in the log's directory.
+func (w *WAL) Check() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.failed; err != nil {
+		w.failed = nil
+		return err
+	}
+	probe, err := os.CreateTemp(w.dir, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("WAL directory is not writable: %w", err)
+	}
+	defer os.Remove(probe.Name())
+	defer probe.Close()
+	if _, err := probe.Write([]byte{0}); err != nil {
+		return fmt.Errorf("WAL directory is not writable: %w", err)
+	}
+	if err := probe.Sync(); err != nil {
+		return fmt.Errorf("WAL directory cannot be synced: %w", err)
+	}
+	return nil
+}
+
+// Close stops background syncing, flushes pending records and closes the log.
+func (w *WAL) Close() error {
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	if err := w.Sync(); err != nil {
+		w.file.Close()
+		return fmt.Errorf("failed to sync WAL on close: %w", err)
+	}
+	return w.file.Close()
+}
+
+// syncDir fsyncs a directory so that file creations and renames are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory for sync: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
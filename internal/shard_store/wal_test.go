@@ -0,0 +1,290 @@
+package counter_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	counter "sharded-counters/internal/shard_store"
+	"testing"
+)
+
+func TestWALReplay(t *testing.T) {
+	dir := t.TempDir()
+	opts := counter.WALOptions{Dir: dir, SyncPolicy: counter.SyncAlways}
+
+	// Test Case 1: Values survive a restart
+	t.Run("ReplayAfterRestart", func(t *testing.T) {
+		manager := counter.NewCounterManager()
+		if err := manager.EnableWAL(opts); err != nil {
+			t.Fatalf("EnableWAL failed: %v", err)
+		}
+		for i := 0; i < 5; i++ {
+			if _, err := manager.Increment("replayed"); err != nil {
+				t.Fatalf("Increment failed: %v", err)
+			}
+		}
+		if _, err := manager.Decrement("replayed"); err != nil {
+			t.Fatalf("Decrement failed: %v", err)
+		}
+		if err := manager.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+
+		restarted := counter.NewCounterManager()
+		if err := restarted.EnableWAL(opts); err != nil {
+			t.Fatalf("EnableWAL after restart failed: %v", err)
+		}
+		defer restarted.Close()
+
+		if got := restarted.Get("replayed"); got != 4 {
+			t.Errorf("Expected replayed value 4, got %d", got)
+		}
+	})
+
+	// Test Case 2: A torn record at the tail is discarded
+	t.Run("TornTail", func(t *testing.T) {
+		path := filepath.Join(dir, "wal-0000000000000001.log")
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			t.Fatalf("Failed to open WAL: %v", err)
+		}
+		if _, err := file.Write([]byte{0xde, 0xad, 0xbe}); err != nil {
+			t.Fatalf("Failed to write torn record: %v", err)
+		}
+		file.Close()
+
+		manager := counter.NewCounterManager()
+		if err := manager.EnableWAL(opts); err != nil {
+			t.Fatalf("EnableWAL failed: %v", err)
+		}
+		if got := manager.Get("replayed"); got != 4 {
+			t.Errorf("Expected value 4 after torn tail, got %d", got)
+		}
+
+		// New records must land after the truncated tail and replay cleanly.
+		if _, err := manager.Increment("replayed"); err != nil {
+			t.Fatalf("Increment failed: %v", err)
+		}
+		manager.Close()
+
+		restarted := counter.NewCounterManager()
+		if err := restarted.EnableWAL(opts); err != nil {
+			t.Fatalf("EnableWAL after restart failed: %v", err)
+		}
+		defer restarted.Close()
+		if got := restarted.Get("replayed"); got != 5 {
+			t.Errorf("Expected value 5 after restart, got %d", got)
+		}
+	})
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+	dir := t.TempDir()
+	opts := counter.WALOptions{Dir: dir, SyncPolicy: counter.SyncNone}
+
+	manager := counter.NewCounterManager()
+	if err := manager.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		manager.Increment("snapshotted")
+	}
+	if err := manager.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	manager.Decrement("snapshotted")
+
+	stats := manager.SnapshotStats()
+	if stats.Counters != 1 || stats.SizeBytes == 0 {
+		t.Errorf("Unexpected snapshot stats: %+v", stats)
+	}
+	if stats.WALSegments != 1 {
+		t.Errorf("Expected compaction to leave 1 WAL segment, got %d", stats.WALSegments)
+	}
+	manager.Close()
+
+	segments, _ := filepath.Glob(filepath.Join(dir, "wal-*.log"))
+	if len(segments) != 1 {
+		t.Errorf("Expected 1 WAL segment on disk, got %v", segments)
+	}
+
+	restarted := counter.NewCounterManager()
+	if err := restarted.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL after restart failed: %v", err)
+	}
+	defer restarted.Close()
+	if got := restarted.Get("snapshotted"); got != 9 {
+		t.Errorf("Expected value 9 from snapshot plus WAL, got %d", got)
+	}
+}
+
+func TestDeleteSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	opts := counter.WALOptions{Dir: dir, SyncPolicy: counter.SyncNone}
+
+	manager := counter.NewCounterManager()
+	if err := manager.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL failed: %v", err)
+	}
+	manager.Add("snapshotted", 3)
+	manager.Add("logged", 5)
+	if err := manager.Delete("snapshotted"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := manager.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	if err := manager.Delete("logged"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	manager.Close()
+
+	restarted := counter.NewCounterManager()
+	if err := restarted.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL after restart failed: %v", err)
+	}
+	defer restarted.Close()
+	for _, id := range []string{"snapshotted", "logged"} {
+		if got := restarted.Get(id); got != 0 {
+			t.Errorf("Expected %s to stay deleted, got %d", id, got)
+		}
+		if _, err := restarted.Add(id, 1); !errors.Is(err, counter.ErrCounterDeleted) {
+			t.Errorf("Expected ErrCounterDeleted for %s, got %v", id, err)
+		}
+	}
+}
+
+func TestAddLoggedAfterDelete(t *testing.T) {
+	opts := counter.WALOptions{Dir: t.TempDir(), SyncPolicy: counter.SyncNone}
+
+	manager := counter.NewCounterManager()
+	if err := manager.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL failed: %v", err)
+	}
+	manager.Add("raced", 3)
+	if err := manager.Delete("raced"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if err := manager.LogAdd("raced", 5); err != nil {
+		t.Fatalf("LogAdd failed: %v", err)
+	}
+	manager.Close()
+
+	restarted := counter.NewCounterManager()
+	if err := restarted.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL after restart failed: %v", err)
+	}
+	defer restarted.Close()
+	if got := restarted.Get("raced"); got != 0 {
+		t.Errorf("Expected the add logged after the delete to be ignored, got %d", got)
+	}
+	if _, err := restarted.Add("raced", 1); !errors.Is(err, counter.ErrCounterDeleted) {
+		t.Errorf("Expected ErrCounterDeleted, got %v", err)
+	}
+}
+
+func TestEpochSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	opts := counter.WALOptions{Dir: dir, SyncPolicy: counter.SyncNone}
+
+	manager := counter.NewCounterManager()
+	if err := manager.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL failed: %v", err)
+	}
+	manager.AddAtEpoch("snapshotted", 0, 5)
+	manager.AddAtEpoch("snapshotted", 2, 1)
+	manager.AddAtEpoch("logged", 0, 5)
+	if err := manager.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	manager.AddAtEpoch("logged", 1, 3)
+	manager.Close()
+
+	restarted := counter.NewCounterManager()
+	if err := restarted.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL after restart failed: %v", err)
+	}
+	defer restarted.Close()
+	if got, err := restarted.GetAtEpoch("snapshotted", 2); err != nil || got != 1 {
+		t.Errorf("Expected 1 in epoch 2 from snapshot, got %d (%v)", got, err)
+	}
+	if got, err := restarted.GetAtEpoch("logged", 1); err != nil || got != 3 {
+		t.Errorf("Expected 3 in epoch 1 from WAL, got %d (%v)", got, err)
+	}
+	if _, err := restarted.AddAtEpoch("snapshotted", 1, 1); !errors.Is(err, counter.ErrStaleEpoch) {
+		t.Errorf("Expected ErrStaleEpoch after restart, got %v", err)
+	}
+}
+
+func TestHandoffSurvivesRestart(t *testing.T) {
+	opts := counter.WALOptions{Dir: t.TempDir(), SyncPolicy: counter.SyncNone}
+
+	manager := counter.NewCounterManager()
+	if err := manager.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL failed: %v", err)
+	}
+	manager.AddAtEpoch("source", 1, 5)
+	manager.AddAtEpoch("logged", 1, 3)
+	snapshotted, err := manager.StartHandoff("source", "shard2")
+	if err != nil {
+		t.Fatalf("StartHandoff failed: %v", err)
+	}
+	manager.AddOnceAtEpoch("target", "op-1", 1, 4)
+	if err := manager.Snapshot(); err != nil {
+		t.Fatalf("Snapshot failed: %v", err)
+	}
+	logged, err := manager.StartHandoff("logged", "shard2")
+	if err != nil {
+		t.Fatalf("StartHandoff failed: %v", err)
+	}
+	manager.Close()
+
+	restarted := counter.NewCounterManager()
+	if err := restarted.EnableWAL(opts); err != nil {
+		t.Fatalf("EnableWAL after restart failed: %v", err)
+	}
+	defer restarted.Close()
+
+	// Test Case 1: Pending hand-offs keep their IDs across the snapshot and the WAL
+	for id, want := range map[string]counter.Handoff{"source": snapshotted, "logged": logged} {
+		if got, err := restarted.StartHandoff(id, "shard3"); err != nil || got != want {
+			t.Errorf("Expected the pending hand-off %+v of %s, got %+v (%v)", want, id, got, err)
+		}
+		if got := restarted.Get(id); got != 0 {
+			t.Errorf("Expected %s to stay 0 while its hand-off is pending, got %d", id, got)
+		}
+		if err := restarted.AbortHandoff(id, want.ID); err != nil {
+			t.Fatalf("AbortHandoff failed: %v", err)
+		}
+		if got := restarted.Get(id); got != want.Value {
+			t.Errorf("Expected %s to get %d back, got %d", id, want.Value, got)
+		}
+	}
+
+	// Test Case 2: Applied operations are not applied again
+	if got, err := restarted.AddOnceAtEpoch("target", "op-1", 1, 4); err != nil || got != 4 {
+		t.Errorf("Expected the applied operation to be skipped, got %d (%v)", got, err)
+	}
+}
+
+func TestCheckWAL(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "wal")
+	manager := counter.NewCounterManager()
+	if err := manager.CheckWAL(); err != nil {
+		t.Errorf("Expected no error without a WAL, got %v", err)
+	}
+	if err := manager.EnableWAL(counter.WALOptions{Dir: dir, SyncPolicy: counter.SyncNone}); err != nil {
+		t.Fatalf("EnableWAL failed: %v", err)
+	}
+	defer manager.Close()
+
+	if err := manager.CheckWAL(); err != nil {
+		t.Errorf("Expected a writable WAL, got %v", err)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatalf("RemoveAll failed: %v", err)
+	}
+	if err := manager.CheckWAL(); err == nil {
+		t.Error("Expected a WAL whose directory is gone to fail the check")
+	}
+}
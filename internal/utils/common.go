@@ -18,6 +18,15 @@ func GenerateUniqueID() (string, error) {
 	return hex.EncodeToString(bytes), nil
 }
 
+// CheckedAdd returns a+b and whether the sum fits in an int64.
+func CheckedAdd(a, b int64) (int64, bool) {
+	sum := a + b
+	if (b > 0 && sum < a) || (b < 0 && sum > a) {
+		return 0, false
+	}
+	return sum, true
+}
+
 // logShardResponse logs the response details from the shard API.
 func LogResponse(resp *http.Response) {
 	body, err := io.ReadAll(resp.Body)